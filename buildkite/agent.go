@@ -0,0 +1,142 @@
+package buildkite
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const agentEndpoint = "https://agent.buildkite.com/v3/"
+
+// agentClient talks to the Buildkite Agent API, which is how vmkite can act
+// on a job directly when no VM is going to run it
+type agentClient struct {
+	endpoint string
+	token    string
+}
+
+func (c *agentClient) newRequest(method string, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, c.endpoint+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Token "+c.token)
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+func (c *agentClient) send(req *http.Request, v interface{}) error {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s %s: %d %s",
+			req.Method, req.URL.Path, resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	if v != nil {
+		return json.NewDecoder(resp.Body).Decode(v)
+	}
+	return nil
+}
+
+func (c *agentClient) doJSON(method string, path string, body interface{}, v interface{}) error {
+	buf := new(bytes.Buffer)
+	if body != nil {
+		if err := json.NewEncoder(buf).Encode(body); err != nil {
+			return err
+		}
+	}
+	req, err := c.newRequest(method, path, buf)
+	if err != nil {
+		return err
+	}
+	return c.send(req, v)
+}
+
+// FailJob finishes a job with a non-zero exit status and message in its log,
+// by registering a short-lived agent that matches the job's agent query rules
+// and acquiring the job with it. The agent is disconnected afterwards, even if
+// failing the job didn't work, so they don't pile up in the organization.
+func (bk *Session) FailJob(agentToken string, job VmkiteJob, message string) error {
+	debugf("Failing job %s: %s", job.ID, message)
+
+	registration := struct {
+		AccessToken string `json:"access_token"`
+	}{}
+	endpoint := agentEndpoint
+	if bk.AgentEndpoint != "" {
+		endpoint = strings.TrimRight(bk.AgentEndpoint, "/") + "/"
+	}
+
+	err := (&agentClient{endpoint: endpoint, token: agentToken}).doJSON("POST", "register", map[string]interface{}{
+		"name":      "vmkite-" + job.ID,
+		"meta_data": job.AgentQueryRules,
+		"version":   "vmkite",
+	}, &registration)
+	if err != nil {
+		return err
+	}
+
+	agent := &agentClient{endpoint: endpoint, token: registration.AccessToken}
+	defer func() {
+		if err := agent.doJSON("POST", "disconnect", nil, nil); err != nil {
+			debugf("Error disconnecting agent for job %s: %v", job.ID, err)
+		}
+	}()
+	if err = agent.doJSON("POST", "connect", nil, nil); err != nil {
+		return err
+	}
+
+	if err = agent.doJSON("PUT", "jobs/"+job.ID+"/acquire", nil, nil); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	if err = agent.doJSON("PUT", "jobs/"+job.ID+"/start", map[string]string{
+		"started_at": now,
+	}, nil); err != nil {
+		return err
+	}
+
+	log := fmt.Sprintf("vmkite: %s\n", message)
+	if err = agent.uploadChunk(job.ID, log); err != nil {
+		debugf("Error uploading log for job %s: %v", job.ID, err)
+	}
+
+	return agent.doJSON("PUT", "jobs/"+job.ID+"/finish", map[string]interface{}{
+		"exit_status":         "1",
+		"finished_at":         now,
+		"chunks_failed_count": 0,
+	}, nil)
+}
+
+func (c *agentClient) uploadChunk(jobID string, data string) error {
+	body := new(bytes.Buffer)
+	gz := gzip.NewWriter(body)
+	if _, err := gz.Write([]byte(data)); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+
+	req, err := c.newRequest("POST", fmt.Sprintf("jobs/%s/chunks?sequence=1&offset=0&size=%d",
+		jobID, len(data)), body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("Content-Encoding", "gzip")
+
+	return c.send(req, nil)
+}
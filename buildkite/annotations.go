@@ -0,0 +1,30 @@
+package buildkite
+
+import "fmt"
+
+// Annotation styles, which set the colour of an annotation in the build
+const (
+	AnnotationSuccess = "success"
+	AnnotationInfo    = "info"
+	AnnotationWarning = "warning"
+	AnnotationError   = "error"
+)
+
+// Annotate adds a Markdown annotation to a job's build, replacing any earlier
+// annotation with the same context
+func (bk *Session) Annotate(job VmkiteJob, context string, style string, body string) error {
+	debugf("Annotating build %s/%s (%s)", job.Pipeline, job.BuildNumber, context)
+	req, err := bk.client.NewRequest("POST", fmt.Sprintf(
+		"v2/organizations/%s/pipelines/%s/builds/%s/annotations",
+		bk.Org, job.Pipeline, job.BuildNumber,
+	), map[string]string{
+		"context": context,
+		"style":   style,
+		"body":    body,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = bk.client.Do(req, nil)
+	return err
+}
@@ -3,9 +3,12 @@ package buildkite
 import (
 	"fmt"
 	"log"
+	"net/http"
+	"net/url"
 	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"gopkg.in/buildkite/go-buildkite.v2/buildkite"
@@ -14,65 +17,207 @@ import (
 const pollDuration = time.Second * 5
 
 type Session struct {
-	Org    string
-	client *buildkite.Client
+	Org string
+	// GraphQLEndpoint overrides Buildkite's GraphQL API endpoint
+	GraphQLEndpoint string
+	// AgentEndpoint overrides Buildkite's Agent API endpoint
+	AgentEndpoint string
+	// PollInterval is the time between listing jobs, 5 seconds by default
+	PollInterval time.Duration
+
+	client    *buildkite.Client
+	transport *tokenTransport
 }
 
 func NewSession(org string, apiToken string) (*Session, error) {
-	config, err := buildkite.NewTokenConfig(apiToken, false)
-	if err != nil {
-		return nil, err
+	if apiToken == "" {
+		return nil, fmt.Errorf("Invalid token, empty string supplied")
 	}
+	transport := &tokenTransport{token: apiToken}
 	return &Session{
-		Org:    org,
-		client: buildkite.NewClient(config.Client()),
+		Org:       org,
+		client:    buildkite.NewClient(&http.Client{Transport: transport}),
+		transport: transport,
 	}, nil
 }
 
+// SetAPIEndpoint overrides Buildkite's REST API endpoint
+func (bk *Session) SetAPIEndpoint(endpoint string) error {
+	u, err := url.Parse(strings.TrimRight(endpoint, "/") + "/")
+	if err != nil {
+		return err
+	}
+	bk.client.BaseURL = u
+	return nil
+}
+
+// UpdateAPIToken changes the API token used for following requests, e.g.
+// after the token is rotated
+func (bk *Session) UpdateAPIToken(apiToken string) {
+	bk.transport.Lock()
+	defer bk.transport.Unlock()
+	bk.transport.token = apiToken
+}
+
+// tokenTransport adds an API token that can be changed to each request
+type tokenTransport struct {
+	sync.Mutex
+	token string
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.Lock()
+	token := t.token
+	t.Unlock()
+	req.Header.Set("Authorization", "Bearer "+token)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
 type VmkiteJob struct {
-	ID          string
-	BuildNumber string
-	Pipeline    string
-	CreatedAt   time.Time
-	Metadata    VmkiteMetadata
+	ID              string
+	BuildNumber     string
+	Pipeline        string
+	Branch          string
+	CreatedAt       time.Time
+	ScheduledAt     time.Time
+	Priority        int
+	Metadata        VmkiteMetadata
+	AgentQueryRules []string
+	// Profile is the name of the profile that matched the job, if the job
+	// didn't give its own vmkite-vmdk and vmkite-guestid rules
+	Profile string
+}
+
+// Rule returns the value of one of the job's agent query rules
+func (v *VmkiteJob) Rule(key string) (string, bool) {
+	for _, r := range v.AgentQueryRules {
+		parts := strings.SplitN(r, "=", 2)
+		if len(parts) == 2 && parts[0] == key {
+			return parts[1], true
+		}
+	}
+	return "", false
 }
 
+// TemplateName is the directory of the job's VMDK, or the image name if the
+// job refers to an image like "macos-10.13:latest"
 func (v *VmkiteJob) TemplateName() string {
+	if !strings.HasSuffix(v.Metadata.VMDK, ".vmdk") && strings.Contains(v.Metadata.VMDK, ":") {
+		return strings.SplitN(v.Metadata.VMDK, ":", 2)[0]
+	}
 	return path.Dir(v.Metadata.VMDK)
 }
 
+// AffinityTag is added to the agent booted for a job so that it can be told
+// apart from agents booted for other jobs
+func (v *VmkiteJob) AffinityTag() string {
+	return "vmkite-job-id=" + v.ID
+}
+
+// Queue is the queue the job targets, "default" if it doesn't name one
+func (v *VmkiteJob) Queue() string {
+	if queue, ok := v.Rule("queue"); ok {
+		return queue
+	}
+	return "default"
+}
+
+// AgentTags are the tags an agent needs to match the job's agent query rules,
+// including its queue, plus the job's affinity tag. Wildcard rules can't be
+// turned into tags so are left out.
+func (v *VmkiteJob) AgentTags() []string {
+	tags := []string{}
+	hasQueue := false
+	for _, r := range v.AgentQueryRules {
+		if strings.Contains(r, "*") || !strings.Contains(r, "=") {
+			continue
+		}
+		if strings.HasPrefix(r, "queue=") {
+			hasQueue = true
+		}
+		tags = append(tags, r)
+	}
+	if !hasQueue {
+		tags = append(tags, "queue="+v.Queue())
+	}
+	return append(tags, v.AffinityTag())
+}
+
+// KeepOnFailure returns whether the job's VM should be kept for debugging if
+// the job fails, from its vmkite-keep-on-failure rule or else the default
+func (v *VmkiteJob) KeepOnFailure(def bool) bool {
+	if rule, ok := v.Rule("vmkite-keep-on-failure"); ok {
+		if keep, err := strconv.ParseBool(rule); err == nil {
+			return keep
+		}
+	}
+	return def
+}
+
 func (v *VmkiteJob) String() string {
 	return fmt.Sprintf("%s/%s/%s", v.Pipeline, v.BuildNumber, v.ID)
 }
 
+// VMName is unique to the job, including the start of its ID so that jobs of
+// the same build using the same template get their own VMs
 func (v VmkiteJob) VMName() string {
 	return fmt.Sprintf(
-		"%s-%s-%s-%s",
+		"%s-%s-%s-%s-%s",
 		v.TemplateName(),
 		v.Pipeline,
 		v.BuildNumber,
 		v.CreatedAt.Format("200612-150405"),
+		v.shortID(),
 	)
 }
 
+// shortID is the first part of the job's UUID
+func (v VmkiteJob) shortID() string {
+	if i := strings.Index(v.ID, "-"); i > 0 {
+		return v.ID[:i]
+	}
+	return v.ID
+}
+
+// Job sources for VmkiteJobQueryParams
+const (
+	// SourceBuilds lists running and scheduled builds with the REST API
+	SourceBuilds = "builds"
+	// SourceGraphQL lists scheduled jobs with the GraphQL API
+	SourceGraphQL = "graphql"
+)
+
 type VmkiteJobQueryParams struct {
+	Source    string
 	Pipelines []string
+	// Profiles are matched against jobs without vmkite-vmdk and
+	// vmkite-guestid rules
+	Profiles []Profile
+	// Withdrawn, if set, is called with the ID of each job PollJobs sent
+	// that is no longer scheduled, e.g. because it was cancelled or an
+	// agent elsewhere took it
+	Withdrawn func(jobID string)
 }
 
 func (bk *Session) PollJobs(query VmkiteJobQueryParams) chan VmkiteJob {
 	ch := make(chan VmkiteJob)
 	listed := make(chan []VmkiteJob)
 
+	interval := bk.PollInterval
+	if interval == 0 {
+		interval = pollDuration
+	}
+
 	// poll the api, return chunks of jobs
 	go func() {
 		for {
 			jobs, err := bk.ListJobs(query)
 			if err != nil {
 				debugf("ERROR ListJobs: %v", err)
-				continue
+			} else {
+				listed <- jobs
 			}
-			listed <- jobs
-			time.Sleep(pollDuration)
+			time.Sleep(interval)
 		}
 	}()
 
@@ -90,6 +235,14 @@ func (bk *Session) PollJobs(query VmkiteJobQueryParams) chan VmkiteJob {
 					ch <- job
 				}
 			}
+			if query.Withdrawn != nil {
+				for id := range sent {
+					if _, exists := received[id]; !exists {
+						debugf("Job %s is no longer scheduled", id)
+						query.Withdrawn(id)
+					}
+				}
+			}
 			sent = received
 		}
 	}()
@@ -98,6 +251,10 @@ func (bk *Session) PollJobs(query VmkiteJobQueryParams) chan VmkiteJob {
 }
 
 func (bk *Session) ListJobs(query VmkiteJobQueryParams) ([]VmkiteJob, error) {
+	if query.Source == SourceGraphQL {
+		return bk.ListScheduledJobs(query)
+	}
+
 	if len(query.Pipelines) > 0 {
 		jobs := make([]VmkiteJob, 0)
 		for _, pipeline := range query.Pipelines {
@@ -107,7 +264,7 @@ func (bk *Session) ListJobs(query VmkiteJobQueryParams) ([]VmkiteJob, error) {
 			if err != nil {
 				return nil, err
 			}
-			jobs = append(jobs, readJobsFromBuilds(builds)...)
+			jobs = append(jobs, readJobsFromBuilds(builds, query.Profiles)...)
 		}
 		return jobs, nil
 	}
@@ -119,44 +276,85 @@ func (bk *Session) ListJobs(query VmkiteJobQueryParams) ([]VmkiteJob, error) {
 		return nil, err
 	}
 
-	return readJobsFromBuilds(builds), nil
+	return readJobsFromBuilds(builds, query.Profiles), nil
 }
 
-func readJobsFromBuilds(builds []buildkite.Build) []VmkiteJob {
+func readJobsFromBuilds(builds []buildkite.Build, profiles []Profile) []VmkiteJob {
 	jobs := make([]VmkiteJob, 0)
 	for _, build := range builds {
 		for _, job := range build.Jobs {
-			metadata := parseAgentQueryRules(job.AgentQueryRules)
-			if metadata.GuestID != "" && metadata.VMDK != "" {
-				jobs = append(jobs, VmkiteJob{
-					ID:          *job.ID,
-					BuildNumber: strconv.Itoa(*build.Number),
-					Pipeline:    *build.Pipeline.Slug,
-					Metadata:    metadata,
-					CreatedAt:   build.CreatedAt.Time,
-				})
+			// only script jobs run on agents, not waiters, triggers or blocks
+			if job.ID == nil || job.Type == nil || *job.Type != "script" {
+				continue
+			}
+			// running builds also list jobs that are running or finished,
+			// which already have an agent
+			if job.State == nil || *job.State != "scheduled" {
+				continue
+			}
+			vmkiteJob := VmkiteJob{
+				ID:              *job.ID,
+				BuildNumber:     strconv.Itoa(*build.Number),
+				Pipeline:        *build.Pipeline.Slug,
+				CreatedAt:       build.CreatedAt.Time,
+				AgentQueryRules: job.AgentQueryRules,
+			}
+			if build.Branch != nil {
+				vmkiteJob.Branch = *build.Branch
+			}
+			if job.ScheduledAt != nil {
+				vmkiteJob.ScheduledAt = job.ScheduledAt.Time
+			}
+			if vmkiteJob, ok := newVmkiteJob(vmkiteJob, profiles); ok {
+				jobs = append(jobs, vmkiteJob)
 			}
 		}
 	}
 	return jobs
 }
 
-func (bk *Session) IsFinished(job VmkiteJob) (bool, error) {
+// newVmkiteJob fills in a job's metadata from its agent query rules or the
+// first matching profile, returning false if vmkite shouldn't run it
+func newVmkiteJob(job VmkiteJob, profiles []Profile) (VmkiteJob, bool) {
+	job.Metadata = parseAgentQueryRules(job.AgentQueryRules)
+	if job.Metadata.GuestID != "" && job.Metadata.VMDK != "" {
+		return job, true
+	}
+	profile := MatchProfile(profiles, job)
+	if profile == nil {
+		return job, false
+	}
+	job.Profile = profile.Name
+	job.Metadata = VmkiteMetadata{VMDK: profile.VMDK, GuestID: profile.GuestID}
+	return job, true
+}
+
+// JobState returns the state of a job in Buildkite, e.g. running, passed or
+// failed, or an empty string if its build doesn't have the job
+func (bk *Session) JobState(job VmkiteJob) (string, error) {
 	debugf("Builds.Get(%s, %s, %s)", bk.Org, job.Pipeline, job.BuildNumber)
 	build, _, err := bk.client.Builds.Get(bk.Org, job.Pipeline, job.BuildNumber)
 	if err != nil {
-		return false, err
+		return "", err
 	}
 	for _, buildJob := range build.Jobs {
-		if *buildJob.ID == job.ID {
-			switch *buildJob.State {
-			case "scheduled", "running":
-				return false, nil
-			}
-			return true, nil
+		if buildJob.ID != nil && *buildJob.ID == job.ID && buildJob.State != nil {
+			return *buildJob.State, nil
 		}
 	}
-	return false, nil
+	return "", nil
+}
+
+func (bk *Session) IsFinished(job VmkiteJob) (bool, error) {
+	state, err := bk.JobState(job)
+	if err != nil {
+		return false, err
+	}
+	switch state {
+	case "", "scheduled", "running":
+		return false, nil
+	}
+	return true, nil
 }
 
 type VmkiteMetadata struct {
@@ -0,0 +1,344 @@
+// Package buildkitetest is a stub of the parts of Buildkite's REST and Agent
+// APIs that vmkite uses, for testing polling for jobs, failing them and
+// annotating their builds without talking to Buildkite
+package buildkitetest
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AgentToken is the agent registration token the stub accepts
+const AgentToken = "stub-agent-token"
+
+// Job is a job listed by the stub, as part of a build
+type Job struct {
+	ID              string
+	Pipeline        string
+	BuildNumber     int
+	Branch          string
+	AgentQueryRules []string
+	// Type defaults to "script", the only type of job agents run
+	Type string
+	// State defaults to "scheduled"
+	State string
+}
+
+// Annotation is an annotation added to a build
+type Annotation struct {
+	Pipeline    string
+	BuildNumber string
+	Context     string
+	Style       string
+	Body        string
+}
+
+// Server is a stub Buildkite, serving the REST API at URL and the Agent API
+// at AgentURL()
+type Server struct {
+	*httptest.Server
+	sync.Mutex
+
+	Org     string
+	Created time.Time
+
+	jobs []Job
+	// Finished maps the IDs of jobs finished through the Agent API to their
+	// exit status
+	Finished map[string]string
+	// Logs holds the log uploaded for each finished job
+	Logs map[string]string
+	// agents maps the access tokens of registered agents to their names,
+	// until they disconnect
+	agents     map[string]string
+	registered int
+	// Annotations are the annotations added to builds, in order
+	Annotations []Annotation
+	// Lists counts requests listing builds, States holds the build states
+	// asked for by the last one
+	Lists  int
+	States []string
+}
+
+// NewServer starts a stub Buildkite for an organization, the caller should
+// Close it when done
+func NewServer(org string) *Server {
+	s := &Server{
+		Org:      org,
+		Created:  time.Now().UTC().Truncate(time.Second),
+		Finished: map[string]string{},
+		Logs:     map[string]string{},
+		agents:   map[string]string{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// AgentURL is the base URL of the stub's Agent API
+func (s *Server) AgentURL() string {
+	return s.URL + "/agent/v3/"
+}
+
+// SetJobs replaces the scheduled jobs the stub lists
+func (s *Server) SetJobs(jobs ...Job) {
+	s.Lock()
+	defer s.Unlock()
+	s.jobs = jobs
+}
+
+// SetJobState changes the state of a job, e.g. to failed once it has run
+func (s *Server) SetJobState(id, state string) {
+	s.Lock()
+	defer s.Unlock()
+	for i := range s.jobs {
+		if s.jobs[i].ID == id {
+			s.jobs[i].State = state
+		}
+	}
+}
+
+// FinishedJob returns the exit status a job was finished with, if it was
+func (s *Server) FinishedJob(id string) (string, bool) {
+	s.Lock()
+	defer s.Unlock()
+	status, ok := s.Finished[id]
+	return status, ok
+}
+
+// Agents returns the names of agents registered through the Agent API that
+// haven't disconnected
+func (s *Server) Agents() []string {
+	s.Lock()
+	defer s.Unlock()
+	names := []string{}
+	for _, name := range s.agents {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// AnnotationsFor returns the annotations added to a build
+func (s *Server) AnnotationsFor(pipeline string, buildNumber int) []Annotation {
+	s.Lock()
+	defer s.Unlock()
+	found := []Annotation{}
+	for _, a := range s.Annotations {
+		if a.Pipeline == pipeline && a.BuildNumber == strconv.Itoa(buildNumber) {
+			found = append(found, a)
+		}
+	}
+	return found
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	switch {
+	case len(parts) >= 2 && parts[0] == "agent":
+		s.serveAgent(w, req, parts[2:])
+	case len(parts) >= 3 && parts[0] == "v2" && parts[1] == "organizations" && parts[2] == s.Org:
+		s.serveREST(w, req, parts[3:])
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// serveREST handles paths under /v2/organizations/ORG
+func (s *Server) serveREST(w http.ResponseWriter, req *http.Request, parts []string) {
+	if !strings.HasPrefix(req.Header.Get("Authorization"), "Bearer ") {
+		http.Error(w, `{"message":"Authentication required"}`, http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	// builds or pipelines/PIPELINE/builds
+	case req.Method == "GET" && len(parts) == 1 && parts[0] == "builds":
+		s.listBuilds(w, req, "")
+	case req.Method == "GET" && len(parts) == 3 && parts[0] == "pipelines" && parts[2] == "builds":
+		s.listBuilds(w, req, parts[1])
+
+	// pipelines/PIPELINE/builds/NUMBER
+	case req.Method == "GET" && len(parts) == 4 && parts[0] == "pipelines" && parts[2] == "builds":
+		s.getBuild(w, req, parts[1], parts[3])
+
+	// pipelines/PIPELINE/builds/NUMBER/annotations
+	case req.Method == "POST" && len(parts) == 5 && parts[0] == "pipelines" && parts[4] == "annotations":
+		var body map[string]string
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.Annotations = append(s.Annotations, Annotation{
+			Pipeline:    parts[1],
+			BuildNumber: parts[3],
+			Context:     body["context"],
+			Style:       body["style"],
+			Body:        body["body"],
+		})
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{}`))
+
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// listBuilds lists a build for each pipeline and build number of the
+// scheduled jobs, optionally for just one pipeline
+func (s *Server) listBuilds(w http.ResponseWriter, req *http.Request, pipeline string) {
+	s.Lists++
+	s.States = req.URL.Query()["state[]"]
+
+	type build struct {
+		pipeline string
+		number   int
+	}
+	builds := []map[string]interface{}{}
+	byBuild := map[build]map[string]interface{}{}
+
+	for _, job := range s.jobs {
+		if pipeline != "" && job.Pipeline != pipeline {
+			continue
+		}
+		if _, finished := s.Finished[job.ID]; finished {
+			continue
+		}
+		key := build{job.Pipeline, job.BuildNumber}
+		b, ok := byBuild[key]
+		if !ok {
+			b = map[string]interface{}{
+				"id":         job.Pipeline + "-" + strconv.Itoa(job.BuildNumber),
+				"number":     job.BuildNumber,
+				"branch":     job.Branch,
+				"state":      "scheduled",
+				"created_at": s.Created.Format(time.RFC3339),
+				"pipeline":   map[string]interface{}{"slug": job.Pipeline},
+				"jobs":       []map[string]interface{}{},
+			}
+			byBuild[key] = b
+			builds = append(builds, b)
+		}
+		b["jobs"] = append(b["jobs"].([]map[string]interface{}), s.jobJSON(job))
+		if job.State != "" && job.State != "scheduled" {
+			b["state"] = "running"
+		}
+	}
+
+	json.NewEncoder(w).Encode(builds)
+}
+
+// getBuild returns a build with its jobs
+func (s *Server) getBuild(w http.ResponseWriter, req *http.Request, pipeline, number string) {
+	jobs := []map[string]interface{}{}
+	for _, job := range s.jobs {
+		if job.Pipeline == pipeline && strconv.Itoa(job.BuildNumber) == number {
+			jobs = append(jobs, s.jobJSON(job))
+		}
+	}
+	if len(jobs) == 0 {
+		http.Error(w, `{"message":"Not Found"}`, http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":       pipeline + "-" + number,
+		"pipeline": map[string]interface{}{"slug": pipeline},
+		"jobs":     jobs,
+	})
+}
+
+func (s *Server) jobJSON(job Job) map[string]interface{} {
+	jobType := job.Type
+	if jobType == "" {
+		jobType = "script"
+	}
+	state := job.State
+	if state == "" {
+		state = "scheduled"
+	}
+	return map[string]interface{}{
+		"id":                job.ID,
+		"type":              jobType,
+		"state":             state,
+		"agent_query_rules": job.AgentQueryRules,
+		"scheduled_at":      s.Created.Format(time.RFC3339),
+	}
+}
+
+// serveAgent handles the Agent API calls used to fail a job: register,
+// connect, acquire, start, upload a log chunk, finish and disconnect. Each
+// registration gets its own access token, which stops working once the agent
+// disconnects.
+func (s *Server) serveAgent(w http.ResponseWriter, req *http.Request, parts []string) {
+	auth := req.Header.Get("Authorization")
+	path := strings.Join(parts, "/")
+
+	if path == "register" {
+		if auth != "Token "+AgentToken {
+			http.Error(w, `{"message":"Invalid agent registration token"}`, http.StatusUnauthorized)
+			return
+		}
+		var body struct {
+			Name string `json:"name"`
+		}
+		json.NewDecoder(req.Body).Decode(&body)
+		s.registered++
+		token := fmt.Sprintf("stub-access-token-%d", s.registered)
+		s.agents[token] = body.Name
+		json.NewEncoder(w).Encode(map[string]string{"access_token": token})
+		return
+	}
+	token := strings.TrimPrefix(auth, "Token ")
+	if _, ok := s.agents[token]; !ok {
+		http.Error(w, `{"message":"Unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case path == "connect":
+		w.Write([]byte(`{}`))
+	case path == "disconnect":
+		delete(s.agents, token)
+		w.Write([]byte(`{}`))
+	case len(parts) == 3 && parts[0] == "jobs" && parts[2] == "acquire":
+		if _, ok := s.Finished[parts[1]]; ok {
+			http.Error(w, `{"message":"Job has already finished"}`, http.StatusUnprocessableEntity)
+			return
+		}
+		w.Write([]byte(`{}`))
+	case len(parts) == 3 && parts[0] == "jobs" && parts[2] == "start":
+		w.Write([]byte(`{}`))
+	case len(parts) == 3 && parts[0] == "jobs" && parts[2] == "chunks":
+		gz, err := gzip.NewReader(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data, _ := ioutil.ReadAll(gz)
+		s.Logs[parts[1]] += string(data)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{}`))
+	case len(parts) == 3 && parts[0] == "jobs" && parts[2] == "finish":
+		var body map[string]interface{}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		status, _ := body["exit_status"].(string)
+		s.Finished[parts[1]] = status
+		w.Write([]byte(`{}`))
+	default:
+		http.NotFound(w, req)
+	}
+}
@@ -0,0 +1,224 @@
+package buildkite
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const graphQLEndpoint = "https://graphql.buildkite.com/v1"
+
+// scheduledJobsQuery finds command jobs waiting for an agent, leaving out
+// jobs that are running, blocked or waiting on earlier steps
+const scheduledJobsQuery = `
+query ScheduledJobs($org: ID!, $after: String) {
+  organization(slug: $org) {
+    jobs(first: 100, after: $after, state: [SCHEDULED], type: [COMMAND], order: RECENTLY_CREATED) {
+      pageInfo { hasNextPage endCursor }
+      edges {
+        node {
+          ... on JobTypeCommand {
+            uuid
+            agentQueryRules
+            scheduledAt
+            priority { number }
+            pipeline { slug }
+            build { number branch createdAt }
+          }
+        }
+      }
+    }
+  }
+}`
+
+type graphQLJob struct {
+	UUID            string    `json:"uuid"`
+	AgentQueryRules []string  `json:"agentQueryRules"`
+	ScheduledAt     time.Time `json:"scheduledAt"`
+	Priority        struct {
+		Number int `json:"number"`
+	} `json:"priority"`
+	Pipeline struct {
+		Slug string `json:"slug"`
+	} `json:"pipeline"`
+	Build struct {
+		Number    int       `json:"number"`
+		Branch    string    `json:"branch"`
+		CreatedAt time.Time `json:"createdAt"`
+	} `json:"build"`
+}
+
+type scheduledJobsResponse struct {
+	Organization *struct {
+		Jobs struct {
+			PageInfo struct {
+				HasNextPage bool   `json:"hasNextPage"`
+				EndCursor   string `json:"endCursor"`
+			} `json:"pageInfo"`
+			Edges []struct {
+				Node graphQLJob `json:"node"`
+			} `json:"edges"`
+		} `json:"jobs"`
+	} `json:"organization"`
+}
+
+// ListScheduledJobs uses the GraphQL API to find just the jobs waiting for an
+// agent, which is much cheaper than walking every job of every running build
+func (bk *Session) ListScheduledJobs(query VmkiteJobQueryParams) ([]VmkiteJob, error) {
+	pipelines := map[string]bool{}
+	for _, p := range query.Pipelines {
+		pipelines[p] = true
+	}
+
+	jobs := make([]VmkiteJob, 0)
+	after := ""
+	for {
+		vars := map[string]interface{}{"org": bk.Org}
+		if after != "" {
+			vars["after"] = after
+		}
+		var resp scheduledJobsResponse
+		if err := bk.graphQL(scheduledJobsQuery, vars, &resp); err != nil {
+			return nil, err
+		}
+		if resp.Organization == nil {
+			return nil, fmt.Errorf("Organization %s not found", bk.Org)
+		}
+
+		for _, edge := range resp.Organization.Jobs.Edges {
+			node := edge.Node
+			if node.UUID == "" || (len(pipelines) > 0 && !pipelines[node.Pipeline.Slug]) {
+				continue
+			}
+			job, ok := newVmkiteJob(VmkiteJob{
+				ID:              node.UUID,
+				BuildNumber:     strconv.Itoa(node.Build.Number),
+				Pipeline:        node.Pipeline.Slug,
+				Branch:          node.Build.Branch,
+				CreatedAt:       node.Build.CreatedAt,
+				ScheduledAt:     node.ScheduledAt,
+				Priority:        node.Priority.Number,
+				AgentQueryRules: node.AgentQueryRules,
+			}, query.Profiles)
+			if ok {
+				jobs = append(jobs, job)
+			}
+		}
+
+		pageInfo := resp.Organization.Jobs.PageInfo
+		if !pageInfo.HasNextPage {
+			return jobs, nil
+		}
+		after = pageInfo.EndCursor
+	}
+}
+
+func (bk *Session) graphQL(query string, vars map[string]interface{}, v interface{}) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"query":     query,
+		"variables": vars,
+	})
+	if err != nil {
+		return err
+	}
+
+	endpoint := bk.GraphQLEndpoint
+	if endpoint == "" {
+		endpoint = graphQLEndpoint
+	}
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := (&http.Client{Transport: bk.transport, Timeout: time.Minute}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("GraphQL: %d %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+
+	result := struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return err
+	}
+	if len(result.Errors) > 0 {
+		msgs := []string{}
+		for _, e := range result.Errors {
+			msgs = append(msgs, e.Message)
+		}
+		return fmt.Errorf("GraphQL: %s", strings.Join(msgs, "; "))
+	}
+	return json.Unmarshal(result.Data, v)
+}
+
+const jobIDQuery = `
+query JobID($uuid: ID!) {
+  job(uuid: $uuid) {
+    ... on JobTypeCommand { id }
+  }
+}`
+
+const cancelJobMutation = `
+mutation CancelJob($id: ID!) {
+  jobTypeCommandCancel(input: {id: $id}) {
+    jobTypeCommand { id }
+  }
+}`
+
+const retryJobMutation = `
+mutation RetryJob($id: ID!) {
+  jobTypeCommandRetry(input: {id: $id}) {
+    jobTypeCommand { uuid }
+  }
+}`
+
+// PreemptJob cancels a job and retries it, so that the job runs again later
+// on a new VM. It returns the ID of the retried job.
+func (bk *Session) PreemptJob(job VmkiteJob) (string, error) {
+	debugf("Preempting job %s", job.ID)
+
+	var found struct {
+		Job *struct {
+			ID string `json:"id"`
+		} `json:"job"`
+	}
+	if err := bk.graphQL(jobIDQuery, map[string]interface{}{"uuid": job.ID}, &found); err != nil {
+		return "", err
+	}
+	if found.Job == nil || found.Job.ID == "" {
+		return "", fmt.Errorf("Job %s not found", job.ID)
+	}
+
+	vars := map[string]interface{}{"id": found.Job.ID}
+	if err := bk.graphQL(cancelJobMutation, vars, &struct{}{}); err != nil {
+		return "", err
+	}
+
+	var retried struct {
+		JobTypeCommandRetry struct {
+			JobTypeCommand struct {
+				UUID string `json:"uuid"`
+			} `json:"jobTypeCommand"`
+		} `json:"jobTypeCommandRetry"`
+	}
+	if err := bk.graphQL(retryJobMutation, vars, &retried); err != nil {
+		return "", err
+	}
+	return retried.JobTypeCommandRetry.JobTypeCommand.UUID, nil
+}
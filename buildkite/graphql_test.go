@@ -0,0 +1,144 @@
+package buildkite
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// graphQLRequest is what ListScheduledJobs posts to the GraphQL endpoint
+type graphQLRequest struct {
+	Query     string                 `json:"query"`
+	Variables map[string]interface{} `json:"variables"`
+}
+
+func graphQLNode(uuid, pipeline string, rules ...string) map[string]interface{} {
+	return map[string]interface{}{
+		"node": map[string]interface{}{
+			"uuid":            uuid,
+			"agentQueryRules": rules,
+			"scheduledAt":     "2017-06-01T10:00:00Z",
+			"priority":        map[string]interface{}{"number": 0},
+			"pipeline":        map[string]interface{}{"slug": pipeline},
+			"build": map[string]interface{}{
+				"number":    7,
+				"branch":    "master",
+				"createdAt": "2017-06-01T09:59:00Z",
+			},
+		},
+	}
+}
+
+func graphQLPage(hasNext bool, cursor string, edges ...map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"data": map[string]interface{}{
+			"organization": map[string]interface{}{
+				"jobs": map[string]interface{}{
+					"pageInfo": map[string]interface{}{"hasNextPage": hasNext, "endCursor": cursor},
+					"edges":    edges,
+				},
+			},
+		},
+	}
+}
+
+func newGraphQLSession(t *testing.T, handler http.HandlerFunc) (*Session, *httptest.Server) {
+	server := httptest.NewServer(handler)
+	bk, err := NewSession("acme", "api-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bk.GraphQLEndpoint = server.URL
+	return bk, server
+}
+
+func TestListScheduledJobsPaginates(t *testing.T) {
+	vmRules := []string{"vmkite-vmdk=macos.vmdk", "vmkite-guestid=darwin16_64Guest"}
+	pages := map[string]map[string]interface{}{
+		"": graphQLPage(true, "page2",
+			graphQLNode("job-1", "app", vmRules...),
+			// not a command job, so it has no fields from JobTypeCommand
+			map[string]interface{}{"node": map[string]interface{}{}},
+		),
+		"page2": graphQLPage(false, "",
+			graphQLNode("job-2", "app", vmRules...),
+			graphQLNode("job-3", "other", vmRules...),
+			graphQLNode("job-4", "app", "queue=default"),
+		),
+	}
+
+	requests := 0
+	bk, server := newGraphQLSession(t, func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		if auth := req.Header.Get("Authorization"); auth != "Bearer api-token" {
+			t.Errorf("Authorization = %q", auth)
+		}
+		var body graphQLRequest
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(body.Query, "state: [SCHEDULED]") {
+			t.Errorf("query doesn't ask for only scheduled jobs: %s", body.Query)
+		}
+		if body.Variables["org"] != "acme" {
+			t.Errorf("org = %v", body.Variables["org"])
+		}
+		after, _ := body.Variables["after"].(string)
+		page, ok := pages[after]
+		if !ok {
+			t.Fatalf("unexpected cursor %q", after)
+		}
+		json.NewEncoder(w).Encode(page)
+	})
+	defer server.Close()
+
+	jobs, err := bk.ListScheduledJobs(VmkiteJobQueryParams{Pipelines: []string{"app"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests != 2 {
+		t.Errorf("made %d requests, want 2", requests)
+	}
+
+	ids := []string{}
+	for _, job := range jobs {
+		ids = append(ids, job.ID)
+	}
+	if got := strings.Join(ids, ","); got != "job-1,job-2" {
+		t.Errorf("jobs = %s, want job-1,job-2", got)
+	}
+	if len(jobs) > 0 {
+		job := jobs[0]
+		if job.Pipeline != "app" || job.BuildNumber != "7" || job.Metadata.VMDK != "macos.vmdk" {
+			t.Errorf("job-1 = %+v", job)
+		}
+	}
+}
+
+func TestListScheduledJobsErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		wantErr string
+	}{
+		{"http error", http.StatusUnauthorized, `{"message":"bad token"}`, "GraphQL: 401"},
+		{"graphql errors", http.StatusOK, `{"data":null,"errors":[{"message":"one"},{"message":"two"}]}`, "GraphQL: one; two"},
+		{"missing organization", http.StatusOK, `{"data":{"organization":null}}`, "Organization acme not found"},
+		{"invalid json", http.StatusOK, `{`, "unexpected EOF"},
+	}
+	for _, test := range tests {
+		bk, server := newGraphQLSession(t, func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(test.status)
+			fmt.Fprint(w, test.body)
+		})
+		_, err := bk.ListScheduledJobs(VmkiteJobQueryParams{})
+		server.Close()
+		if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("%s: error = %v, want %q", test.name, err, test.wantErr)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package buildkite_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/macstadium/vmkite/buildkite"
+	"github.com/macstadium/vmkite/buildkite/buildkitetest"
+)
+
+var vmRules = []string{"queue=macos", "vmkite-vmdk=macos.vmdk", "vmkite-guestid=darwin16_64Guest"}
+
+func newStubSession(t *testing.T) (*buildkite.Session, *buildkitetest.Server) {
+	stub := buildkitetest.NewServer("acme")
+	bk, err := buildkite.NewSession("acme", "api-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bk.SetAPIEndpoint(stub.URL); err != nil {
+		t.Fatal(err)
+	}
+	bk.AgentEndpoint = stub.AgentURL()
+	bk.PollInterval = time.Millisecond * 10
+	return bk, stub
+}
+
+// receive reads the jobs sent by PollJobs until none arrive for a while
+func receive(ch chan buildkite.VmkiteJob) []string {
+	ids := []string{}
+	for {
+		select {
+		case job := <-ch:
+			ids = append(ids, job.ID)
+		case <-time.After(time.Millisecond * 200):
+			return ids
+		}
+	}
+}
+
+func TestPollJobsSendsEachJobOnce(t *testing.T) {
+	bk, stub := newStubSession(t)
+	defer stub.Close()
+
+	stub.SetJobs(
+		buildkitetest.Job{ID: "job-1", Pipeline: "app", BuildNumber: 1, AgentQueryRules: vmRules},
+		buildkitetest.Job{ID: "job-2", Pipeline: "app", BuildNumber: 1, AgentQueryRules: vmRules},
+		buildkitetest.Job{ID: "wait", Pipeline: "app", BuildNumber: 1, Type: "waiter"},
+		buildkitetest.Job{ID: "linux", Pipeline: "app", BuildNumber: 1, AgentQueryRules: []string{"queue=linux"}},
+	)
+	ch := bk.PollJobs(buildkite.VmkiteJobQueryParams{})
+
+	if got := strings.Join(receive(ch), ","); got != "job-1,job-2" {
+		t.Fatalf("first jobs = %s, want job-1,job-2", got)
+	}
+
+	stub.SetJobs(
+		buildkitetest.Job{ID: "job-2", Pipeline: "app", BuildNumber: 1, AgentQueryRules: vmRules},
+		buildkitetest.Job{ID: "job-3", Pipeline: "docs", BuildNumber: 4, Branch: "master", AgentQueryRules: vmRules},
+	)
+	if got := strings.Join(receive(ch), ","); got != "job-3" {
+		t.Fatalf("next jobs = %s, want job-3", got)
+	}
+
+	stub.Lock()
+	defer stub.Unlock()
+	if stub.Lists < 2 {
+		t.Errorf("listed builds %d times, want at least 2", stub.Lists)
+	}
+	if strings.Join(stub.States, ",") != "scheduled,running" {
+		t.Errorf("listed builds in states %v, want scheduled and running", stub.States)
+	}
+}
+
+func TestPollJobsSkipsStartedJobs(t *testing.T) {
+	bk, stub := newStubSession(t)
+	defer stub.Close()
+
+	// a running build lists its running and finished jobs too
+	stub.SetJobs(
+		buildkitetest.Job{ID: "passed", Pipeline: "app", BuildNumber: 1, AgentQueryRules: vmRules, State: "passed"},
+		buildkitetest.Job{ID: "failed", Pipeline: "app", BuildNumber: 1, AgentQueryRules: vmRules, State: "failed"},
+		buildkitetest.Job{ID: "running", Pipeline: "app", BuildNumber: 1, AgentQueryRules: vmRules, State: "running"},
+		buildkitetest.Job{ID: "assigned", Pipeline: "app", BuildNumber: 1, AgentQueryRules: vmRules, State: "assigned"},
+		buildkitetest.Job{ID: "scheduled", Pipeline: "app", BuildNumber: 1, AgentQueryRules: vmRules},
+	)
+	ch := bk.PollJobs(buildkite.VmkiteJobQueryParams{})
+
+	if got := strings.Join(receive(ch), ","); got != "scheduled" {
+		t.Fatalf("jobs = %s, want only the scheduled one", got)
+	}
+}
+
+func TestPollJobsReportsWithdrawnJobs(t *testing.T) {
+	bk, stub := newStubSession(t)
+	defer stub.Close()
+
+	stub.SetJobs(
+		buildkitetest.Job{ID: "cancelled", Pipeline: "app", BuildNumber: 1, AgentQueryRules: vmRules},
+		buildkitetest.Job{ID: "waiting", Pipeline: "app", BuildNumber: 1, AgentQueryRules: vmRules},
+	)
+	withdrawn := make(chan string, 10)
+	ch := bk.PollJobs(buildkite.VmkiteJobQueryParams{
+		Withdrawn: func(id string) { withdrawn <- id },
+	})
+	if got := strings.Join(receive(ch), ","); got != "cancelled,waiting" {
+		t.Fatalf("jobs = %s, want cancelled,waiting", got)
+	}
+
+	stub.SetJobs(
+		buildkitetest.Job{ID: "waiting", Pipeline: "app", BuildNumber: 1, AgentQueryRules: vmRules},
+	)
+	select {
+	case id := <-withdrawn:
+		if id != "cancelled" {
+			t.Errorf("withdrawn %s, want cancelled", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the cancelled job wasn't reported withdrawn")
+	}
+	select {
+	case id := <-withdrawn:
+		t.Errorf("withdrawn %s as well", id)
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+func TestListJobsByPipeline(t *testing.T) {
+	bk, stub := newStubSession(t)
+	defer stub.Close()
+
+	stub.SetJobs(
+		buildkitetest.Job{ID: "app-1", Pipeline: "app", BuildNumber: 3, Branch: "master", AgentQueryRules: vmRules},
+		buildkitetest.Job{ID: "docs-1", Pipeline: "docs", BuildNumber: 1, AgentQueryRules: vmRules},
+	)
+
+	jobs, err := bk.ListJobs(buildkite.VmkiteJobQueryParams{Pipelines: []string{"app"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 {
+		t.Fatalf("got %d jobs, want 1", len(jobs))
+	}
+	job := jobs[0]
+	if job.ID != "app-1" || job.Pipeline != "app" || job.BuildNumber != "3" || job.Branch != "master" {
+		t.Errorf("job = %+v", job)
+	}
+	if job.Metadata.VMDK != "macos.vmdk" || !job.CreatedAt.Equal(stub.Created) {
+		t.Errorf("job metadata = %+v, created %v", job.Metadata, job.CreatedAt)
+	}
+}
+
+func TestListJobsAPIError(t *testing.T) {
+	bk, stub := newStubSession(t)
+	stub.Close()
+
+	if _, err := bk.ListJobs(buildkite.VmkiteJobQueryParams{}); err == nil {
+		t.Fatal("ListJobs succeeded without a server")
+	}
+}
+
+func TestFailJob(t *testing.T) {
+	bk, stub := newStubSession(t)
+	defer stub.Close()
+	job := buildkite.VmkiteJob{ID: "job-1", Pipeline: "app", BuildNumber: "1", AgentQueryRules: vmRules}
+
+	if err := bk.FailJob("wrong-token", job, "no VM"); err == nil {
+		t.Error("FailJob succeeded with the wrong agent token")
+	}
+	if err := bk.FailJob(buildkitetest.AgentToken, job, "No datastore has capacity"); err != nil {
+		t.Fatal(err)
+	}
+
+	status, ok := stub.FinishedJob("job-1")
+	if !ok || status != "1" {
+		t.Errorf("job finished = %v with %q, want exit status 1", ok, status)
+	}
+	stub.Lock()
+	logged := stub.Logs["job-1"]
+	stub.Unlock()
+	if !strings.Contains(logged, "vmkite: No datastore has capacity") {
+		t.Errorf("job log = %q", logged)
+	}
+	if agents := stub.Agents(); len(agents) != 0 {
+		t.Errorf("agents left registered: %v", agents)
+	}
+
+	// the agent is disconnected when the job can't be failed too
+	if err := bk.FailJob(buildkitetest.AgentToken, job, "again"); err == nil {
+		t.Error("FailJob succeeded on a finished job")
+	}
+	if agents := stub.Agents(); len(agents) != 0 {
+		t.Errorf("agents left registered: %v", agents)
+	}
+}
+
+func TestAnnotate(t *testing.T) {
+	bk, stub := newStubSession(t)
+	defer stub.Close()
+	job := buildkite.VmkiteJob{ID: "job-1", Pipeline: "app", BuildNumber: "7"}
+
+	if err := bk.Annotate(job, "vmkite-job-1", buildkite.AnnotationError, "**failed**"); err != nil {
+		t.Fatal(err)
+	}
+	annotations := stub.AnnotationsFor("app", 7)
+	if len(annotations) != 1 {
+		t.Fatalf("got %d annotations, want 1", len(annotations))
+	}
+	if a := annotations[0]; a.Context != "vmkite-job-1" || a.Style != "error" || a.Body != "**failed**" {
+		t.Errorf("annotation = %+v", a)
+	}
+}
+
+func TestJobState(t *testing.T) {
+	bk, stub := newStubSession(t)
+	defer stub.Close()
+	stub.SetJobs(buildkitetest.Job{ID: "job-1", Pipeline: "app", BuildNumber: 2, AgentQueryRules: vmRules})
+	job := buildkite.VmkiteJob{ID: "job-1", Pipeline: "app", BuildNumber: "2"}
+
+	if state, err := bk.JobState(job); err != nil || state != "scheduled" {
+		t.Errorf("JobState = %q, %v, want scheduled", state, err)
+	}
+	stub.SetJobState("job-1", "timed_out")
+	if state, err := bk.JobState(job); err != nil || state != "timed_out" {
+		t.Errorf("JobState = %q, %v, want timed_out", state, err)
+	}
+	if finished, err := bk.IsFinished(job); err != nil || !finished {
+		t.Errorf("IsFinished = %v, %v, want true", finished, err)
+	}
+	job.BuildNumber = "3"
+	if _, err := bk.JobState(job); err == nil {
+		t.Error("JobState of a missing build succeeded")
+	}
+}
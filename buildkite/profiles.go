@@ -0,0 +1,101 @@
+package buildkite
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Profile describes the VM to boot for jobs matching its rules, so that jobs
+// don't need vmkite-vmdk and vmkite-guestid agent query rules
+type Profile struct {
+	Name    string     `json:"name"`
+	Match   MatchRules `json:"match"`
+	VMDK    string     `json:"vmdk"`
+	GuestID string     `json:"guest_id"`
+}
+
+// MatchRules select jobs by their queue, agent query rules, pipeline and
+// branch. Each pattern is a glob like "macos-*", or a regular expression
+// between slashes like "/^release-[0-9]+$/". Empty patterns match anything.
+type MatchRules struct {
+	Queue    string            `json:"queue"`
+	Tags     map[string]string `json:"tags"`
+	Pipeline string            `json:"pipeline"`
+	Branch   string            `json:"branch"`
+}
+
+// LoadProfiles reads a JSON array of profiles from a file, checking their
+// patterns are valid
+func LoadProfiles(file string) ([]Profile, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	profiles := []Profile{}
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return nil, fmt.Errorf("Invalid profiles in %s: %v", file, err)
+	}
+	for _, p := range profiles {
+		if p.Name == "" || p.VMDK == "" || p.GuestID == "" {
+			return nil, fmt.Errorf("Profile %q in %s needs a name, vmdk and guest_id", p.Name, file)
+		}
+		patterns := []string{p.Match.Queue, p.Match.Pipeline, p.Match.Branch}
+		for _, pattern := range p.Match.Tags {
+			patterns = append(patterns, pattern)
+		}
+		for _, pattern := range patterns {
+			if _, err := matchPattern(pattern, ""); err != nil {
+				return nil, fmt.Errorf("Profile %s: %v", p.Name, err)
+			}
+		}
+	}
+	return profiles, nil
+}
+
+// Matches returns whether a job should run on the profile's VMs
+func (p Profile) Matches(job VmkiteJob) bool {
+	m := p.Match
+	if !matches(m.Queue, job.Queue()) || !matches(m.Pipeline, job.Pipeline) || !matches(m.Branch, job.Branch) {
+		return false
+	}
+	for tag, pattern := range m.Tags {
+		val, ok := job.Rule(tag)
+		if !ok || !matches(pattern, val) {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchProfile returns the first profile matching a job, or nil
+func MatchProfile(profiles []Profile, job VmkiteJob) *Profile {
+	for i := range profiles {
+		if profiles[i].Matches(job) {
+			return &profiles[i]
+		}
+	}
+	return nil
+}
+
+func matches(pattern, s string) bool {
+	ok, err := matchPattern(pattern, s)
+	return err == nil && ok
+}
+
+func matchPattern(pattern, s string) (bool, error) {
+	if pattern == "" {
+		return true, nil
+	}
+	if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return false, err
+		}
+		return re.MatchString(s), nil
+	}
+	return path.Match(pattern, s)
+}
@@ -0,0 +1,123 @@
+package buildkite
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestProfileMatches(t *testing.T) {
+	job := VmkiteJob{
+		Pipeline:        "ios-app",
+		Branch:          "release-12",
+		AgentQueryRules: []string{"queue=macos", "xcode=9.2"},
+	}
+
+	tests := []struct {
+		name  string
+		match MatchRules
+		job   VmkiteJob
+		want  bool
+	}{
+		{"empty rules match anything", MatchRules{}, job, true},
+		{"queue glob", MatchRules{Queue: "mac*"}, job, true},
+		{"queue mismatch", MatchRules{Queue: "linux"}, job, false},
+		{"default queue", MatchRules{Queue: "default"}, VmkiteJob{}, true},
+		{"pipeline glob", MatchRules{Pipeline: "ios-*"}, job, true},
+		{"branch regexp", MatchRules{Branch: "/^release-[0-9]+$/"}, job, true},
+		{"branch regexp mismatch", MatchRules{Branch: "/^main$/"}, job, false},
+		{"tag", MatchRules{Tags: map[string]string{"xcode": "9.*"}}, job, true},
+		{"tag mismatch", MatchRules{Tags: map[string]string{"xcode": "10.*"}}, job, false},
+		{"missing tag", MatchRules{Tags: map[string]string{"ruby": "*"}}, job, false},
+		{"all rules", MatchRules{Queue: "macos", Pipeline: "ios-app", Branch: "release-*",
+			Tags: map[string]string{"xcode": "9.2"}}, job, true},
+		{"invalid regexp never matches", MatchRules{Branch: "/(/"}, job, false},
+	}
+	for _, test := range tests {
+		p := Profile{Name: test.name, Match: test.match}
+		if got := p.Matches(test.job); got != test.want {
+			t.Errorf("%s: Matches = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestMatchProfileFirstWins(t *testing.T) {
+	profiles := []Profile{
+		{Name: "linux", Match: MatchRules{Queue: "linux"}, VMDK: "linux.vmdk", GuestID: "ubuntu64Guest"},
+		{Name: "release", Match: MatchRules{Queue: "macos", Branch: "release-*"}, VMDK: "release.vmdk", GuestID: "darwin16_64Guest"},
+		{Name: "macos", Match: MatchRules{Queue: "macos"}, VMDK: "macos.vmdk", GuestID: "darwin16_64Guest"},
+	}
+
+	tests := []struct {
+		branch string
+		queue  string
+		want   string
+	}{
+		{"release-1", "macos", "release"},
+		{"master", "macos", "macos"},
+		{"master", "linux", "linux"},
+		{"master", "windows", ""},
+	}
+	for _, test := range tests {
+		job := VmkiteJob{Branch: test.branch, AgentQueryRules: []string{"queue=" + test.queue}}
+		got := ""
+		if p := MatchProfile(profiles, job); p != nil {
+			got = p.Name
+		}
+		if got != test.want {
+			t.Errorf("%s on %s: matched %q, want %q", test.branch, test.queue, got, test.want)
+		}
+	}
+}
+
+func TestNewVmkiteJobUsesProfile(t *testing.T) {
+	profiles := []Profile{{Name: "macos", Match: MatchRules{Queue: "macos"}, VMDK: "macos:latest", GuestID: "darwin16_64Guest"}}
+
+	job, ok := newVmkiteJob(VmkiteJob{AgentQueryRules: []string{"queue=macos"}}, profiles)
+	if !ok || job.Profile != "macos" || job.Metadata.VMDK != "macos:latest" {
+		t.Errorf("profile job = %+v, %v", job, ok)
+	}
+
+	// explicit rules win over profiles
+	job, ok = newVmkiteJob(VmkiteJob{AgentQueryRules: []string{
+		"queue=macos", "vmkite-vmdk=custom.vmdk", "vmkite-guestid=darwin17_64Guest",
+	}}, profiles)
+	if !ok || job.Profile != "" || job.Metadata.VMDK != "custom.vmdk" {
+		t.Errorf("explicit job = %+v, %v", job, ok)
+	}
+
+	if _, ok := newVmkiteJob(VmkiteJob{AgentQueryRules: []string{"queue=linux"}}, profiles); ok {
+		t.Error("job matching no profile was accepted")
+	}
+}
+
+func TestLoadProfiles(t *testing.T) {
+	tests := []struct {
+		name    string
+		json    string
+		wantErr string
+	}{
+		{"valid", `[{"name":"macos","match":{"queue":"macos"},"vmdk":"macos.vmdk","guest_id":"darwin16_64Guest"}]`, ""},
+		{"missing vmdk", `[{"name":"macos","guest_id":"darwin16_64Guest"}]`, "needs a name, vmdk and guest_id"},
+		{"invalid pattern", `[{"name":"macos","match":{"branch":"/(/"},"vmdk":"m.vmdk","guest_id":"g"}]`, "Profile macos"},
+		{"invalid json", `{`, "Invalid profiles"},
+	}
+	for _, test := range tests {
+		f, err := ioutil.TempFile("", "vmkite-profiles")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString(test.json)
+		f.Close()
+
+		_, err = LoadProfiles(f.Name())
+		os.Remove(f.Name())
+		if test.wantErr == "" && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+			t.Errorf("%s: error = %v, want %q", test.name, err, test.wantErr)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package capacity
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// Recommendation is the capacity suggested for a template during an hour of
+// the week
+type Recommendation struct {
+	Template string
+	Hour     int
+	// ArrivalRate is the expected number of jobs per hour
+	ArrivalRate float64
+	// BusyVMs is the expected number of VMs booting or running jobs
+	BusyVMs float64
+	// WarmVMs is how many VMs to have booted ahead of time so that jobs
+	// don't wait for a VM to boot
+	WarmVMs int
+	// Wait is the expected time a job waits for a VM without warm VMs, and
+	// WarmWait with them. Saturated is set if jobs arrive faster than the
+	// concurrency limit can run them, so waits grow without bound.
+	Wait      time.Duration
+	WarmWait  time.Duration
+	Saturated bool
+}
+
+// Recommend works out the capacity each template needs for each hour of the
+// week that jobs have arrived in, given the runner's concurrency limit.
+// Arrivals are modelled as a Poisson process served by concurrency VMs
+// (M/M/c), each busy for the mean boot plus run time.
+func Recommend(s *Stats, concurrency int) []Recommendation {
+	s.Lock()
+	defer s.Unlock()
+
+	recs := []Recommendation{}
+	for name, t := range s.Templates {
+		boot := t.Boots.Mean()
+		service := boot + t.Runs.Mean()
+
+		for hour := 0; hour < HoursPerWeek; hour++ {
+			rate := t.ArrivalRate(hour)
+			if rate == 0 {
+				continue
+			}
+			rec := Recommendation{
+				Template:    name,
+				Hour:        hour,
+				ArrivalRate: rate,
+				BusyVMs:     rate * service.Hours(),
+				// VMs that would otherwise be booting when jobs arrive
+				WarmVMs: int(math.Ceil(rate * boot.Hours())),
+			}
+
+			queued, ok := queueWait(rate, service, concurrency)
+			if !ok {
+				rec.Saturated = true
+			} else {
+				rec.Wait = queued + boot
+				rec.WarmWait = queued
+			}
+			recs = append(recs, rec)
+		}
+	}
+
+	sort.Slice(recs, func(i, j int) bool {
+		if recs[i].Template != recs[j].Template {
+			return recs[i].Template < recs[j].Template
+		}
+		return recs[i].Hour < recs[j].Hour
+	})
+	return recs
+}
+
+// queueWait is the mean time a job waits for one of servers to be free in an
+// M/M/c queue, using the Erlang C formula. It returns false if the queue
+// grows without bound.
+func queueWait(ratePerHour float64, service time.Duration, servers int) (time.Duration, bool) {
+	if service <= 0 {
+		return 0, true
+	}
+	if servers <= 0 {
+		return 0, false
+	}
+	load := ratePerHour * service.Hours() // offered load in erlangs
+	c := float64(servers)
+	if load >= c {
+		return 0, false
+	}
+
+	// sum of load^k/k! for k < c, built up term by term
+	term, sum := 1.0, 0.0
+	for k := 0; k < servers; k++ {
+		sum += term
+		term *= load / float64(k+1)
+	}
+	// term is now load^c/c!
+	top := term * c / (c - load)
+	erlangC := top / (sum + top)
+
+	hours := erlangC * service.Hours() / (c - load)
+	return time.Duration(hours * float64(time.Hour)), true
+}
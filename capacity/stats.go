@@ -0,0 +1,179 @@
+// Package capacity records how often jobs arrive for each template and how
+// long their VMs take to boot and run, and from that recommends how many VMs
+// to keep ready ahead of demand.
+package capacity
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// HoursPerWeek is the number of hour-of-week buckets arrivals are counted in,
+// so that e.g. Monday morning can be told apart from Sunday morning
+const HoursPerWeek = 7 * 24
+
+// TemplateStats are the observations for one template
+type TemplateStats struct {
+	Arrivals  [HoursPerWeek]int `json:"arrivals"`
+	FirstSeen time.Time         `json:"first_seen"`
+	LastSeen  time.Time         `json:"last_seen"`
+	Boots     Durations         `json:"boots"`
+	Runs      Durations         `json:"runs"`
+}
+
+// Durations keeps a running mean of observed durations
+type Durations struct {
+	Count int           `json:"count"`
+	Total time.Duration `json:"total"`
+}
+
+func (d *Durations) add(dur time.Duration) {
+	d.Count++
+	d.Total += dur
+}
+
+// Mean is the average observed duration, or zero if there were none
+func (d Durations) Mean() time.Duration {
+	if d.Count == 0 {
+		return 0
+	}
+	return d.Total / time.Duration(d.Count)
+}
+
+// Weeks is how many weeks the template has been observed for, at least one
+func (t *TemplateStats) Weeks() float64 {
+	weeks := t.LastSeen.Sub(t.FirstSeen).Hours() / HoursPerWeek
+	if weeks < 1 {
+		return 1
+	}
+	return weeks
+}
+
+// ArrivalRate is the average number of jobs arriving per hour during an
+// hour of the week
+func (t *TemplateStats) ArrivalRate(hour int) float64 {
+	return float64(t.Arrivals[hour]) / t.Weeks()
+}
+
+// HourOfWeek returns the bucket t falls in, counting from Sunday midnight
+func HourOfWeek(t time.Time) int {
+	return int(t.Weekday())*24 + t.Hour()
+}
+
+// Stats are the observations for all templates, saved to a file as they are
+// recorded so that they build up across restarts
+type Stats struct {
+	sync.Mutex `json:"-"`
+
+	Templates map[string]*TemplateStats `json:"templates"`
+	// Concurrency is the runner's concurrency limit when the stats were last
+	// recorded, the default for reports
+	Concurrency int `json:"concurrency,omitempty"`
+	file        string
+}
+
+// Load reads stats from a file, starting afresh if it doesn't exist yet
+func Load(file string) (*Stats, error) {
+	s := &Stats{Templates: map[string]*TemplateStats{}, file: file}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+	if s.Templates == nil {
+		s.Templates = map[string]*TemplateStats{}
+	}
+	return s, nil
+}
+
+func (s *Stats) template(name string) *TemplateStats {
+	t, ok := s.Templates[name]
+	if !ok {
+		t = &TemplateStats{}
+		s.Templates[name] = t
+	}
+	return t
+}
+
+// SetConcurrency records the concurrency limit of the runner recording stats
+func (s *Stats) SetConcurrency(n int) {
+	s.Lock()
+	defer s.Unlock()
+	if s.Concurrency != n {
+		s.Concurrency = n
+		s.save()
+	}
+}
+
+// Arrival records a job for a template being queued at a time
+func (s *Stats) Arrival(template string, at time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	t := s.template(template)
+	t.Arrivals[HourOfWeek(at)]++
+	if t.FirstSeen.IsZero() || at.Before(t.FirstSeen) {
+		t.FirstSeen = at
+	}
+	if at.After(t.LastSeen) {
+		t.LastSeen = at
+	}
+	s.save()
+}
+
+// Boot records how long a VM for a template took to be ready for its job
+func (s *Stats) Boot(template string, d time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	s.template(template).Boots.add(d)
+	s.save()
+}
+
+// Run records how long a VM for a template ran its job for
+func (s *Stats) Run(template string, d time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	s.template(template).Runs.add(d)
+	s.save()
+}
+
+// save writes the stats to their file, replacing it atomically. Errors are
+// only logged, losing stats isn't worth failing jobs over.
+func (s *Stats) save() {
+	if s.file == "" {
+		return
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		debugf("Error encoding stats: %v", err)
+		return
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.file), ".vmkite-capacity")
+	if err != nil {
+		debugf("Error saving stats: %v", err)
+		return
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		debugf("Error saving stats to %s: %v", s.file, err)
+	}
+}
+
+func debugf(format string, data ...interface{}) {
+	log.Printf("[capacity] "+format, data...)
+}
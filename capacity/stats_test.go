@@ -0,0 +1,46 @@
+package capacity
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStatsSaveAndLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vmkite-capacity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "capacity.json")
+
+	s, err := Load(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	monday := time.Date(2017, 6, 5, 9, 30, 0, 0, time.UTC)
+	s.SetConcurrency(10)
+	s.Arrival("macos", monday)
+	s.Boot("macos", time.Minute)
+	s.Run("macos", time.Minute*3)
+
+	loaded, err := Load(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Concurrency != 10 {
+		t.Errorf("Concurrency = %d, want 10", loaded.Concurrency)
+	}
+	tmpl := loaded.Templates["macos"]
+	if tmpl == nil {
+		t.Fatal("macos template wasn't saved")
+	}
+	if tmpl.Arrivals[HourOfWeek(monday)] != 1 {
+		t.Errorf("arrivals at Mon 09:00 = %d, want 1", tmpl.Arrivals[HourOfWeek(monday)])
+	}
+	if tmpl.Boots.Mean() != time.Minute || tmpl.Runs.Mean() != time.Minute*3 {
+		t.Errorf("boot and run means = %v, %v", tmpl.Boots.Mean(), tmpl.Runs.Mean())
+	}
+}
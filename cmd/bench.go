@@ -0,0 +1,107 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/macstadium/vmkite/runner"
+
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+)
+
+var (
+	benchParams  runner.BenchParams
+	benchVerbose bool
+)
+
+func ConfigureBench(app *kingpin.Application) {
+	cmd := app.Command("bench", "drive synthetic jobs through the runner with a fake Buildkite and hypervisor")
+
+	cmd.Flag("jobs", "number of synthetic jobs").
+		Default("1000").
+		IntVar(&benchParams.Jobs)
+	cmd.Flag("pipelines", "number of pipelines the jobs are spread over").
+		Default("10").
+		IntVar(&benchParams.Pipelines)
+	cmd.Flag("concurrency", "number of workers").
+		Default("50").
+		IntVar(&benchParams.Concurrency)
+	cmd.Flag("arrival-interval", "time between jobs being queued").
+		Default("5ms").
+		DurationVar(&benchParams.ArrivalInterval)
+	cmd.Flag("create-latency", "average time to create a VM").
+		Default("200ms").
+		DurationVar(&benchParams.CreateLatency)
+	cmd.Flag("job-duration", "average time a VM runs its job for").
+		Default("500ms").
+		DurationVar(&benchParams.JobDuration)
+	cmd.Flag("destroy-latency", "average time to destroy a VM").
+		Default("100ms").
+		DurationVar(&benchParams.DestroyLatency)
+	cmd.Flag("job-timeout", "how long to wait for a VM to power off").
+		Default("5s").
+		DurationVar(&benchParams.JobTimeout)
+	cmd.Flag("deadline", "fail if the jobs haven't all finished by then, dumping goroutines").
+		Default("10m").
+		DurationVar(&benchParams.Deadline)
+	cmd.Flag("create-failure-rate", "fraction of VM creations that fail").
+		Default("0.02").
+		Float64Var(&benchParams.CreateFailureRate)
+	cmd.Flag("hung-poweroff-rate", "fraction of VMs that never power off").
+		Default("0.01").
+		Float64Var(&benchParams.HungPowerOffRate)
+	cmd.Flag("api-error-rate", "fraction of Buildkite API calls that fail").
+		Default("0.02").
+		Float64Var(&benchParams.APIErrorRate)
+	cmd.Flag("dropped-hook-rate", "fraction of hook notifications that never arrive").
+		Default("0.05").
+		Float64Var(&benchParams.DroppedHookRate)
+	cmd.Flag("verbose", "show the runner's logs").
+		BoolVar(&benchVerbose)
+
+	cmd.Action(cmdBench)
+}
+
+func cmdBench(c *kingpin.ParseContext) error {
+	if benchParams.Pipelines < 1 {
+		benchParams.Pipelines = 1
+	}
+	if !benchVerbose {
+		log.SetOutput(ioutil.Discard)
+		defer log.SetOutput(os.Stderr)
+	}
+
+	report, err := runner.Bench(benchParams)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "jobs\t%d (%d succeeded, %d failed)\n", report.Jobs, report.Succeeded, report.Failed)
+	fmt.Fprintf(w, "elapsed\t%v\n", report.Elapsed.Truncate(time.Millisecond))
+	fmt.Fprintf(w, "throughput\t%.1f jobs/s\n", report.Throughput)
+	for _, pc := range []int{50, 90, 99, 100} {
+		fmt.Fprintf(w, "latency p%d\t%v\n", pc, report.Latencies[pc].Truncate(time.Millisecond))
+	}
+	fmt.Fprintf(w, "faults\t%d create failures, %d hung VMs, %d API errors, %d dropped hooks\n",
+		report.CreateFailures, report.HungVMs, report.APIErrors, report.DroppedHooks)
+	fmt.Fprintf(w, "leaks\t%d subscribers, %d auth tokens, %d bootstrap tokens, %d jobs in state, %d preemptible, %d goroutines\n",
+		report.LeakedSubscribers, report.LeakedAuthTokens, report.LeakedBootstraps,
+		report.LeakedStateJobs, report.LeakedPreemptible, report.LeakedGoroutines)
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if report.Succeeded+report.Failed != report.Jobs {
+		return fmt.Errorf("%d jobs finished, expected %d", report.Succeeded+report.Failed, report.Jobs)
+	}
+	if report.LeakedSubscribers+report.LeakedAuthTokens+report.LeakedBootstraps+
+		report.LeakedStateJobs+report.LeakedPreemptible+report.LeakedGoroutines > 0 {
+		return fmt.Errorf("Leaks found")
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/macstadium/vmkite/capacity"
+
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+)
+
+var (
+	capacityFile        string
+	capacityConcurrency int
+)
+
+func ConfigureCapacity(app *kingpin.Application) {
+	cmd := app.Command("capacity", "plan VM capacity from recorded job history")
+
+	report := cmd.Command("report", "recommend how many VMs to keep booted for each template and hour of the week")
+	report.Flag("capacity-stats", "file recorded by vmkite run --capacity-stats").
+		Required().
+		ExistingFileVar(&capacityFile)
+	report.Flag("concurrency", "the concurrency limit to estimate waits for, defaults to the one the stats were recorded with").
+		IntVar(&capacityConcurrency)
+	report.Action(cmdCapacityReport)
+}
+
+var weekdays = []string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"}
+
+func cmdCapacityReport(c *kingpin.ParseContext) error {
+	stats, err := capacity.Load(capacityFile)
+	if err != nil {
+		return err
+	}
+	concurrency := capacityConcurrency
+	if concurrency == 0 {
+		concurrency = stats.Concurrency
+	}
+	if concurrency <= 0 {
+		return fmt.Errorf("%s doesn't record a concurrency limit, pass --concurrency", capacityFile)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "TEMPLATE\tHOUR\tJOBS/H\tBUSY VMS\tWARM VMS\tWAIT\tWAIT (WARM)")
+
+	for _, rec := range capacity.Recommend(stats, concurrency) {
+		wait, warmWait := "unbounded", "unbounded"
+		if !rec.Saturated {
+			wait = rec.Wait.Truncate(time.Second).String()
+			warmWait = rec.WarmWait.Truncate(time.Second).String()
+		}
+		fmt.Fprintf(w, "%s\t%s %02d:00\t%.1f\t%.1f\t%d\t%s\t%s\n",
+			rec.Template, weekdays[rec.Hour/24], rec.Hour%24,
+			rec.ArrivalRate, rec.BusyVMs, rec.WarmVMs, wait, warmWait)
+	}
+
+	return w.Flush()
+}
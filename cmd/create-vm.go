@@ -2,10 +2,13 @@ package cmd
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 
+	"github.com/alecthomas/units"
 	"github.com/macstadium/vmkite/creator"
+	"github.com/macstadium/vmkite/images"
 	"github.com/macstadium/vmkite/vsphere"
 
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
@@ -13,7 +16,11 @@ import (
 
 var (
 	vmClusterPath       string
-	vmDS                string
+	vmDatastores        []string
+	vmDatastoreCluster  string
+	vmDatastoreMinFree  units.Base2Bytes
+	vmDatastoreMaxVMs   int
+	vmUseReplicas       bool
 	vmdkDS              string
 	vmdkPath            string
 	vmNetwork           string
@@ -21,6 +28,7 @@ var (
 	vmNumCPUs           int32
 	vmNumCoresPerSocket int32
 	vmGuestId           string
+	vmSerialLog         bool
 )
 
 var (
@@ -28,25 +36,32 @@ var (
 )
 
 func ConfigureCreateVM(app *kingpin.Application) {
-	cmd := app.Command("create-vm", "create a virtual machine")
+	cmd := app.Command("create-vm", "create a virtual machine for testing an image by hand, without a Buildkite agent token")
 
 	addCreateVMFlags(cmd)
 
-	cmd.Flag("source-path", "path of source disk image").
+	cmd.Flag("source-path", "path of source disk image, or an image reference like macos-10.13:latest").
 		Required().
 		StringVar(&vmdkPath)
 
-	cmd.Flag("buildkite-agent-token", "Buildkite Agent Token").
-		Required().
-		StringVar(&buildkiteAgentToken)
-
+	cmd.PreAction(requireVsphere)
 	cmd.Action(cmdCreateVM)
 }
 
 func addCreateVMFlags(cmd *kingpin.CmdClause) {
-	cmd.Flag("target-datastore", "name of datastore for new VM").
-		Required().
-		StringVar(&vmDS)
+	cmd.Flag("target-datastore", "name of datastore for new VM, repeat to choose between several").
+		StringsVar(&vmDatastores)
+
+	cmd.Flag("target-datastore-cluster", "path of a datastore cluster to choose a datastore from").
+		StringVar(&vmDatastoreCluster)
+
+	cmd.Flag("datastore-min-free", "Minimum free space a datastore must keep after taking a new VM, e.g. 50GB").
+		Default("0B").
+		BytesVar(&vmDatastoreMinFree)
+
+	cmd.Flag("datastore-max-vms", "Maximum VMs on a datastore before it isn't chosen, 0 for no limit").
+		Default("0").
+		IntVar(&vmDatastoreMaxVMs)
 
 	cmd.Flag("source-datastore", "name of datastore holding source image").
 		Required().
@@ -72,6 +87,12 @@ func addCreateVMFlags(cmd *kingpin.CmdClause) {
 		Required().
 		Int32Var(&vmNumCoresPerSocket)
 
+	cmd.Flag("use-image-replicas", "Read the source disk from a replica on the target datastore if there is one").
+		BoolVar(&vmUseReplicas)
+
+	cmd.Flag("vm-serial-log", "Add a serial port writing to serial.log in the VM's directory, saved with other diagnostics").
+		BoolVar(&vmSerialLog)
+
 	cmd.Flag("vm-guest-id", "The guestid of the vm").
 		Default("darwin14_64Guest").
 		StringVar(&vmGuestId)
@@ -80,29 +101,51 @@ func addCreateVMFlags(cmd *kingpin.CmdClause) {
 		StringMapVar(&vmGuestInfo)
 }
 
+func creatorOptions() (creator.Options, error) {
+	if len(vmDatastores) == 0 && vmDatastoreCluster == "" {
+		return creator.Options{}, errors.New("one of --target-datastore or --target-datastore-cluster is required")
+	}
+	return creator.Options{
+		Datastores:         vmDatastores,
+		DatastoreCluster:   vmDatastoreCluster,
+		MinFreeSpace:       vmDatastoreMinFree,
+		MaxVMsPerDatastore: vmDatastoreMaxVMs,
+		Replicas:           vmUseReplicas,
+	}, nil
+}
+
 func cmdCreateVM(c *kingpin.ParseContext) error {
 	ctx := context.Background()
 
+	opts, err := creatorOptions()
+	if err != nil {
+		return err
+	}
+
 	vs, err := vsphere.NewSession(ctx, connectionParams)
 	if err != nil {
 		return err
 	}
 
+	srcDiskPath, err := images.Resolve(vs, vmdkDS, vmdkPath)
+	if err != nil {
+		return err
+	}
+
 	params := vsphere.VirtualMachineCreationParams{
-		BuildkiteAgentToken: buildkiteAgentToken,
-		ClusterPath:         vmClusterPath,
-		DatastoreName:       vmDS,
-		MemoryMB:            vmMemoryMB,
-		Name:                fmt.Sprintf("vmkite-%s", time.Now().Format("200612-150405")),
-		NetworkLabel:        vmNetwork,
-		NumCPUs:             vmNumCPUs,
-		NumCoresPerSocket:   vmNumCoresPerSocket,
-		SrcDiskDataStore:    vmdkDS,
-		SrcDiskPath:         vmdkPath,
-		GuestInfo:           vmGuestInfo,
+		ClusterPath:       vmClusterPath,
+		MemoryMB:          vmMemoryMB,
+		Name:              fmt.Sprintf("vmkite-%s", time.Now().Format("200612-150405")),
+		NetworkLabel:      vmNetwork,
+		NumCPUs:           vmNumCPUs,
+		NumCoresPerSocket: vmNumCoresPerSocket,
+		SrcDiskDataStore:  vmdkDS,
+		SrcDiskPath:       srcDiskPath,
+		SerialLog:         vmSerialLog,
+		GuestInfo:         vmGuestInfo,
 	}
 
-	_, err = creator.CreateVM(vs, params)
+	_, err = creator.CreateVM(vs, params, opts)
 	if err != nil {
 		return err
 	}
@@ -19,6 +19,7 @@ func ConfigureDestroyVM(app *kingpin.Application) {
 		Required().
 		StringsVar(&vmNames)
 
+	cmd.PreAction(requireVsphere)
 	cmd.Action(cmdDestroyVM)
 }
 
@@ -0,0 +1,149 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/macstadium/vmkite/eventlog"
+
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+)
+
+var (
+	eventLogFile string
+	eventsFrom   string
+	eventsFollow bool
+	eventsJSON   bool
+	eventsJobID  string
+)
+
+func ConfigureEvents(app *kingpin.Application) {
+	events := app.Command("events", "show what vmkite run did with each job")
+	events.Flag("event-log", "file recorded by vmkite run --event-log").
+		StringVar(&eventLogFile)
+	events.Flag("from", "address of a vmkite run --event-stream API server to follow instead, e.g. 10.0.0.2:8080").
+		StringVar(&eventsFrom)
+	events.Flag("operator-token", "the --operator-token of the vmkite run to follow with --from; may be a file:, env: or vault: reference").
+		StringVar(&operatorToken)
+	events.Flag("follow", "keep showing events as they are recorded").
+		Short('f').
+		BoolVar(&eventsFollow)
+	events.Flag("job", "only show events for a job ID").
+		StringVar(&eventsJobID)
+	events.Flag("json", "show events as JSON lines").
+		BoolVar(&eventsJSON)
+	events.Action(cmdEvents)
+
+	history := app.Command("history", "show the lifecycle of a job")
+	history.Flag("event-log", "file recorded by vmkite run --event-log").
+		Required().
+		ExistingFileVar(&eventLogFile)
+	history.Flag("job", "the job ID").
+		Required().
+		StringVar(&eventsJobID)
+	history.Action(cmdHistory)
+}
+
+func cmdEvents(c *kingpin.ParseContext) error {
+	show := func(e eventlog.Event) error {
+		if eventsJobID != "" && e.JobID != eventsJobID {
+			return nil
+		}
+		if eventsJSON {
+			return json.NewEncoder(os.Stdout).Encode(e)
+		}
+		fmt.Printf("%s  %-11s  %s  %s\n",
+			e.Time.Format(time.RFC3339), e.Type, e.Job, eventDetails(e))
+		return nil
+	}
+
+	if eventsFrom != "" {
+		url := "http://" + eventsFrom + "/events"
+		if eventsJobID != "" {
+			url += "?job=" + eventsJobID
+		}
+		token, err := secretResolver.Resolve(operatorToken)
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("GET %s: %s", url, resp.Status)
+		}
+		return eventlog.Read(resp.Body, false, show)
+	}
+
+	if eventLogFile == "" {
+		return errors.New("one of --event-log or --from is required")
+	}
+	f, err := os.Open(eventLogFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return eventlog.Read(f, eventsFollow, show)
+}
+
+func cmdHistory(c *kingpin.ParseContext) error {
+	f, err := os.Open(eventLogFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tEVENT\tSINCE\tELAPSED\tDETAILS")
+
+	found := false
+	err = eventlog.Read(f, false, func(e eventlog.Event) error {
+		if e.JobID != eventsJobID {
+			return nil
+		}
+		if !found {
+			fmt.Printf("%s\n\n", e.Job)
+			found = true
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", e.Time.Format(time.RFC3339), e.Type,
+			e.Since.Truncate(time.Second), e.Elapsed.Truncate(time.Second), eventDetails(e))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("No events for job %s in %s", eventsJobID, eventLogFile)
+	}
+	return w.Flush()
+}
+
+// eventDetails describes the parts of an event that are set
+func eventDetails(e eventlog.Event) string {
+	details := []string{}
+	for _, d := range []struct{ key, value string }{
+		{"vm", e.VM},
+		{"host", e.Host},
+		{"hook", e.Hook},
+		{"exit_status", e.ExitStatus},
+		{"error", e.Error},
+	} {
+		if d.value != "" {
+			details = append(details, d.key+"="+d.value)
+		}
+	}
+	return strings.Join(details, " ")
+}
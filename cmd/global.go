@@ -1,6 +1,10 @@
 package cmd
 
 import (
+	"fmt"
+	"time"
+
+	"github.com/macstadium/vmkite/secrets"
 	"github.com/macstadium/vmkite/vsphere"
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
 )
@@ -9,19 +13,24 @@ var (
 	clusterPath      string
 	vmPath           string
 	connectionParams vsphere.ConnectionParams
+	vspherePassRef   string
+	vaultAddr        string
+	vaultToken       string
+	secretsRefresh   time.Duration
+	secretResolver   *secrets.Resolver
+	vaultProvider    *secrets.VaultProvider
 )
 
 func ConfigureGlobal(app *kingpin.Application) {
+	// the vSphere flags are only required by commands that connect, see
+	// requireVsphere
 	app.Flag("vsphere-host", "vSphere hostname or IP address").
-		Required().
 		StringVar(&connectionParams.Host)
 
 	app.Flag("vsphere-user", "vSphere username").
-		Required().
 		StringVar(&connectionParams.User)
 
-	app.Flag("vsphere-pass", "vSphere password").
-		Required().
+	app.Flag("vsphere-pass", "vSphere password, or a file:, env: or vault: reference to it").
 		StringVar(&connectionParams.Pass)
 
 	app.Flag("vsphere-insecure", "vSphere certificate verification").
@@ -29,6 +38,53 @@ func ConfigureGlobal(app *kingpin.Application) {
 		BoolVar(&connectionParams.Insecure)
 
 	app.Flag("vm-path", "path to folder containing virtual machines").
-		Required().
 		StringVar(&vmPath)
+
+	app.Flag("vault-addr", "Address of a Vault server to resolve vault:path#key secret references with").
+		StringVar(&vaultAddr)
+
+	app.Flag("vault-token", "Vault token, or a file: or env: reference to it").
+		StringVar(&vaultToken)
+
+	app.Flag("secrets-refresh", "How often to re-read secret references to pick up rotated credentials, 0 to disable").
+		Default("5m").
+		DurationVar(&secretsRefresh)
+
+	app.PreAction(resolveGlobalSecrets)
+}
+
+// resolveGlobalSecrets sets up the secret resolver and replaces the vSphere
+// password reference with its value, keeping the reference for refreshes
+func resolveGlobalSecrets(c *kingpin.ParseContext) error {
+	secretResolver = secrets.NewResolver()
+	if vaultAddr != "" {
+		token, err := secretResolver.Resolve(vaultToken)
+		if err != nil {
+			return err
+		}
+		vaultProvider = secrets.NewVaultProvider(vaultAddr, token)
+		secretResolver.Register("vault", vaultProvider)
+	}
+
+	vspherePassRef = connectionParams.Pass
+	return secretResolver.ResolveAll(&connectionParams.Pass)
+}
+
+// requireVsphere checks the vSphere connection flags, as a PreAction of the
+// commands that connect to vSphere
+func requireVsphere(c *kingpin.ParseContext) error {
+	flags := []struct {
+		name, value string
+	}{
+		{"vsphere-host", connectionParams.Host},
+		{"vsphere-user", connectionParams.User},
+		{"vsphere-pass", connectionParams.Pass},
+		{"vm-path", vmPath},
+	}
+	for _, flag := range flags {
+		if flag.value == "" {
+			return fmt.Errorf("required flag --%s not provided", flag.name)
+		}
+	}
+	return nil
 }
@@ -0,0 +1,193 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/macstadium/vmkite/vsphere"
+
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+)
+
+var (
+	guestAuth    vsphere.GuestAuth
+	guestVMName  string
+	guestCommand []string
+	guestCpSrc   string
+	guestCpDst   string
+	guestTimeout time.Duration
+	execTimeout  time.Duration
+)
+
+func ConfigureGuest(app *kingpin.Application) {
+	exec := app.Command("exec", "run a command in a VM's guest OS through VMware Tools")
+	addGuestFlags(exec)
+	exec.Flag("timeout", "how long the command can run for").
+		Default("1h").
+		DurationVar(&execTimeout)
+	exec.Arg("vm", "name of the virtual machine").
+		Required().
+		StringVar(&guestVMName)
+	exec.Arg("command", "command and arguments to run, after --").
+		Required().
+		StringsVar(&guestCommand)
+	exec.PreAction(requireVsphere)
+	exec.Action(cmdExec)
+
+	cp := app.Command("cp", "copy a file into or out of a VM's guest OS, e.g. vmkite cp my-vm:/var/log/system.log .")
+	addGuestFlags(cp)
+	cp.Arg("src", "source, either a local path or VM:PATH").
+		Required().
+		StringVar(&guestCpSrc)
+	cp.Arg("dst", "destination, either a local path or VM:PATH").
+		Required().
+		StringVar(&guestCpDst)
+	cp.PreAction(requireVsphere)
+	cp.Action(cmdCp)
+}
+
+func addGuestFlags(cmd *kingpin.CmdClause) {
+	cmd.Flag("guest-user", "user to authenticate as in the guest").
+		Required().
+		StringVar(&guestAuth.User)
+
+	cmd.Flag("guest-pass", "password of the guest user").
+		Required().
+		StringVar(&guestAuth.Pass)
+
+	cmd.Flag("tools-timeout", "how long to wait for VMware Tools to be running").
+		Default("2m").
+		DurationVar(&guestTimeout)
+}
+
+func guestVM(vs *vsphere.Session, name string) (*vsphere.VirtualMachine, error) {
+	vm, err := vs.VirtualMachine(vmPath + "/" + name)
+	if err != nil {
+		return nil, err
+	}
+	return vm, vm.WaitForTools(guestTimeout)
+}
+
+func cmdExec(c *kingpin.ParseContext) error {
+	vs, err := vsphere.NewSession(context.Background(), connectionParams)
+	if err != nil {
+		return err
+	}
+
+	vm, err := guestVM(vs, guestVMName)
+	if err != nil {
+		return err
+	}
+
+	// guest operations don't return output, so capture it in a file
+	output := fmt.Sprintf("/tmp/vmkite-exec-%d.log", time.Now().UnixNano())
+	script := fmt.Sprintf("%s > %s 2>&1", shellJoin(guestCommand), output)
+
+	pid, err := vm.StartProgram(guestAuth, "/bin/sh", "-c "+shellQuote(script), nil)
+	if err != nil {
+		return err
+	}
+	exitCode, err := vm.WaitForProgram(guestAuth, pid, execTimeout)
+	if err != nil {
+		return err
+	}
+
+	r, _, err := vm.CopyFromGuest(guestAuth, output)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(os.Stdout, r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+
+	if _, err := vm.StartProgram(guestAuth, "/bin/rm", "-f "+shellQuote(output), nil); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to remove %s: %v\n", output, err)
+	}
+
+	if exitCode != 0 {
+		return fmt.Errorf("command exited with %d", exitCode)
+	}
+	return nil
+}
+
+func cmdCp(c *kingpin.ParseContext) error {
+	srcVM, srcPath := splitGuestPath(guestCpSrc)
+	dstVM, dstPath := splitGuestPath(guestCpDst)
+
+	if (srcVM == "") == (dstVM == "") {
+		return fmt.Errorf("exactly one of src and dst must be a VM:PATH")
+	}
+
+	vs, err := vsphere.NewSession(context.Background(), connectionParams)
+	if err != nil {
+		return err
+	}
+
+	if srcVM != "" {
+		vm, err := guestVM(vs, srcVM)
+		if err != nil {
+			return err
+		}
+		r, _, err := vm.CopyFromGuest(guestAuth, srcPath)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+
+		if info, err := os.Stat(dstPath); err == nil && info.IsDir() {
+			dstPath = dstPath + "/" + srcPath[strings.LastIndex(srcPath, "/")+1:]
+		}
+		f, err := os.Create(dstPath)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, r); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}
+
+	vm, err := guestVM(vs, dstVM)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return vm.CopyToGuest(guestAuth, f, info.Size(), dstPath, int64(info.Mode().Perm()))
+}
+
+// splitGuestPath splits "vm:/path" into its VM name and path, local paths
+// have an empty VM name
+func splitGuestPath(s string) (string, string) {
+	i := strings.Index(s, ":")
+	if i <= 0 || strings.Contains(s[:i], "/") {
+		return "", s
+	}
+	return s[:i], s[i+1:]
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+func shellJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
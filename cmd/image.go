@@ -0,0 +1,401 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/alecthomas/units"
+	"github.com/macstadium/vmkite/images"
+	"github.com/macstadium/vmkite/vsphere"
+
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+)
+
+var (
+	imageDatastore  string
+	imagePath       string
+	imageReplicaDSs []string
+	imagePrefix     string
+	imageLocalFile  string
+	imageBuild      images.BuildParams
+	imagePromote    bool
+	imageName       string
+	imageVersion    string
+	imageAlias      string
+)
+
+func ConfigureImage(app *kingpin.Application) {
+	cmd := app.Command("image", "manage base images")
+	cmd.PreAction(requireVsphere)
+
+	replicate := cmd.Command("replicate", "copy a base image to other datastores")
+	addImageSourceFlags(replicate)
+	replicate.Flag("target-datastore", "name of datastore to copy the image to").
+		Required().
+		StringsVar(&imageReplicaDSs)
+	replicate.Action(cmdImageReplicate)
+
+	replicas := cmd.Command("replicas", "show which datastores hold copies of a base image")
+	addImageSourceFlags(replicas)
+	replicas.Flag("target-datastore", "name of datastore to look for copies on").
+		Required().
+		StringsVar(&imageReplicaDSs)
+	replicas.Action(cmdImageReplicas)
+
+	list := cmd.Command("list", "list base images on a datastore")
+	list.Flag("datastore", "name of datastore holding images").
+		Required().
+		StringVar(&imageDatastore)
+	list.Flag("prefix", "directory on the datastore to list images under").
+		Default("").
+		StringVar(&imagePrefix)
+	list.Action(cmdImageList)
+
+	upload := cmd.Command("upload", "upload a local VMDK or OVA as a base image")
+	upload.Arg("file", "local .vmdk or .ova file").
+		Required().
+		ExistingFileVar(&imageLocalFile)
+	addImageFlags(upload)
+	upload.Action(cmdImageUpload)
+
+	verify := cmd.Command("verify", "check a base image's descriptor and disk chain")
+	addImageFlags(verify)
+	verify.Action(cmdImageVerify)
+
+	retire := cmd.Command("retire", "delete a base image that no VMs are using")
+	addImageFlags(retire)
+	retire.Action(cmdImageRetire)
+
+	build := cmd.Command("build", "build a new image version by provisioning a base image in a VM")
+	addCreateVMFlags(build)
+	build.Flag("source-path", "path of the base disk image to build from").
+		Required().
+		StringVar(&vmdkPath)
+	build.Flag("name", "name of the image to build, e.g. macos-10.13").
+		Required().
+		StringVar(&imageBuild.Name)
+	build.Flag("image-version", "version of the image to build, defaults to the current time").
+		Default(time.Now().Format("20060102-150405")).
+		StringVar(&imageBuild.Version)
+	build.Flag("script", "local provisioning script to run in the guest").
+		Required().
+		ExistingFileVar(&imageBuild.Script)
+	build.Flag("guest-user", "user to run the provisioning script as").
+		Required().
+		StringVar(&imageBuild.GuestAuth.User)
+	build.Flag("guest-pass", "password of the guest user, or a file:, env: or vault: reference to it").
+		Required().
+		StringVar(&imageBuild.GuestAuth.Pass)
+	build.Flag("script-timeout", "how long the provisioning script can run for").
+		Default("2h").
+		DurationVar(&imageBuild.ScriptTimeout)
+	build.Flag("tools-timeout", "how long to wait for VMware Tools to start in the guest").
+		Default("10m").
+		DurationVar(&imageBuild.ToolsTimeout)
+	build.Flag("shutdown-timeout", "how long to wait for the guest to shut down").
+		Default("5m").
+		DurationVar(&imageBuild.Timeout)
+	build.Flag("promote", "point the image's latest alias at the new version once built").
+		BoolVar(&imagePromote)
+	build.Action(cmdImageBuild)
+
+	versions := cmd.Command("versions", "list the versions and aliases of an image")
+	addImageNameFlags(versions)
+	versions.Action(cmdImageVersions)
+
+	promote := cmd.Command("promote", "point an image alias at a version")
+	addImageNameFlags(promote)
+	promote.Flag("image-version", "version to promote").
+		Required().
+		StringVar(&imageVersion)
+	promote.Flag("alias", "alias to point at the version").
+		Default("latest").
+		StringVar(&imageAlias)
+	promote.Action(cmdImagePromote)
+
+	rollback := cmd.Command("rollback", "point an image alias back at its previous version")
+	addImageNameFlags(rollback)
+	rollback.Flag("alias", "alias to roll back").
+		Default("latest").
+		StringVar(&imageAlias)
+	rollback.Action(cmdImageRollback)
+}
+
+func addImageNameFlags(cmd *kingpin.CmdClause) {
+	cmd.Flag("datastore", "name of datastore holding the image").
+		Required().
+		StringVar(&imageDatastore)
+
+	cmd.Flag("name", "name of the image, e.g. macos-10.13").
+		Required().
+		StringVar(&imageName)
+}
+
+func addImageFlags(cmd *kingpin.CmdClause) {
+	cmd.Flag("datastore", "name of datastore holding the image").
+		Required().
+		StringVar(&imageDatastore)
+
+	cmd.Flag("path", "path of the image's .vmdk on the datastore").
+		Required().
+		StringVar(&imagePath)
+}
+
+func addImageSourceFlags(cmd *kingpin.CmdClause) {
+	cmd.Flag("source-datastore", "name of datastore holding source image").
+		Required().
+		StringVar(&imageDatastore)
+
+	cmd.Flag("source-path", "path of source disk image").
+		Required().
+		StringVar(&imagePath)
+}
+
+func cmdImageReplicate(c *kingpin.ParseContext) error {
+	vs, err := vsphere.NewSession(context.Background(), connectionParams)
+	if err != nil {
+		return err
+	}
+
+	for _, ds := range imageReplicaDSs {
+		ok, err := images.HasReplica(vs, imageDatastore, imagePath, ds)
+		if err != nil {
+			return err
+		}
+		if ok {
+			fmt.Printf("%s already has a copy of %s\n", ds, imagePath)
+			continue
+		}
+		if err := images.Replicate(vs, imageDatastore, imagePath, ds); err != nil {
+			return err
+		}
+		fmt.Printf("Copied %s to %s\n", imagePath, ds)
+	}
+
+	return nil
+}
+
+func cmdImageReplicas(c *kingpin.ParseContext) error {
+	vs, err := vsphere.NewSession(context.Background(), connectionParams)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "DATASTORE\tSOURCE\tCHECKSUM\tREPLICATED")
+
+	for _, ds := range append([]string{imageDatastore}, imageReplicaDSs...) {
+		sidecar, err := images.ReadSidecar(vs, ds, imagePath)
+		if err != nil {
+			return err
+		}
+		if sidecar == nil {
+			fmt.Fprintf(w, "%s\t-\t-\t-\n", ds)
+			continue
+		}
+		replicated := "-"
+		if !sidecar.ReplicatedAt.IsZero() {
+			replicated = sidecar.ReplicatedAt.Format("2006-01-02 15:04")
+		}
+		source := sidecar.Source
+		if source == "" {
+			source = "(original)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", ds, source, sidecar.Checksum, replicated)
+	}
+
+	return w.Flush()
+}
+
+func cmdImageList(c *kingpin.ParseContext) error {
+	vs, err := vsphere.NewSession(context.Background(), connectionParams)
+	if err != nil {
+		return err
+	}
+
+	imgs, err := images.List(vs, imageDatastore, imagePrefix, vmPath)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PATH\tCAPACITY\tTYPE\tCID\tPARENT\tUSED BY")
+
+	for _, img := range imgs {
+		capacity := units.Base2Bytes(img.CapacityKB * 1024).String()
+		diskType, cid, parent := "?", "?", "-"
+		if img.Descriptor != nil {
+			diskType, cid = img.Descriptor.CreateType, img.Descriptor.CID
+			if img.Descriptor.IsChild() {
+				parent = img.Descriptor.ParentFileNameHint
+			}
+		}
+		users := []string{}
+		for _, vm := range img.UsedBy {
+			if vm.Template {
+				users = append(users, vm.Name+" (template)")
+			} else {
+				users = append(users, vm.Name)
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			img.Path, capacity, diskType, cid, parent, strings.Join(users, ", "))
+	}
+
+	return w.Flush()
+}
+
+func cmdImageUpload(c *kingpin.ParseContext) error {
+	vs, err := vsphere.NewSession(context.Background(), connectionParams)
+	if err != nil {
+		return err
+	}
+
+	if err := images.Upload(vs, imageLocalFile, imageDatastore, imagePath); err != nil {
+		return err
+	}
+
+	fmt.Printf("Uploaded %s to [%s] %s\n", imageLocalFile, imageDatastore, imagePath)
+	return nil
+}
+
+func cmdImageVerify(c *kingpin.ParseContext) error {
+	vs, err := vsphere.NewSession(context.Background(), connectionParams)
+	if err != nil {
+		return err
+	}
+
+	chain, err := images.Verify(vs, imageDatastore, imagePath)
+	if err != nil {
+		return err
+	}
+
+	for i, desc := range chain {
+		fmt.Printf("%s%s CID=%s size=%s\n", strings.Repeat("  ", i),
+			desc.CreateType, desc.CID, units.Base2Bytes(desc.Size()))
+	}
+	fmt.Printf("[%s] %s is OK\n", imageDatastore, imagePath)
+	return nil
+}
+
+func cmdImageRetire(c *kingpin.ParseContext) error {
+	vs, err := vsphere.NewSession(context.Background(), connectionParams)
+	if err != nil {
+		return err
+	}
+
+	if err := images.Retire(vs, imageDatastore, imagePath, vmPath); err != nil {
+		return err
+	}
+
+	fmt.Printf("Deleted [%s] %s\n", imageDatastore, imagePath)
+	return nil
+}
+
+func cmdImageBuild(c *kingpin.ParseContext) error {
+	if len(vmDatastores) == 0 {
+		return errors.New("--target-datastore is required for image builds")
+	}
+	if err := secretResolver.ResolveAll(&imageBuild.GuestAuth.Pass); err != nil {
+		return err
+	}
+
+	vs, err := vsphere.NewSession(context.Background(), connectionParams)
+	if err != nil {
+		return err
+	}
+
+	p := imageBuild
+	p.BaseDatastore = vmdkDS
+	p.BasePath = vmdkPath
+	p.Datastore = vmdkDS
+	p.VM = vsphere.VirtualMachineCreationParams{
+		ClusterPath:       vmClusterPath,
+		DatastoreName:     vmDatastores[0],
+		MemoryMB:          vmMemoryMB,
+		NetworkLabel:      vmNetwork,
+		NumCPUs:           vmNumCPUs,
+		NumCoresPerSocket: vmNumCoresPerSocket,
+		GuestID:           vmGuestId,
+		GuestInfo:         vmGuestInfo,
+	}
+
+	if err := images.Build(vs, p); err != nil {
+		return err
+	}
+
+	fmt.Printf("Built [%s] %s\n", p.Datastore, images.VersionPath(p.Name, p.Version))
+
+	if imagePromote {
+		if err := images.Promote(vs, p.Datastore, p.Name, p.Version, "latest"); err != nil {
+			return err
+		}
+		fmt.Printf("Promoted %s:%s to latest\n", p.Name, p.Version)
+	}
+	return nil
+}
+
+func cmdImageVersions(c *kingpin.ParseContext) error {
+	vs, err := vsphere.NewSession(context.Background(), connectionParams)
+	if err != nil {
+		return err
+	}
+
+	versions, err := images.Versions(vs, imageDatastore, imageName)
+	if err != nil {
+		return err
+	}
+	reg, err := images.ReadRegistry(vs, imageDatastore, imageName)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tALIASES")
+	for _, version := range versions {
+		aliases := []string{}
+		for alias, v := range reg.Aliases {
+			if v == version {
+				aliases = append(aliases, alias)
+			}
+		}
+		sort.Strings(aliases)
+		fmt.Fprintf(w, "%s:%s\t%s\n", imageName, version, strings.Join(aliases, ", "))
+	}
+	return w.Flush()
+}
+
+func cmdImagePromote(c *kingpin.ParseContext) error {
+	vs, err := vsphere.NewSession(context.Background(), connectionParams)
+	if err != nil {
+		return err
+	}
+
+	if err := images.Promote(vs, imageDatastore, imageName, imageVersion, imageAlias); err != nil {
+		return err
+	}
+
+	fmt.Printf("%s:%s now points at %s\n", imageName, imageAlias, imageVersion)
+	return nil
+}
+
+func cmdImageRollback(c *kingpin.ParseContext) error {
+	vs, err := vsphere.NewSession(context.Background(), connectionParams)
+	if err != nil {
+		return err
+	}
+
+	version, err := images.Rollback(vs, imageDatastore, imageName, imageAlias)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s:%s now points at %s\n", imageName, imageAlias, version)
+	return nil
+}
@@ -2,8 +2,16 @@ package cmd
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/macstadium/vmkite/buildkite"
+	"github.com/macstadium/vmkite/capacity"
+	"github.com/macstadium/vmkite/eventlog"
+	"github.com/macstadium/vmkite/images"
 	"github.com/macstadium/vmkite/runner"
 	"github.com/macstadium/vmkite/vsphere"
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
@@ -17,19 +25,48 @@ var (
 	concurrency         int
 	apiListenOn         string
 	apiTokenSecret      string
+	operatorToken       string
+	createAttempts      int
+	createBackoff       time.Duration
+	replicateImages     bool
+	vmSecrets           = map[string]string{}
+	pipelineAgentTokens = map[string]string{}
+	agentPriority       int
+	profilesFile        string
+	jobSource           string
+	pipelineWeights     = map[string]int{}
+	pipelineTeams       = map[string]string{}
+	teamWeights         = map[string]int{}
+	pipelineMaxVMs      = map[string]int{}
+	preemption          runner.PreemptionParams
+	capacityStatsFile   string
+	dryRun              bool
+	dryRunJobDuration   time.Duration
+	diagnosticsDir      string
+	keepOnFailure       runner.KeepParams
+	annotateBuilds      string
+	runEventLog         string
+	eventStream         bool
 )
 
 func ConfigureRun(app *kingpin.Application) {
 	cmd := app.Command("run", "wait for Buildkite jobs, launch VMs")
 
-	cmd.Flag("buildkite-agent-token", "Buildkite Agent Token").
+	cmd.Flag("buildkite-agent-token", "Buildkite Agent Token, or a file:, env: or vault: reference to it").
 		Required().
 		StringVar(&buildkiteAgentToken)
 
-	cmd.Flag("buildkite-api-token", "Buildkite API Token").
+	cmd.Flag("buildkite-api-token", "Buildkite API Token, or a file:, env: or vault: reference to it").
 		Required().
 		StringVar(&buildkiteApiToken)
 
+	cmd.Flag("pipeline-agent-token", "A pipeline=token agent token for jobs from a pipeline, overriding --buildkite-agent-token; tokens may be file:, env: or vault: references").
+		StringMapVar(&pipelineAgentTokens)
+
+	cmd.Flag("agent-priority", "The priority of the agent started in each VM").
+		Default("0").
+		IntVar(&agentPriority)
+
 	cmd.Flag("buildkite-org", "Buildkite organization slug").
 		Required().
 		StringVar(&buildkiteOrg)
@@ -37,28 +74,175 @@ func ConfigureRun(app *kingpin.Application) {
 	cmd.Flag("buildkite-pipeline", "Limit to a specific buildkite pipelines").
 		StringsVar(&buildkitePipelines)
 
+	cmd.Flag("job-source", "How to find jobs: builds lists running builds with the REST API, graphql asks the GraphQL API for just scheduled jobs").
+		Default(buildkite.SourceBuilds).
+		EnumVar(&jobSource, buildkite.SourceBuilds, buildkite.SourceGraphQL)
+
+	cmd.Flag("profiles", "A JSON file of profiles mapping jobs to VMs by queue, tags, pipeline and branch").
+		ExistingFileVar(&profilesFile)
+
 	cmd.Flag("concurrency", "Limit how many concurrent jobs are run").
 		Default("3").
 		IntVar(&concurrency)
 
+	cmd.Flag("pipeline-weight", "A pipeline=N share of VMs relative to other pipelines, 1 by default").
+		SetValue(intMapValue(pipelineWeights))
+
+	cmd.Flag("pipeline-team", "A pipeline=team assignment, pipelines in a team share the team's VMs").
+		StringMapVar(&pipelineTeams)
+
+	cmd.Flag("team-weight", "A team=N share of VMs relative to other teams and pipelines, 1 by default").
+		SetValue(intMapValue(teamWeights))
+
+	cmd.Flag("pipeline-max-vms", "A pipeline=N limit on how many VMs a pipeline can have at once").
+		SetValue(intMapValue(pipelineMaxVMs))
+
+	cmd.Flag("preempt", "Destroy a lower priority job's VM and retry the job when an urgent job is queued and all workers are busy").
+		BoolVar(&preemption.Enabled)
+
+	cmd.Flag("preempt-min-priority", "The priority a job needs to preempt others").
+		Default("1").
+		IntVar(&preemption.MinPriority)
+
+	cmd.Flag("preempt-policy", "Which job to preempt: lowest-priority, or newest to waste the least work").
+		Default(runner.PreemptLowestPriority).
+		EnumVar(&preemption.Policy, runner.PreemptLowestPriority, runner.PreemptNewest)
+
+	cmd.Flag("capacity-stats", "A file to record job arrivals and VM boot times in, for vmkite capacity report").
+		StringVar(&capacityStatsFile)
+
+	cmd.Flag("dry-run", "Log the VMs that would be created for real jobs, without changing anything in vSphere or Buildkite").
+		BoolVar(&dryRun)
+
+	cmd.Flag("dry-run-job-duration", "How long each job pretends to run for in a dry run").
+		Default("5m").
+		DurationVar(&dryRunJobDuration)
+
+	cmd.Flag("diagnostics-dir", "Save a screenshot, vmware.log and serial output of VMs that time out or run the wrong job here, per job").
+		StringVar(&diagnosticsDir)
+
+	cmd.Flag("keep-on-failure", "Keep the VMs of failed jobs powered on for debugging, jobs can also opt in or out with vmkite-keep-on-failure=true or false").
+		BoolVar(&keepOnFailure.Enabled)
+
+	cmd.Flag("keep-on-failure-ttl", "How long to keep the VM of a failed job before destroying it").
+		Default("2h").
+		DurationVar(&keepOnFailure.TTL)
+
+	cmd.Flag("keep-on-failure-max", "Maximum VMs kept for debugging at once, which don't count towards --concurrency, 0 to keep none").
+		Default("2").
+		IntVar(&keepOnFailure.MaxVMs)
+
+	cmd.Flag("annotate-builds", "Which builds to annotate: none, failures for jobs that couldn't get a VM, or all to also show the VM each job ran on").
+		Default(runner.AnnotateFailures).
+		EnumVar(&annotateBuilds, runner.AnnotateNone, runner.AnnotateFailures, runner.AnnotateAll)
+
+	cmd.Flag("event-log", "Append a JSON line to this file for everything that happens to each job, for vmkite events and vmkite history").
+		StringVar(&runEventLog)
+
+	cmd.Flag("event-stream", "Stream events as JSON lines from /events on the API server, for vmkite events --from").
+		BoolVar(&eventStream)
+
 	cmd.Flag("api-listen", "The address and port for the api server to listen on").
 		StringVar(&apiListenOn)
 
 	cmd.Flag("api-token-secret", "The secret to use for generating api job auth tokens").
 		StringVar(&apiTokenSecret)
 
+	cmd.Flag("operator-token", "Token required for the dashboard and event stream on the API server, which are disabled without one; may be a file:, env: or vault: reference").
+		StringVar(&operatorToken)
+
+	cmd.Flag("create-attempts", "How many times to try creating a VM on transient errors").
+		Default("3").
+		IntVar(&createAttempts)
+
+	cmd.Flag("create-backoff", "How long to wait before retrying VM creation, doubled each retry").
+		Default("5s").
+		DurationVar(&createBackoff)
+
+	cmd.Flag("vm-secret", "A key=value secret for VMs to fetch from the bootstrap API, never stored in guestinfo; values may be file:, env: or vault: references").
+		StringMapVar(&vmSecrets)
+
+	cmd.Flag("replicate-images", "Copy source disks to target datastores that don't have them yet, implies --use-image-replicas").
+		BoolVar(&replicateImages)
+
 	addCreateVMFlags(cmd)
 
+	cmd.PreAction(requireVsphere)
 	cmd.Action(cmdRun)
 }
 
 func cmdRun(c *kingpin.ParseContext) error {
+	opts, err := creatorOptions()
+	if err != nil {
+		return err
+	}
+	opts.Attempts = createAttempts
+	opts.Backoff = createBackoff
+
+	apiToken, err := secretResolver.Resolve(buildkiteApiToken)
+	if err != nil {
+		return err
+	}
+	agentToken, err := secretResolver.Resolve(buildkiteAgentToken)
+	if err != nil {
+		return err
+	}
+	resolvedOperatorToken, err := secretResolver.Resolve(operatorToken)
+	if err != nil {
+		return err
+	}
+	resolvedSecrets := map[string]string{}
+	for k, ref := range vmSecrets {
+		if resolvedSecrets[k], err = secretResolver.Resolve(ref); err != nil {
+			return err
+		}
+	}
+
+	var profiles []buildkite.Profile
+	if profilesFile != "" {
+		if profiles, err = buildkite.LoadProfiles(profilesFile); err != nil {
+			return err
+		}
+	}
+
+	var stats *capacity.Stats
+	if capacityStatsFile != "" && dryRun {
+		return errors.New("Simulated jobs can't be recorded with --capacity-stats in a dry run")
+	}
+	if capacityStatsFile != "" {
+		if stats, err = capacity.Load(capacityStatsFile); err != nil {
+			return err
+		}
+		stats.SetConcurrency(concurrency)
+	}
+
+	var events *eventlog.Log
+	if runEventLog != "" || eventStream {
+		if events, err = eventlog.Open(runEventLog); err != nil {
+			return err
+		}
+	}
+
+	resolvedTokens := map[string]string{}
+	for pipeline, ref := range pipelineAgentTokens {
+		if resolvedTokens[pipeline], err = secretResolver.Resolve(ref); err != nil {
+			return err
+		}
+	}
+
 	vs, err := vsphere.NewSession(context.Background(), connectionParams)
 	if err != nil {
 		return err
 	}
 
-	bk, err := buildkite.NewSession(buildkiteOrg, buildkiteApiToken)
+	if replicateImages {
+		opts.Replicas = true
+		if !dryRun {
+			opts.Replicator = images.NewReplicator(vs)
+		}
+	}
+
+	bk, err := buildkite.NewSession(buildkiteOrg, apiToken)
 	if err != nil {
 		return err
 	}
@@ -66,22 +250,91 @@ func cmdRun(c *kingpin.ParseContext) error {
 	r := runner.NewRunner(vs, bk, runner.Params{
 		Concurrency:    concurrency,
 		Pipelines:      buildkitePipelines,
+		JobSource:      jobSource,
 		ApiListenOn:    apiListenOn,
 		ApiTokenSecret: apiTokenSecret,
+		OperatorToken:  resolvedOperatorToken,
+		CreatorOptions: opts,
+		Secrets:        resolvedSecrets,
+
+		AgentToken:          agentToken,
+		PipelineAgentTokens: resolvedTokens,
+		AgentPriority:       agentPriority,
+		Profiles:            profiles,
+		Scheduler: runner.SchedulerParams{
+			PipelineWeights: pipelineWeights,
+			PipelineTeams:   pipelineTeams,
+			TeamWeights:     teamWeights,
+			PipelineMaxVMs:  pipelineMaxVMs,
+		},
+		Preemption: preemption,
+		Stats:      stats,
+
+		DryRun:            dryRun,
+		DryRunJobDuration: dryRunJobDuration,
+		DiagnosticsDir:    diagnosticsDir,
+		KeepOnFailure:     keepOnFailure,
+		Annotate:          annotateBuilds,
+		Events:            events,
 	})
 
+	// pick up rotated credentials without restarting
+	if vaultProvider != nil {
+		vaultProvider.KeepRenewed()
+		secretResolver.Watch(vaultToken, secretsRefresh, vaultProvider.UpdateToken)
+	}
+	secretResolver.Watch(vspherePassRef, secretsRefresh, vs.UpdatePassword)
+	secretResolver.Watch(buildkiteApiToken, secretsRefresh, bk.UpdateAPIToken)
+	secretResolver.Watch(buildkiteAgentToken, secretsRefresh, r.UpdateAgentToken)
+	secretResolver.Watch(operatorToken, secretsRefresh, r.UpdateOperatorToken)
+	for pipeline, ref := range pipelineAgentTokens {
+		pipeline := pipeline
+		secretResolver.Watch(ref, secretsRefresh, func(token string) {
+			r.UpdatePipelineAgentToken(pipeline, token)
+		})
+	}
+	for key, ref := range vmSecrets {
+		key := key
+		secretResolver.Watch(ref, secretsRefresh, func(val string) {
+			r.UpdateSecret(key, val)
+		})
+	}
+
 	return r.Run(vsphere.VirtualMachineCreationParams{
-		BuildkiteAgentToken: buildkiteAgentToken,
-		ClusterPath:         vmClusterPath,
-		VirtualMachinePath:  vmPath,
-		DatastoreName:       vmDS,
-		MemoryMB:            vmMemoryMB,
-		Name:                "", // automatic
-		NetworkLabel:        vmNetwork,
-		NumCPUs:             vmNumCPUs,
-		NumCoresPerSocket:   vmNumCoresPerSocket,
-		SrcDiskDataStore:    vmdkDS,
-		SrcDiskPath:         "", // per-job
-		GuestInfo:           vmGuestInfo,
+		ClusterPath:        vmClusterPath,
+		VirtualMachinePath: vmPath,
+		MemoryMB:           vmMemoryMB,
+		Name:               "", // automatic
+		NetworkLabel:       vmNetwork,
+		NumCPUs:            vmNumCPUs,
+		NumCoresPerSocket:  vmNumCoresPerSocket,
+		SrcDiskDataStore:   vmdkDS,
+		SrcDiskPath:        "", // per-job
+		SerialLog:          vmSerialLog,
+		GuestInfo:          vmGuestInfo,
 	})
 }
+
+// intMapValue is a repeatable key=N flag
+type intMapValue map[string]int
+
+func (m intMapValue) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("expected KEY=N got %q", value)
+	}
+	n, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return fmt.Errorf("expected KEY=N got %q", value)
+	}
+	m[parts[0]] = n
+	return nil
+}
+
+func (m intMapValue) String() string {
+	return fmt.Sprintf("%v", map[string]int(m))
+}
+
+func (m intMapValue) IsCumulative() bool {
+	return true
+}
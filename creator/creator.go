@@ -1,16 +1,201 @@
 package creator
 
 import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/alecthomas/units"
+	"github.com/macstadium/vmkite/images"
 	"github.com/macstadium/vmkite/vsphere"
 )
 
-func CreateVM(vs *vsphere.Session, params vsphere.VirtualMachineCreationParams) (*vsphere.VirtualMachine, error) {
-	vm, err := vs.CreateVM(params)
+const (
+	defaultAttempts = 3
+	defaultBackoff  = time.Second * 5
+)
+
+// Options control how hard CreateVM tries before giving up
+type Options struct {
+	// Datastores to choose from; params.DatastoreName is used if empty
+	Datastores []string
+	// DatastoreCluster whose member datastores are also candidates
+	DatastoreCluster string
+	// MinFreeSpace a datastore must have left after taking the VM's swap
+	// file and disk to be chosen
+	MinFreeSpace units.Base2Bytes
+	// MaxVMsPerDatastore stops choosing a datastore once it has this many
+	// VMs on it, zero for no limit
+	MaxVMsPerDatastore int
+	// Attempts per placement for transient errors
+	Attempts int
+	// Backoff before the first retry, doubled for each following retry
+	Backoff time.Duration
+	// Replicas reads the source disk from a copy on the target datastore
+	// when there is one
+	Replicas bool
+	// Replicator, if set, copies the source disk to target datastores that
+	// don't have it yet, for the next VM
+	Replicator *images.Replicator
+}
+
+// CreateVM creates and powers on a VM on the datastore with the most free
+// space, retrying transient failures with backoff and moving to another host
+// or datastore when the current one can't take the VM
+func CreateVM(vs *vsphere.Session, params vsphere.VirtualMachineCreationParams, opts Options) (*vsphere.VirtualMachine, error) {
+	datastores, err := selectDatastores(vs, params, opts)
 	if err != nil {
 		return nil, err
 	}
-	if err := vm.PowerOn(); err != nil {
-		return nil, err
+
+	srcDatastore := params.SrcDiskDataStore
+	for _, ds := range datastores {
+		params.DatastoreName = ds
+		params.HostName = ""
+
+		if opts.Replicas {
+			params.SrcDiskDataStore = images.ClosestReplica(vs, srcDatastore, params.SrcDiskPath, ds)
+			if params.SrcDiskDataStore != ds && opts.Replicator != nil {
+				opts.Replicator.Ensure(srcDatastore, params.SrcDiskPath, ds)
+			}
+		}
+
+		var vm *vsphere.VirtualMachine
+		vm, err = createOnDatastore(vs, params, opts)
+		if err == nil {
+			return vm, nil
+		}
+		if !vsphere.IsDatastoreFault(err) {
+			return nil, err
+		}
+		debugf("datastore %s can't take %s: %v", ds, params.Name, err)
+	}
+
+	return nil, fmt.Errorf("No datastore could take %s: %v", params.Name, err)
+}
+
+// Placement is where CreateVM would first try to put a VM
+type Placement struct {
+	Datastore    string
+	SrcDatastore string
+	// Host is empty when vSphere picks the host
+	Host string
+}
+
+// Plan works out where CreateVM would first try to put a VM, without changing
+// anything in vSphere
+func Plan(vs *vsphere.Session, params vsphere.VirtualMachineCreationParams, opts Options) (Placement, error) {
+	datastores, err := selectDatastores(vs, params, opts)
+	if err != nil {
+		return Placement{}, err
 	}
-	return vm, nil
+
+	p := Placement{
+		Datastore:    datastores[0],
+		SrcDatastore: params.SrcDiskDataStore,
+		Host:         params.HostName,
+	}
+	if opts.Replicas {
+		p.SrcDatastore = images.ClosestReplica(vs, params.SrcDiskDataStore, params.SrcDiskPath, p.Datastore)
+	}
+	return p, nil
+}
+
+// createOnDatastore tries the hosts in the cluster until one takes the VM,
+// starting with whichever host vSphere picks. Hosts that can't create the VM
+// or can't power it on are both skipped.
+func createOnDatastore(vs *vsphere.Session, params vsphere.VirtualMachineCreationParams, opts Options) (*vsphere.VirtualMachine, error) {
+	tried := map[string]bool{}
+
+	for {
+		vm, placedOn, err := createWithRetry(vs, params, opts)
+		if err == nil || !vsphere.IsHostFault(err) {
+			return vm, err
+		}
+
+		// vSphere may have picked the host, which is the one to skip
+		if placedOn == "" {
+			placedOn = params.HostName
+		}
+		debugf("host %q can't take %s: %v", placedOn, params.Name, err)
+		tried[params.HostName] = true
+		tried[placedOn] = true
+
+		hosts, herr := vs.ClusterHosts(params.ClusterPath)
+		if herr != nil {
+			return nil, herr
+		}
+
+		params.HostName = ""
+		for _, host := range hosts {
+			if !tried[host] {
+				params.HostName = host
+				break
+			}
+		}
+		if params.HostName == "" {
+			return nil, fmt.Errorf("No host could take %s: %v", params.Name, err)
+		}
+	}
+}
+
+// createWithRetry retries transient failures, returning the host the last
+// attempt's VM was placed on if it couldn't be powered on
+func createWithRetry(vs *vsphere.Session, params vsphere.VirtualMachineCreationParams, opts Options) (*vsphere.VirtualMachine, string, error) {
+	attempts := opts.Attempts
+	if attempts <= 0 {
+		attempts = defaultAttempts
+	}
+	backoff := opts.Backoff
+	if backoff <= 0 {
+		backoff = defaultBackoff
+	}
+
+	var err error
+	var placedOn string
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if attempt > 1 {
+			debugf("retrying %s in %v (attempt %d of %d): %v",
+				params.Name, backoff, attempt, attempts, err)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		var vm *vsphere.VirtualMachine
+		vm, placedOn, err = createAndPowerOn(vs, params)
+		if err == nil {
+			return vm, "", nil
+		}
+		if !vsphere.IsTransient(err) {
+			return nil, placedOn, err
+		}
+	}
+
+	return nil, placedOn, err
+}
+
+// createAndPowerOn either returns a powered on VM, or makes sure that no VM
+// is left behind in vSphere. If the VM can't be powered on, it returns the
+// host the VM was placed on so that a host fault can move on from it.
+func createAndPowerOn(vs *vsphere.Session, params vsphere.VirtualMachineCreationParams) (*vsphere.VirtualMachine, string, error) {
+	vm, err := vs.CreateVM(params)
+	if err != nil {
+		return nil, "", err
+	}
+	if err = vm.PowerOn(); err != nil {
+		placedOn, herr := vm.HostName()
+		if herr != nil {
+			debugf("failed to find host of %s: %v", vm.Name, herr)
+		}
+		debugf("destroying %s after failed power on: %v", vm.Name, err)
+		if derr := vm.Destroy(true); derr != nil {
+			debugf("failed to destroy %s: %v", vm.Name, derr)
+		}
+		return nil, placedOn, err
+	}
+	return vm, "", nil
+}
+
+func debugf(format string, data ...interface{}) {
+	log.Printf("[creator] "+format, data...)
 }
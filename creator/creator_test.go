@@ -0,0 +1,156 @@
+package creator
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/units"
+	"github.com/macstadium/vmkite/vsphere"
+	"github.com/macstadium/vmkite/vsphere/vspheretest"
+)
+
+const testBaseDisk = "macos/macos.vmdk"
+
+func newTestSession(t *testing.T) (*vsphere.Session, *vspheretest.Simulator) {
+	sim, err := vspheretest.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sim.WriteDisk(sim.Datastores[0], testBaseDisk); err != nil {
+		sim.Close()
+		t.Fatal(err)
+	}
+	vs, err := vsphere.NewSession(context.Background(), vsphere.ConnectionParams{
+		Host:     sim.Host,
+		User:     sim.User,
+		Pass:     sim.Pass,
+		Insecure: true,
+	})
+	if err != nil {
+		sim.Close()
+		t.Fatal(err)
+	}
+	return vs, sim
+}
+
+func testParams(sim *vspheretest.Simulator, name string) vsphere.VirtualMachineCreationParams {
+	return vsphere.VirtualMachineCreationParams{
+		ClusterPath:       sim.ClusterPath,
+		DatastoreName:     sim.Datastores[0],
+		GuestID:           "darwin16_64Guest",
+		MemoryMB:          4096,
+		Name:              name,
+		NetworkLabel:      sim.Network,
+		NumCPUs:           2,
+		NumCoresPerSocket: 1,
+		SrcDiskDataStore:  sim.Datastores[0],
+		SrcDiskPath:       testBaseDisk,
+		GuestInfo:         map[string]string{},
+	}
+}
+
+func TestCreateVM(t *testing.T) {
+	vs, sim := newTestSession(t)
+	defer sim.Close()
+
+	opts := Options{
+		Datastores:         []string{sim.Datastores[1]},
+		MaxVMsPerDatastore: 1,
+		Backoff:            time.Millisecond,
+	}
+	vm, err := CreateVM(vs, testParams(sim, "vmkite-job-1"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if on, err := vm.IsPoweredOn(); err != nil || !on {
+		t.Errorf("powered on = %v, %v", on, err)
+	}
+	if ds, _, err := vm.Directory(); err != nil || ds != sim.Datastores[1] {
+		t.Errorf("VM placed on %q (%v), want %s", ds, err, sim.Datastores[1])
+	}
+
+	// the only datastore is now at its cap
+	if _, err := CreateVM(vs, testParams(sim, "vmkite-job-2"), opts); err != ErrNoDatastoreCapacity {
+		t.Errorf("err = %v, want %v", err, ErrNoDatastoreCapacity)
+	}
+	if names, err := sim.VMs(); err != nil || len(names) != 1 {
+		t.Errorf("VMs = %v, %v", names, err)
+	}
+}
+
+func TestPlan(t *testing.T) {
+	vs, sim := newTestSession(t)
+	defer sim.Close()
+
+	params := testParams(sim, "vmkite-job-1")
+	p, err := Plan(vs, params, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Datastore != sim.Datastores[0] || p.SrcDatastore != sim.Datastores[0] || p.Host != "" {
+		t.Errorf("placement = %+v", p)
+	}
+
+	params.HostName = sim.Hosts[1]
+	p, err = Plan(vs, params, Options{Datastores: sim.Datastores})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Host != sim.Hosts[1] {
+		t.Errorf("placement = %+v, want host %s", p, sim.Hosts[1])
+	}
+
+	// planning doesn't create anything
+	if names, err := sim.VMs(); err != nil || len(names) != 0 {
+		t.Errorf("VMs = %v, %v", names, err)
+	}
+
+	_, err = Plan(vs, params, Options{Datastores: sim.Datastores, MinFreeSpace: units.Exbibyte})
+	if err != ErrNoDatastoreCapacity {
+		t.Errorf("err = %v, want %v", err, ErrNoDatastoreCapacity)
+	}
+}
+
+func TestSelectDatastoresSkipsUnreadable(t *testing.T) {
+	vs, sim := newTestSession(t)
+	defer sim.Close()
+
+	opts := Options{Datastores: []string{"no-such-datastore", sim.Datastores[1]}}
+	selected, err := selectDatastores(vs, testParams(sim, "vmkite-job-1"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(selected) != 1 || selected[0] != sim.Datastores[1] {
+		t.Errorf("selected = %v, want %s", selected, sim.Datastores[1])
+	}
+
+	opts.Datastores = []string{"no-such-datastore"}
+	if _, err := selectDatastores(vs, testParams(sim, "vmkite-job-1"), opts); err != ErrNoDatastoreCapacity {
+		t.Errorf("err = %v, want %v", err, ErrNoDatastoreCapacity)
+	}
+}
+
+func TestSelectDatastoresCountsPlannedSize(t *testing.T) {
+	vs, sim := newTestSession(t)
+	defer sim.Close()
+
+	stats, err := vs.DatastoreStats([]string{sim.Datastores[1]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the datastore has room for the minimum, but not for the VM's swap file on top
+	opts := Options{
+		Datastores:   []string{sim.Datastores[1]},
+		MinFreeSpace: units.Base2Bytes(stats[0].FreeSpace) - units.MiB,
+	}
+	params := testParams(sim, "vmkite-job-1")
+	if _, err := selectDatastores(vs, params, opts); err != ErrNoDatastoreCapacity {
+		t.Errorf("err = %v, want %v", err, ErrNoDatastoreCapacity)
+	}
+
+	params.MemoryMB = 0
+	if selected, err := selectDatastores(vs, params, opts); err != nil || len(selected) != 1 {
+		t.Errorf("selected = %v, %v", selected, err)
+	}
+}
@@ -0,0 +1,95 @@
+package creator
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/alecthomas/units"
+	"github.com/macstadium/vmkite/vsphere"
+)
+
+// ErrNoDatastoreCapacity is returned when every candidate datastore is
+// inaccessible, below the free space threshold or at its VM cap
+var ErrNoDatastoreCapacity = errors.New("No datastore has capacity for another VM")
+
+// selectDatastores returns the candidate datastores that can take another VM,
+// ordered by most free space first. Candidates whose stats can't be read are
+// skipped.
+func selectDatastores(vs *vsphere.Session, params vsphere.VirtualMachineCreationParams, opts Options) ([]string, error) {
+	candidates := append([]string{}, opts.Datastores...)
+	if opts.DatastoreCluster != "" {
+		members, err := vs.DatastoreClusterMembers(opts.DatastoreCluster)
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, members...)
+	}
+	if len(candidates) == 0 {
+		candidates = []string{params.DatastoreName}
+	}
+	candidates = unique(candidates)
+
+	stats := []vsphere.DatastoreStats{}
+	for _, name := range candidates {
+		s, err := vs.DatastoreStats([]string{name})
+		if err != nil {
+			debugf("skipping datastore %s, can't read its stats: %v", name, err)
+			continue
+		}
+		stats = append(stats, s...)
+	}
+
+	sort.SliceStable(stats, func(i, j int) bool {
+		return stats[i].FreeSpace > stats[j].FreeSpace
+	})
+
+	planned := plannedSize(vs, params)
+	selected := []string{}
+	for _, ds := range stats {
+		debugf("datastore %s has %s free of %s, %d VMs", ds.Name,
+			units.Base2Bytes(ds.FreeSpace), units.Base2Bytes(ds.Capacity), ds.VMCount)
+
+		switch {
+		case !ds.Accessible:
+			debugf("skipping datastore %s, not accessible", ds.Name)
+		case ds.FreeSpace-planned < int64(opts.MinFreeSpace):
+			debugf("skipping datastore %s, below minimum free space of %s with %s for %s",
+				ds.Name, opts.MinFreeSpace, units.Base2Bytes(planned), params.Name)
+		case opts.MaxVMsPerDatastore > 0 && ds.VMCount >= opts.MaxVMsPerDatastore:
+			debugf("skipping datastore %s, at limit of %d VMs", ds.Name, opts.MaxVMsPerDatastore)
+		default:
+			selected = append(selected, ds.Name)
+		}
+	}
+
+	if len(selected) == 0 {
+		return nil, ErrNoDatastoreCapacity
+	}
+	return selected, nil
+}
+
+// plannedSize is how much space a VM can take on its datastore: its swap file
+// and the redo log of its disk, which can grow to the disk's capacity
+func plannedSize(vs *vsphere.Session, params vsphere.VirtualMachineCreationParams) int64 {
+	size := params.MemoryMB * int64(units.MiB)
+	capacity, err := vs.DiskCapacity(params.SrcDiskDataStore, params.SrcDiskPath)
+	if err != nil {
+		debugf("Error finding the capacity of [%s] %s: %v", params.SrcDiskDataStore, params.SrcDiskPath, err)
+		return size
+	}
+	return size + capacity
+}
+
+// unique drops repeated datastores, e.g. ones both listed and in the
+// datastore cluster, keeping the first of each
+func unique(names []string) []string {
+	seen := map[string]bool{}
+	result := []string{}
+	for _, name := range names {
+		if !seen[name] {
+			seen[name] = true
+			result = append(result, name)
+		}
+	}
+	return result
+}
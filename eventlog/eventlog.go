@@ -0,0 +1,255 @@
+// Package eventlog keeps an append-only record of what vmkite did with each
+// job, as JSON lines in a file, and streams new events to followers.
+package eventlog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Event types, in the order they usually happen to a job
+const (
+	// Seen is a job found in Buildkite
+	Seen = "seen"
+	// Queued is a job waiting for a worker
+	Queued = "queued"
+	// Assigned is a job taken by a worker
+	Assigned = "assigned"
+	// VMCreated is a job's VM created, Since is how long creation took
+	VMCreated = "vm-created"
+	// PoweredOn is a job's VM seen powered on, which vmkite does as it creates it
+	PoweredOn = "powered-on"
+	// Hook is a hook reported by the VM's agent
+	Hook = "hook"
+	// PoweredOff is a job's VM having powered itself off
+	PoweredOff = "powered-off"
+	// Preempted is a job stopped for a higher priority one
+	Preempted = "preempted"
+	// TimedOut is a job whose VM didn't power off in time
+	TimedOut = "timed-out"
+	// Kept is a failed job's VM kept for debugging
+	Kept = "kept"
+	// Destroyed is a job's VM destroyed
+	Destroyed = "destroyed"
+	// Failed is a job vmkite couldn't run, with the error
+	Failed = "failed"
+	// Finished is a job vmkite is done with
+	Finished = "finished"
+)
+
+// maxOpenJobs is how many jobs without a terminal event Record tracks the
+// durations of, beyond which the least recently active are forgotten
+const maxOpenJobs = 10000
+
+// subscriberBuffer is how many events a slow follower can fall behind by
+// before more are dropped
+const subscriberBuffer = 64
+
+// Event is one thing that happened to a job
+type Event struct {
+	Time  time.Time `json:"time"`
+	Type  string    `json:"type"`
+	JobID string    `json:"job_id"`
+	// Job is the job's pipeline, build number and ID
+	Job  string `json:"job,omitempty"`
+	VM   string `json:"vm,omitempty"`
+	Host string `json:"host,omitempty"`
+	Hook string `json:"hook,omitempty"`
+	// ExitStatus is the job's exit status, if a hook reported it
+	ExitStatus string `json:"exit_status,omitempty"`
+	Error      string `json:"error,omitempty"`
+	// Since is the time since the job's previous event, and Elapsed the
+	// time since it was seen, both filled in by Record
+	Since   time.Duration `json:"since,omitempty"`
+	Elapsed time.Duration `json:"elapsed,omitempty"`
+}
+
+// Terminal returns whether nothing more happens to the job after the event
+func (e Event) Terminal() bool {
+	return e.Type == Finished || e.Type == Failed
+}
+
+// Log appends events to a file and passes them on to subscribers
+type Log struct {
+	sync.Mutex
+
+	file        *os.File
+	seen        map[string]time.Time
+	last        map[string]time.Time
+	subscribers map[chan Event]struct{}
+}
+
+// Open appends to the log in file, creating it if needed. If file is empty
+// events are only passed on to subscribers.
+func Open(file string) (*Log, error) {
+	l := &Log{
+		seen:        map[string]time.Time{},
+		last:        map[string]time.Time{},
+		subscribers: map[chan Event]struct{}{},
+	}
+	if file == "" {
+		return l, nil
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	l.file = f
+	return l, nil
+}
+
+// Record timestamps an event, works out its durations, appends it to the file
+// and passes it on to subscribers
+func (l *Log) Record(e Event) {
+	l.Lock()
+	defer l.Unlock()
+
+	// durations are tracked from when a job is seen until its terminal
+	// event, so events after that, like a kept VM being destroyed, don't
+	// start tracking it again
+	e.Time = time.Now()
+	if seen, ok := l.seen[e.JobID]; ok {
+		e.Since = e.Time.Sub(l.last[e.JobID])
+		e.Elapsed = e.Time.Sub(seen)
+		l.last[e.JobID] = e.Time
+	} else if e.Type == Seen {
+		l.seen[e.JobID] = e.Time
+		l.last[e.JobID] = e.Time
+	}
+	if e.Terminal() {
+		l.forget(e.JobID)
+	} else if len(l.seen) > maxOpenJobs {
+		l.forgetOldest()
+	}
+
+	if l.file != nil {
+		data, err := json.Marshal(e)
+		if err == nil {
+			_, err = l.file.Write(append(data, '\n'))
+		}
+		if err != nil {
+			debugf("Error writing event: %v", err)
+		}
+	}
+
+	for ch := range l.subscribers {
+		select {
+		case ch <- e:
+		default:
+			debugf("Dropped %s event for job %s, follower too slow", e.Type, e.JobID)
+		}
+	}
+}
+
+func (l *Log) forget(jobID string) {
+	delete(l.seen, jobID)
+	delete(l.last, jobID)
+}
+
+// forgetOldest forgets the job with the oldest last event, which most likely
+// ended without a terminal event
+func (l *Log) forgetOldest() {
+	oldest := ""
+	for jobID, last := range l.last {
+		if oldest == "" || last.Before(l.last[oldest]) {
+			oldest = jobID
+		}
+	}
+	debugf("Tracking more than %d jobs, forgetting %s", maxOpenJobs, oldest)
+	l.forget(oldest)
+}
+
+// Subscribe returns a channel of events recorded from now on, and a function
+// to stop receiving them
+func (l *Log) Subscribe() (chan Event, func()) {
+	ch := make(chan Event, subscriberBuffer)
+
+	l.Lock()
+	l.subscribers[ch] = struct{}{}
+	l.Unlock()
+
+	return ch, func() {
+		l.Lock()
+		defer l.Unlock()
+		if _, ok := l.subscribers[ch]; ok {
+			delete(l.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// ServeHTTP streams events as JSON lines as they are recorded, only those for
+// the ?job= job ID if given
+func (l *Log) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	jobID := req.URL.Query().Get("job")
+
+	events, unsubscribe := l.Subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case e := <-events:
+			if jobID != "" && e.JobID != jobID {
+				continue
+			}
+			if err := enc.Encode(e); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+// Read calls fn with each event in r until it runs out. With follow it keeps
+// waiting for more events to be appended instead, like tail -f.
+func Read(r io.Reader, follow bool, fn func(Event) error) error {
+	br := bufio.NewReader(r)
+	var line []byte
+	for {
+		chunk, err := br.ReadBytes('\n')
+		line = append(line, chunk...)
+		if err == io.EOF && follow {
+			time.Sleep(time.Millisecond * 500)
+			continue
+		}
+		if len(bytes.TrimSpace(line)) > 0 && (err == nil || err == io.EOF) {
+			var e Event
+			if jerr := json.Unmarshal(line, &e); jerr != nil {
+				return jerr
+			}
+			if ferr := fn(e); ferr != nil {
+				return ferr
+			}
+		}
+		line = line[:0]
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func debugf(format string, data ...interface{}) {
+	log.Printf("[eventlog] "+format, data...)
+}
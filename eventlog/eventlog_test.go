@@ -0,0 +1,52 @@
+package eventlog
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRecordForgetsFinishedJobs(t *testing.T) {
+	l, err := Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, stop := l.Subscribe()
+	defer stop()
+
+	for _, typ := range []string{Seen, Queued, Failed} {
+		l.Record(Event{Type: typ, JobID: "job-1"})
+	}
+	if len(l.seen) != 0 || len(l.last) != 0 {
+		t.Errorf("still tracking %d jobs after a terminal event", len(l.seen))
+	}
+	if e := <-events; e.Type != Seen || e.Elapsed != 0 {
+		t.Errorf("first event = %+v", e)
+	}
+}
+
+func TestRecordDoesNotTrackAfterTerminalEvent(t *testing.T) {
+	l, err := Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a kept VM is destroyed after its job failed
+	for _, typ := range []string{Seen, Kept, Failed, Destroyed} {
+		l.Record(Event{Type: typ, JobID: "job-1"})
+	}
+	if len(l.seen) != 0 || len(l.last) != 0 {
+		t.Errorf("tracking %d jobs after an event following a terminal one", len(l.seen))
+	}
+}
+
+func TestRecordCapsOpenJobs(t *testing.T) {
+	l, err := Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i <= maxOpenJobs; i++ {
+		l.Record(Event{Type: Seen, JobID: fmt.Sprintf("job-%d", i)})
+	}
+	if len(l.seen) != maxOpenJobs || len(l.last) != maxOpenJobs {
+		t.Errorf("tracking %d seen and %d last, want %d", len(l.seen), len(l.last), maxOpenJobs)
+	}
+}
@@ -0,0 +1,139 @@
+package images
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/macstadium/vmkite/vsphere"
+)
+
+// BuildParams describe how to build a new image version from a base image
+type BuildParams struct {
+	// VM settings for the build VM; disk and name are set by Build
+	VM vsphere.VirtualMachineCreationParams
+
+	BaseDatastore string
+	BasePath      string
+
+	Datastore string
+	Name      string
+	Version   string
+
+	Script        string
+	ScriptTimeout time.Duration
+	GuestAuth     vsphere.GuestAuth
+	ToolsTimeout  time.Duration
+	Timeout       time.Duration
+}
+
+// VersionPath returns where a version of a named image is stored
+func VersionPath(name, version string) string {
+	return path.Join(name, fmt.Sprintf("%s-%s.vmdk", name, version))
+}
+
+// Build copies the base image to a new version, boots a VM from it with a
+// persistent disk, runs a provisioning script in the guest and shuts it down,
+// leaving the provisioned disk behind as the new image version
+func Build(vs *vsphere.Session, p BuildParams) (err error) {
+	script, err := os.Open(p.Script)
+	if err != nil {
+		return err
+	}
+	defer script.Close()
+	info, err := script.Stat()
+	if err != nil {
+		return err
+	}
+
+	imagePath := VersionPath(p.Name, p.Version)
+	exists, err := vs.FileExists(p.Datastore, imagePath)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("[%s] %s already exists", p.Datastore, imagePath)
+	}
+
+	debugf("copying [%s] %s to [%s] %s", p.BaseDatastore, p.BasePath, p.Datastore, imagePath)
+	if err = vs.CopyDisk(p.BaseDatastore, p.BasePath, p.Datastore, imagePath); err != nil {
+		return err
+	}
+
+	vmParams := p.VM
+	vmParams.Name = fmt.Sprintf("vmkite-build-%s-%s", p.Name, p.Version)
+	vmParams.SrcDiskDataStore = p.Datastore
+	vmParams.SrcDiskPath = imagePath
+	vmParams.PersistentDisk = true
+
+	vm, err := vs.CreateVM(vmParams)
+	if err != nil {
+		if derr := vs.DeleteDisk(p.Datastore, imagePath); derr != nil {
+			debugf("Error deleting [%s] %s: %v", p.Datastore, imagePath, derr)
+		}
+		return err
+	}
+
+	// the disk is only kept if the build succeeds, otherwise it goes with the VM
+	keepDisk := false
+	defer func() {
+		if keepDisk {
+			if derr := vm.DetachDisks(); derr != nil {
+				err = combineErrors(err, fmt.Errorf("Failed to detach disk from %s: %v", vm.Name, derr))
+			}
+		}
+		if derr := vm.Destroy(true); derr != nil {
+			err = combineErrors(err, fmt.Errorf("Failed to destroy %s: %v", vm.Name, derr))
+		}
+	}()
+
+	if err = vm.PowerOn(); err != nil {
+		return err
+	}
+	if err = vm.WaitForTools(p.ToolsTimeout); err != nil {
+		return err
+	}
+
+	guestScript := "/tmp/vmkite-provision"
+	if err = vm.CopyToGuest(p.GuestAuth, script, info.Size(), guestScript, 0755); err != nil {
+		return err
+	}
+
+	pid, err := vm.StartProgram(p.GuestAuth, guestScript, "", []string{
+		"VMKITE_IMAGE_NAME=" + p.Name,
+		"VMKITE_IMAGE_VERSION=" + p.Version,
+	})
+	if err != nil {
+		return err
+	}
+
+	debugf("waiting for provisioning script (pid %d) in %s", pid, vm.Name)
+	exitCode, err := vm.WaitForProgram(p.GuestAuth, pid, p.ScriptTimeout)
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("Provisioning script exited with %d", exitCode)
+	}
+
+	if err = vm.ShutdownGuest(p.Timeout); err != nil {
+		return err
+	}
+	keepDisk = true
+
+	return WriteSidecar(vs, p.Datastore, imagePath, Sidecar{
+		Name:      p.Name,
+		Version:   p.Version,
+		BuiltFrom: fmt.Sprintf("[%s] %s", p.BaseDatastore, p.BasePath),
+		BuiltAt:   time.Now(),
+	})
+}
+
+// combineErrors joins a cleanup error onto the error being returned
+func combineErrors(err, cleanupErr error) error {
+	if err == nil {
+		return cleanupErr
+	}
+	return fmt.Errorf("%v; %v", err, cleanupErr)
+}
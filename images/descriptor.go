@@ -0,0 +1,112 @@
+package images
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Descriptor is the parsed text descriptor of a VMDK
+type Descriptor struct {
+	CID                string
+	ParentCID          string
+	CreateType         string
+	ParentFileNameHint string
+	Extents            []Extent
+}
+
+// Extent is a file holding part of a VMDK's data
+type Extent struct {
+	Access  string
+	Sectors int64
+	Type    string
+	File    string
+}
+
+// IsChild returns whether the disk is a delta on top of a parent disk
+func (d Descriptor) IsChild() bool {
+	return d.ParentCID != "" && d.ParentCID != "ffffffff"
+}
+
+// Size returns the size of the disk in bytes
+func (d Descriptor) Size() int64 {
+	var sectors int64
+	for _, e := range d.Extents {
+		sectors += e.Sectors
+	}
+	return sectors * 512
+}
+
+// ParseDescriptor parses a VMDK text descriptor
+func ParseDescriptor(data []byte) (*Descriptor, error) {
+	d := &Descriptor{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(line, "RW ") ||
+			strings.HasPrefix(line, "RDONLY ") ||
+			strings.HasPrefix(line, "NOACCESS "):
+			extent, err := parseExtent(line)
+			if err != nil {
+				return nil, err
+			}
+			d.Extents = append(d.Extents, extent)
+
+		case strings.Contains(line, "="):
+			parts := strings.SplitN(line, "=", 2)
+			key := strings.TrimSpace(parts[0])
+			val := strings.Trim(strings.TrimSpace(parts[1]), `"`)
+			switch key {
+			case "CID":
+				d.CID = val
+			case "parentCID":
+				d.ParentCID = val
+			case "createType":
+				d.CreateType = val
+			case "parentFileNameHint":
+				d.ParentFileNameHint = val
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if d.CID == "" || d.CreateType == "" {
+		return nil, fmt.Errorf("Not a VMDK descriptor, missing CID or createType")
+	}
+	if len(d.Extents) == 0 {
+		return nil, fmt.Errorf("VMDK descriptor has no extents")
+	}
+	return d, nil
+}
+
+// parseExtent parses a line like `RW 83886080 VMFS "disk-flat.vmdk" 0`
+func parseExtent(line string) (Extent, error) {
+	quoted := strings.SplitN(line, `"`, 3)
+	if len(quoted) < 3 {
+		return Extent{}, fmt.Errorf("Invalid extent %q", line)
+	}
+	fields := strings.Fields(quoted[0])
+	if len(fields) != 3 {
+		return Extent{}, fmt.Errorf("Invalid extent %q", line)
+	}
+	sectors, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return Extent{}, fmt.Errorf("Invalid extent size in %q: %v", line, err)
+	}
+	return Extent{
+		Access:  fields[0],
+		Sectors: sectors,
+		Type:    fields[2],
+		File:    quoted[1],
+	}, nil
+}
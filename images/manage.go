@@ -0,0 +1,273 @@
+package images
+
+import (
+	"archive/tar"
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/macstadium/vmkite/vsphere"
+)
+
+// Image is a base image found on a datastore
+type Image struct {
+	vsphere.DiskFile
+
+	Descriptor      *Descriptor
+	DescriptorError error
+	UsedBy          []vsphere.VirtualMachineDisks
+}
+
+// DatastorePath returns the image's path in "[datastore] path" form
+func (i Image) DatastorePath() string {
+	return fmt.Sprintf("[%s] %s", i.Datastore, i.Path)
+}
+
+// List finds the images under a directory on a datastore, along with the VMs
+// and templates in vmFolder that have them attached
+func List(vs *vsphere.Session, datastore, dir, vmFolder string) ([]Image, error) {
+	disks, err := vs.ListDisks(datastore, dir)
+	if err != nil {
+		return nil, err
+	}
+	vms, err := vs.ListVirtualMachineDisks(vmFolder)
+	if err != nil {
+		return nil, err
+	}
+
+	imgs := []Image{}
+	for _, disk := range disks {
+		img := Image{DiskFile: disk}
+
+		data, err := vs.ReadFile(datastore, disk.Path)
+		if err == nil {
+			img.Descriptor, err = ParseDescriptor(data)
+		}
+		img.DescriptorError = err
+		img.UsedBy = usedBy(vms, img.DatastorePath())
+
+		imgs = append(imgs, img)
+	}
+	return imgs, nil
+}
+
+func usedBy(vms []vsphere.VirtualMachineDisks, datastorePath string) []vsphere.VirtualMachineDisks {
+	users := []vsphere.VirtualMachineDisks{}
+	for _, vm := range vms {
+		for _, disk := range vm.Disks {
+			if disk == datastorePath {
+				users = append(users, vm)
+				break
+			}
+		}
+	}
+	return users
+}
+
+// Upload copies a local VMDK, or the first VMDK in a local OVA, to a
+// datastore. The disk is uploaded next to its destination and then converted
+// into a datastore-native disk with the VirtualDiskManager. streamOptimized
+// disks, which OVAs usually hold, can't be converted that way and are
+// rejected before anything is uploaded.
+func Upload(vs *vsphere.Session, localPath, datastore, dstPath string) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	var size int64
+
+	switch strings.ToLower(filepath.Ext(localPath)) {
+	case ".vmdk":
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		size = info.Size()
+	case ".ova":
+		tr := tar.NewReader(f)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return fmt.Errorf("No VMDK found in %s", localPath)
+			}
+			if err != nil {
+				return err
+			}
+			if strings.HasSuffix(strings.ToLower(hdr.Name), ".vmdk") {
+				debugf("uploading %s from %s", hdr.Name, localPath)
+				r, size = tr, hdr.Size
+				break
+			}
+		}
+	default:
+		return fmt.Errorf("Don't know how to upload %s, expected a .vmdk or .ova", localPath)
+	}
+
+	br := bufio.NewReader(r)
+	header, err := br.Peek(sparseHeaderSize)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if isCompressedSparse(header) {
+		return fmt.Errorf("%s is a streamOptimized disk, which vSphere can't import as a plain file. "+
+			"Convert it first, e.g. with `vmware-vdiskmanager -r in.vmdk -t 0 out.vmdk`", localPath)
+	}
+	r = br
+
+	exists, err := vs.FileExists(datastore, dstPath)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("[%s] %s already exists", datastore, dstPath)
+	}
+
+	tmpPath := strings.TrimSuffix(dstPath, ".vmdk") + "-upload.vmdk"
+	if err := vs.UploadFile(datastore, tmpPath, r, size); err != nil {
+		return err
+	}
+	defer func() {
+		if err := vs.DeleteFile(datastore, tmpPath); err != nil {
+			debugf("Error deleting [%s] %s: %v", datastore, tmpPath, err)
+		}
+	}()
+
+	return vs.CopyDisk(datastore, tmpPath, datastore, dstPath)
+}
+
+// sparseHeaderSize is how much of a hosted sparse VMDK is needed to read
+// its flags
+const sparseHeaderSize = 12
+
+// isCompressedSparse returns whether header starts a hosted sparse extent
+// with compressed grains, which is what streamOptimized disks are
+func isCompressedSparse(header []byte) bool {
+	const (
+		sparseMagic      = 0x564d444b // "KDMV"
+		compressedGrains = 1 << 16
+	)
+	if len(header) < sparseHeaderSize {
+		return false
+	}
+	if binary.LittleEndian.Uint32(header[0:4]) != sparseMagic {
+		return false
+	}
+	return binary.LittleEndian.Uint32(header[8:12])&compressedGrains != 0
+}
+
+// Verify parses an image's descriptor, checks the datastore sees each of its
+// extents as part of the disk and walks its parent chain checking each link,
+// returning the chain from the image down to its base disk
+func Verify(vs *vsphere.Session, datastore, vmdkPath string) ([]*Descriptor, error) {
+	chain := []*Descriptor{}
+	seen := map[string]bool{}
+
+	for {
+		if seen[vmdkPath] {
+			return nil, fmt.Errorf("Disk chain loops back to %s", vmdkPath)
+		}
+		seen[vmdkPath] = true
+
+		data, err := vs.ReadFile(datastore, vmdkPath)
+		if err != nil {
+			return nil, err
+		}
+		desc, err := ParseDescriptor(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", vmdkPath, err)
+		}
+
+		found, err := vs.DiskExtents(datastore, vmdkPath)
+		if err != nil {
+			return nil, err
+		}
+		for _, extent := range desc.Extents {
+			extentPath := path.Join(path.Dir(vmdkPath), extent.File)
+			if !contains(found, extentPath) {
+				return nil, fmt.Errorf("%s: extent %s is missing", vmdkPath, extentPath)
+			}
+		}
+
+		if len(chain) > 0 {
+			child := chain[len(chain)-1]
+			if child.ParentCID != desc.CID {
+				return nil, fmt.Errorf("%s: CID %s doesn't match child's parentCID %s",
+					vmdkPath, desc.CID, child.ParentCID)
+			}
+		}
+		chain = append(chain, desc)
+
+		if !desc.IsChild() {
+			return chain, nil
+		}
+		if desc.ParentFileNameHint == "" {
+			return nil, fmt.Errorf("%s: has a parent but no parentFileNameHint", vmdkPath)
+		}
+		if path.IsAbs(desc.ParentFileNameHint) {
+			return nil, fmt.Errorf("%s: parent %s is outside the datastore", vmdkPath, desc.ParentFileNameHint)
+		}
+		vmdkPath = path.Join(path.Dir(vmdkPath), desc.ParentFileNameHint)
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Retire deletes an image and its sidecar, refusing if any VM in vmFolder
+// has it attached or, for a version of a named image, if an alias points at
+// it now or could be rolled back to it
+func Retire(vs *vsphere.Session, datastore, vmdkPath, vmFolder string) error {
+	vms, err := vs.ListVirtualMachineDisks(vmFolder)
+	if err != nil {
+		return err
+	}
+	users := usedBy(vms, fmt.Sprintf("[%s] %s", datastore, vmdkPath))
+	if len(users) > 0 {
+		names := []string{}
+		for _, vm := range users {
+			names = append(names, vm.Name)
+		}
+		return fmt.Errorf("[%s] %s is attached to %s", datastore, vmdkPath, strings.Join(names, ", "))
+	}
+
+	name, version, ok := parseVersionPath(vmdkPath)
+	if !ok {
+		return deleteImage(vs, datastore, vmdkPath)
+	}
+
+	// hold the registry's lock so the version can't be promoted meanwhile
+	return updateRegistry(vs, datastore, name, func(reg *Registry) (bool, error) {
+		if aliases := reg.references(version); len(aliases) > 0 {
+			return false, fmt.Errorf("%s:%s is referenced by %s:%s", name, version,
+				name, strings.Join(aliases, ", "+name+":"))
+		}
+		return false, deleteImage(vs, datastore, vmdkPath)
+	})
+}
+
+// deleteImage deletes an image and its sidecar, if it has one
+func deleteImage(vs *vsphere.Session, datastore, vmdkPath string) error {
+	if err := vs.DeleteDisk(datastore, vmdkPath); err != nil {
+		return err
+	}
+
+	exists, err := vs.FileExists(datastore, SidecarPath(vmdkPath))
+	if err != nil || !exists {
+		return err
+	}
+	return vs.DeleteFile(datastore, SidecarPath(vmdkPath))
+}
@@ -0,0 +1,96 @@
+package images
+
+import (
+	"context"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/macstadium/vmkite/vsphere"
+	"github.com/macstadium/vmkite/vsphere/vspheretest"
+)
+
+// newTestSession starts a simulator and logs in to it
+func newTestSession(t *testing.T) (*vsphere.Session, *vspheretest.Simulator) {
+	sim, err := vspheretest.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vs, err := vsphere.NewSession(context.Background(), vsphere.ConnectionParams{
+		Host:     sim.Host,
+		User:     sim.User,
+		Pass:     sim.Pass,
+		Insecure: true,
+	})
+	if err != nil {
+		sim.Close()
+		t.Fatal(err)
+	}
+	return vs, sim
+}
+
+func sparseHeader(flags uint32) []byte {
+	header := make([]byte, sparseHeaderSize)
+	copy(header, "KDMV")
+	binary.LittleEndian.PutUint32(header[4:8], 3)
+	binary.LittleEndian.PutUint32(header[8:12], flags)
+	return header
+}
+
+func TestIsCompressedSparse(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []byte
+		want   bool
+	}{
+		{"streamOptimized", sparseHeader(1<<16 | 1<<17 | 1), true},
+		{"monolithicSparse", sparseHeader(1 | 2), false},
+		{"descriptor", []byte("# Disk DescriptorFile\n"), false},
+		{"short", []byte("KDMV"), false},
+		{"empty", nil, false},
+	}
+	for _, test := range tests {
+		if got := isCompressedSparse(test.header); got != test.want {
+			t.Errorf("%s: isCompressedSparse = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestRetire(t *testing.T) {
+	vs, sim := newTestSession(t)
+	defer sim.Close()
+	ds := sim.Datastores[0]
+
+	for _, version := range []string{"1", "2", "3"} {
+		if err := sim.WriteDisk(ds, VersionPath("macos", version)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := Promote(vs, ds, "macos", "1", "latest"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Promote(vs, ds, "macos", "2", "latest"); err != nil {
+		t.Fatal(err)
+	}
+
+	// latest points at 2 and can be rolled back to 1
+	for _, version := range []string{"1", "2"} {
+		err := Retire(vs, ds, VersionPath("macos", version), "/DC0/vm")
+		if err == nil || !strings.Contains(err.Error(), "referenced by macos:latest") {
+			t.Errorf("retiring %s: %v, want it refused", version, err)
+		}
+		if exists, _ := vs.FileExists(ds, VersionPath("macos", version)); !exists {
+			t.Errorf("%s was deleted", version)
+		}
+	}
+
+	if err := Retire(vs, ds, VersionPath("macos", "3"), "/DC0/vm"); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := vs.FileExists(ds, VersionPath("macos", "3")); exists {
+		t.Error("3 wasn't deleted")
+	}
+	if exists, _ := vs.FileExists(ds, registryLockPath("macos")); exists {
+		t.Error("registry left locked")
+	}
+}
@@ -0,0 +1,257 @@
+package images
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/macstadium/vmkite/vsphere"
+)
+
+const defaultAlias = "latest"
+
+// Registry maps aliases like "latest" to versions of a named image, it is
+// stored as registry.json in the image's directory on the datastore
+type Registry struct {
+	Aliases map[string]string `json:"aliases"`
+	// History of the versions each alias pointed to before, most recent last
+	History map[string][]string `json:"history"`
+}
+
+func registryPath(name string) string {
+	return path.Join(name, "registry.json")
+}
+
+// IsReference returns whether s is an image reference like "name:version"
+// or "name:alias" rather than a path to a VMDK
+func IsReference(s string) bool {
+	return strings.Contains(s, ":") && !strings.HasSuffix(s, ".vmdk")
+}
+
+// ParseReference splits an image reference into its name and tag, the tag
+// defaults to "latest"
+func ParseReference(ref string) (string, string) {
+	parts := strings.SplitN(ref, ":", 2)
+	if len(parts) == 1 || parts[1] == "" {
+		return parts[0], defaultAlias
+	}
+	return parts[0], parts[1]
+}
+
+// ReadRegistry reads the registry for a named image, returning an empty
+// registry if it has none yet
+func ReadRegistry(vs *vsphere.Session, datastore, name string) (*Registry, error) {
+	reg := &Registry{
+		Aliases: map[string]string{},
+		History: map[string][]string{},
+	}
+	exists, err := vs.FileExists(datastore, registryPath(name))
+	if err != nil || !exists {
+		return reg, err
+	}
+	data, err := vs.ReadFile(datastore, registryPath(name))
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, reg); err != nil {
+		return nil, fmt.Errorf("Invalid registry for %s: %v", name, err)
+	}
+	return reg, nil
+}
+
+// writeRegistry replaces the registry by writing it alongside and moving it
+// into place, so readers never see a partial file
+func writeRegistry(vs *vsphere.Session, datastore, name string, reg *Registry) error {
+	data, err := json.MarshalIndent(reg, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := registryPath(name) + ".tmp"
+	if err := vs.WriteFile(datastore, tmp, data); err != nil {
+		return err
+	}
+	return vs.MoveFile(datastore, tmp, registryPath(name))
+}
+
+// Resolve turns an image reference into the path of the VMDK it refers to,
+// paths that aren't references are returned unchanged
+func Resolve(vs *vsphere.Session, datastore, ref string) (string, error) {
+	if !IsReference(ref) {
+		return ref, nil
+	}
+
+	name, tag := ParseReference(ref)
+	reg, err := ReadRegistry(vs, datastore, name)
+	if err != nil {
+		return "", err
+	}
+	version := tag
+	if aliased, ok := reg.Aliases[tag]; ok {
+		version = aliased
+	}
+
+	vmdkPath := VersionPath(name, version)
+	exists, err := vs.FileExists(datastore, vmdkPath)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return "", fmt.Errorf("Image %s resolves to [%s] %s, which doesn't exist", ref, datastore, vmdkPath)
+	}
+	debugf("resolved %s to %s", ref, vmdkPath)
+	return vmdkPath, nil
+}
+
+// Promote points an alias of a named image at a version
+func Promote(vs *vsphere.Session, datastore, name, version, alias string) error {
+	exists, err := vs.FileExists(datastore, VersionPath(name, version))
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("%s:%s doesn't exist", name, version)
+	}
+
+	return updateRegistry(vs, datastore, name, func(reg *Registry) (bool, error) {
+		return reg.promote(version, alias), nil
+	})
+}
+
+// Rollback points an alias of a named image back at the version it pointed
+// to before the last promotion, returning that version
+func Rollback(vs *vsphere.Session, datastore, name, alias string) (string, error) {
+	var previous string
+	err := updateRegistry(vs, datastore, name, func(reg *Registry) (bool, error) {
+		var ok bool
+		if previous, ok = reg.rollback(alias); !ok {
+			return false, fmt.Errorf("%s:%s has no previous version to roll back to", name, alias)
+		}
+		return true, nil
+	})
+	return previous, err
+}
+
+// promote points alias at version, returning whether anything changed
+func (reg *Registry) promote(version, alias string) bool {
+	if current, ok := reg.Aliases[alias]; ok {
+		if current == version {
+			return false
+		}
+		reg.History[alias] = append(reg.History[alias], current)
+	}
+	reg.Aliases[alias] = version
+	return true
+}
+
+// rollback points alias at the version it pointed to before, returning it,
+// or false if there is no history to go back to
+func (reg *Registry) rollback(alias string) (string, bool) {
+	history := reg.History[alias]
+	if len(history) == 0 {
+		return "", false
+	}
+	previous := history[len(history)-1]
+	reg.History[alias] = history[:len(history)-1]
+	reg.Aliases[alias] = previous
+	return previous, true
+}
+
+// references returns the aliases pointing at version now or in their
+// history, which a rollback could point back at
+func (reg *Registry) references(version string) []string {
+	aliases := []string{}
+	for alias, current := range reg.Aliases {
+		if current == version || contains(reg.History[alias], version) {
+			aliases = append(aliases, alias)
+		}
+	}
+	for alias, history := range reg.History {
+		if _, ok := reg.Aliases[alias]; !ok && contains(history, version) {
+			aliases = append(aliases, alias)
+		}
+	}
+	sort.Strings(aliases)
+	return aliases
+}
+
+// parseVersionPath is the reverse of VersionPath, returning false for paths
+// that aren't a version of a named image
+func parseVersionPath(vmdkPath string) (string, string, bool) {
+	name := path.Dir(vmdkPath)
+	base := strings.TrimSuffix(path.Base(vmdkPath), ".vmdk")
+	if name == "." || !strings.HasPrefix(base, name+"-") || base == name+"-" {
+		return "", "", false
+	}
+	return name, strings.TrimPrefix(base, name+"-"), true
+}
+
+const (
+	registryLockTimeout = time.Minute
+	registryLockRetry   = 2 * time.Second
+)
+
+func registryLockPath(name string) string {
+	return path.Join(name, "registry.lock")
+}
+
+// updateRegistry reads, changes and writes back an image's registry while
+// holding its lock, so concurrent promotions and rollbacks don't overwrite
+// each other. fn returns whether it changed the registry.
+func updateRegistry(vs *vsphere.Session, datastore, name string, fn func(*Registry) (bool, error)) error {
+	if err := lockRegistry(vs, datastore, name); err != nil {
+		return err
+	}
+	defer func() {
+		if err := vs.DeleteFile(datastore, registryLockPath(name)); err != nil {
+			debugf("Error unlocking registry for %s: %v", name, err)
+		}
+	}()
+
+	reg, err := ReadRegistry(vs, datastore, name)
+	if err != nil {
+		return err
+	}
+	changed, err := fn(reg)
+	if err != nil || !changed {
+		return err
+	}
+	return writeRegistry(vs, datastore, name, reg)
+}
+
+// lockRegistry creates the registry's lock directory, which only one
+// caller can do at a time, waiting up to registryLockTimeout for it
+func lockRegistry(vs *vsphere.Session, datastore, name string) error {
+	deadline := time.Now().Add(registryLockTimeout)
+	for {
+		err := vs.MakeDirectory(datastore, registryLockPath(name))
+		if err == nil || !vsphere.IsFileAlreadyExists(err) {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Timed out waiting for the lock on %s's registry, "+
+				"remove [%s] %s if nothing else is changing it", name, datastore, registryLockPath(name))
+		}
+		debugf("registry for %s is locked, waiting", name)
+		time.Sleep(registryLockRetry)
+	}
+}
+
+// Versions lists the versions of a named image found on a datastore
+func Versions(vs *vsphere.Session, datastore, name string) ([]string, error) {
+	disks, err := vs.ListDisks(datastore, name)
+	if err != nil {
+		return nil, err
+	}
+	prefix := name + "-"
+	versions := []string{}
+	for _, disk := range disks {
+		base := strings.TrimSuffix(path.Base(disk.Path), ".vmdk")
+		if path.Dir(disk.Path) == name && strings.HasPrefix(base, prefix) {
+			versions = append(versions, strings.TrimPrefix(base, prefix))
+		}
+	}
+	return versions, nil
+}
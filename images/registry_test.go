@@ -0,0 +1,136 @@
+package images
+
+import (
+	"reflect"
+	"testing"
+)
+
+func newRegistry() *Registry {
+	return &Registry{Aliases: map[string]string{}, History: map[string][]string{}}
+}
+
+func TestRegistryPromoteAndRollback(t *testing.T) {
+	reg := newRegistry()
+
+	steps := []struct {
+		op      string
+		version string
+		changed bool
+		latest  string
+		history []string
+	}{
+		{op: "promote", version: "1", changed: true, latest: "1"},
+		{op: "promote", version: "2", changed: true, latest: "2", history: []string{"1"}},
+		{op: "promote", version: "2", changed: false, latest: "2", history: []string{"1"}},
+		{op: "promote", version: "3", changed: true, latest: "3", history: []string{"1", "2"}},
+		{op: "rollback", version: "2", changed: true, latest: "2", history: []string{"1"}},
+		{op: "rollback", version: "1", changed: true, latest: "1", history: []string{}},
+		{op: "rollback", changed: false, latest: "1", history: []string{}},
+	}
+
+	for i, step := range steps {
+		var changed bool
+		switch step.op {
+		case "promote":
+			changed = reg.promote(step.version, "latest")
+		case "rollback":
+			var version string
+			version, changed = reg.rollback("latest")
+			if version != step.version {
+				t.Errorf("step %d: rolled back to %q, want %q", i, version, step.version)
+			}
+		}
+		if changed != step.changed {
+			t.Errorf("step %d: %s changed = %v, want %v", i, step.op, changed, step.changed)
+		}
+		if reg.Aliases["latest"] != step.latest {
+			t.Errorf("step %d: latest = %q, want %q", i, reg.Aliases["latest"], step.latest)
+		}
+		history := reg.History["latest"]
+		if len(history) != len(step.history) || (len(history) > 0 && !reflect.DeepEqual(history, step.history)) {
+			t.Errorf("step %d: history = %v, want %v", i, history, step.history)
+		}
+	}
+}
+
+func TestRegistryAliasesAreIndependent(t *testing.T) {
+	reg := newRegistry()
+	reg.promote("1", "latest")
+	reg.promote("1", "stable")
+	reg.promote("2", "latest")
+
+	if _, ok := reg.rollback("stable"); ok {
+		t.Error("rolled back stable, which was only promoted once")
+	}
+	if reg.Aliases["stable"] != "1" || reg.Aliases["latest"] != "2" {
+		t.Errorf("aliases = %v", reg.Aliases)
+	}
+}
+
+func TestParseReference(t *testing.T) {
+	tests := []struct {
+		ref, name, tag string
+		isRef          bool
+	}{
+		{"macos-10.13:latest", "macos-10.13", "latest", true},
+		{"macos-10.13:2", "macos-10.13", "2", true},
+		{"macos-10.13:", "macos-10.13", "latest", true},
+		{"macos/macos.vmdk", "macos/macos.vmdk", "latest", false},
+	}
+	for _, test := range tests {
+		name, tag := ParseReference(test.ref)
+		if name != test.name || tag != test.tag {
+			t.Errorf("ParseReference(%q) = %q, %q, want %q, %q", test.ref, name, tag, test.name, test.tag)
+		}
+		if IsReference(test.ref) != test.isRef {
+			t.Errorf("IsReference(%q) = %v, want %v", test.ref, !test.isRef, test.isRef)
+		}
+	}
+}
+
+func TestRegistryReferences(t *testing.T) {
+	reg := newRegistry()
+	reg.promote("1", "latest")
+	reg.promote("2", "latest")
+	reg.promote("3", "latest")
+	reg.rollback("latest")
+	reg.promote("2", "stable")
+	reg.History["old"] = []string{"0"}
+
+	tests := []struct {
+		version string
+		want    []string
+	}{
+		{"0", []string{"old"}},
+		{"1", []string{"latest"}},
+		{"2", []string{"latest", "stable"}},
+		{"3", []string{}},
+		{"4", []string{}},
+	}
+	for _, test := range tests {
+		if got := reg.references(test.version); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("references(%s) = %v, want %v", test.version, got, test.want)
+		}
+	}
+}
+
+func TestParseVersionPath(t *testing.T) {
+	tests := []struct {
+		path    string
+		name    string
+		version string
+		ok      bool
+	}{
+		{"macos-10.13/macos-10.13-20170601.vmdk", "macos-10.13", "20170601", true},
+		{VersionPath("xcode", "9.1-2"), "xcode", "9.1-2", true},
+		{"macos-10.13/base.vmdk", "", "", false},
+		{"macos-10.13/macos-10.13-.vmdk", "", "", false},
+		{"macos.vmdk", "", "", false},
+	}
+	for _, test := range tests {
+		name, version, ok := parseVersionPath(test.path)
+		if name != test.name || version != test.version || ok != test.ok {
+			t.Errorf("parseVersionPath(%s) = %q, %q, %v", test.path, name, version, ok)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+// Package images manages the base VMDK images that vmkite VMs boot from,
+// including copies of them replicated across datastores.
+package images
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/macstadium/vmkite/vsphere"
+)
+
+// Sidecar is stored next to an image on each datastore it is on, recording
+// where the copy came from and the checksum of its data
+type Sidecar struct {
+	Source       string    `json:"source"`
+	Checksum     string    `json:"checksum"`
+	Size         int64     `json:"size"`
+	ReplicatedAt time.Time `json:"replicated_at"`
+
+	// the size and modification time of the source disk when it was
+	// checksummed, a copy is stale once they change
+	SourceSize     int64     `json:"source_size,omitempty"`
+	SourceModified time.Time `json:"source_modified,omitempty"`
+
+	// set for images built by vmkite
+	Name      string    `json:"name,omitempty"`
+	Version   string    `json:"version,omitempty"`
+	BuiltFrom string    `json:"built_from,omitempty"`
+	BuiltAt   time.Time `json:"built_at,omitempty"`
+}
+
+// matches returns whether the sidecar was written for the disk as it is now
+func (s *Sidecar) matches(disk vsphere.DiskFile) bool {
+	return s.SourceSize == disk.FileSize && s.SourceModified.Equal(disk.Modified)
+}
+
+// SidecarPath returns the path of the sidecar file for an image
+func SidecarPath(vmdkPath string) string {
+	return strings.TrimSuffix(vmdkPath, ".vmdk") + ".vmkite.json"
+}
+
+// ReadSidecar reads an image's sidecar file, returning nil if there isn't one
+func ReadSidecar(vs *vsphere.Session, datastore, vmdkPath string) (*Sidecar, error) {
+	exists, err := vs.FileExists(datastore, SidecarPath(vmdkPath))
+	if err != nil || !exists {
+		return nil, err
+	}
+	data, err := vs.ReadFile(datastore, SidecarPath(vmdkPath))
+	if err != nil {
+		return nil, err
+	}
+	sidecar := &Sidecar{}
+	if err := json.Unmarshal(data, sidecar); err != nil {
+		return nil, fmt.Errorf("Invalid sidecar for [%s] %s: %v", datastore, vmdkPath, err)
+	}
+	return sidecar, nil
+}
+
+// WriteSidecar writes an image's sidecar file
+func WriteSidecar(vs *vsphere.Session, datastore, vmdkPath string, sidecar Sidecar) error {
+	data, err := json.MarshalIndent(sidecar, "", "  ")
+	if err != nil {
+		return err
+	}
+	return vs.WriteFile(datastore, SidecarPath(vmdkPath), data)
+}
+
+// Checksum returns the sha256 of an image's extents along with its size,
+// this reads the whole image so can take a long time
+func Checksum(vs *vsphere.Session, datastore, vmdkPath string) (string, int64, error) {
+	data, err := vs.ReadFile(datastore, vmdkPath)
+	if err != nil {
+		return "", 0, err
+	}
+	desc, err := ParseDescriptor(data)
+	if err != nil {
+		return "", 0, err
+	}
+
+	h := sha256.New()
+	var size int64
+	for _, extent := range desc.Extents {
+		extentPath := path.Join(path.Dir(vmdkPath), extent.File)
+		f, _, err := vs.OpenFile(datastore, extentPath)
+		if err != nil {
+			return "", 0, err
+		}
+		n, err := io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", 0, err
+		}
+		size += n
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), size, nil
+}
+
+// Replicate copies an image to the same path on another datastore and
+// checksums both copies, recording the result in sidecar files. A stale copy
+// already on the datastore is replaced.
+func Replicate(vs *vsphere.Session, srcDatastore, vmdkPath, dstDatastore string) error {
+	disk, err := vs.Disk(srcDatastore, vmdkPath)
+	if err != nil {
+		return err
+	}
+	source, err := ReadSidecar(vs, srcDatastore, vmdkPath)
+	if err != nil {
+		return err
+	}
+	if source == nil {
+		source = &Sidecar{}
+	}
+	if source.Checksum == "" || !source.matches(disk) {
+		debugf("checksumming [%s] %s", srcDatastore, vmdkPath)
+		source.Checksum, source.Size, err = Checksum(vs, srcDatastore, vmdkPath)
+		if err != nil {
+			return err
+		}
+		source.SourceSize, source.SourceModified = disk.FileSize, disk.Modified
+		if err := WriteSidecar(vs, srcDatastore, vmdkPath, *source); err != nil {
+			return err
+		}
+	}
+
+	exists, err := vs.FileExists(dstDatastore, vmdkPath)
+	if err != nil {
+		return err
+	}
+	if exists {
+		debugf("deleting stale copy [%s] %s", dstDatastore, vmdkPath)
+		if err := vs.DeleteDisk(dstDatastore, vmdkPath); err != nil {
+			return err
+		}
+	}
+
+	debugf("copying [%s] %s to %s", srcDatastore, vmdkPath, dstDatastore)
+	if err := vs.CopyDisk(srcDatastore, vmdkPath, dstDatastore, vmdkPath); err != nil {
+		return err
+	}
+
+	sum, size, err := Checksum(vs, dstDatastore, vmdkPath)
+	if err != nil {
+		return err
+	}
+	if sum != source.Checksum {
+		return fmt.Errorf("Checksum of [%s] %s is %s, expected %s",
+			dstDatastore, vmdkPath, sum, source.Checksum)
+	}
+
+	replica := *source
+	replica.Source = fmt.Sprintf("[%s] %s", srcDatastore, vmdkPath)
+	replica.Checksum = sum
+	replica.Size = size
+	replica.ReplicatedAt = time.Now()
+	return WriteSidecar(vs, dstDatastore, vmdkPath, replica)
+}
+
+// HasReplica returns whether a datastore holds a verified copy of an image
+// that is still the same as the image, the image's own datastore always does
+func HasReplica(vs *vsphere.Session, srcDatastore, vmdkPath, datastore string) (bool, error) {
+	if datastore == srcDatastore {
+		return true, nil
+	}
+	sidecar, err := ReadSidecar(vs, datastore, vmdkPath)
+	if err != nil || sidecar == nil {
+		return false, err
+	}
+	if sidecar.Source != fmt.Sprintf("[%s] %s", srcDatastore, vmdkPath) {
+		return false, nil
+	}
+	disk, err := vs.Disk(srcDatastore, vmdkPath)
+	if err != nil {
+		return false, err
+	}
+	if !sidecar.matches(disk) {
+		debugf("copy of [%s] %s on %s is stale", srcDatastore, vmdkPath, datastore)
+		return false, nil
+	}
+	return true, nil
+}
+
+// ClosestReplica returns the datastore to read an image from for a VM placed
+// on targetDatastore; the target itself if it holds a copy, else the source
+func ClosestReplica(vs *vsphere.Session, srcDatastore, vmdkPath, targetDatastore string) string {
+	ok, err := HasReplica(vs, srcDatastore, vmdkPath, targetDatastore)
+	if err != nil {
+		debugf("Error checking for replica of %s on %s: %v", vmdkPath, targetDatastore, err)
+	}
+	if ok {
+		return targetDatastore
+	}
+	return srcDatastore
+}
+
+// Replicator copies images in the background, at most once at a time for
+// each image and datastore
+type Replicator struct {
+	sync.Mutex
+
+	vs       *vsphere.Session
+	inflight map[string]struct{}
+}
+
+func NewReplicator(vs *vsphere.Session) *Replicator {
+	return &Replicator{
+		vs:       vs,
+		inflight: map[string]struct{}{},
+	}
+}
+
+// Ensure starts replicating an image to a datastore unless it's already
+// there or already being copied
+func (r *Replicator) Ensure(srcDatastore, vmdkPath, dstDatastore string) {
+	key := fmt.Sprintf("[%s] %s", dstDatastore, vmdkPath)
+
+	r.Lock()
+	if _, ok := r.inflight[key]; ok {
+		r.Unlock()
+		return
+	}
+	r.inflight[key] = struct{}{}
+	r.Unlock()
+
+	go func() {
+		defer func() {
+			r.Lock()
+			delete(r.inflight, key)
+			r.Unlock()
+		}()
+
+		ok, err := HasReplica(r.vs, srcDatastore, vmdkPath, dstDatastore)
+		if err != nil || ok {
+			return
+		}
+		if err := Replicate(r.vs, srcDatastore, vmdkPath, dstDatastore); err != nil {
+			debugf("Error replicating %s: %v", key, err)
+			return
+		}
+		debugf("replicated %s", key)
+	}()
+}
+
+func debugf(format string, data ...interface{}) {
+	log.Printf("[images] "+format, data...)
+}
@@ -0,0 +1,62 @@
+package images
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/macstadium/vmkite/vsphere/vspheretest"
+)
+
+// writeTestImage writes a flat disk image to the simulator
+func writeTestImage(sim *vspheretest.Simulator, datastore, vmdkPath, cid, data string) error {
+	flat := strings.TrimSuffix(path.Base(vmdkPath), ".vmdk") + "-flat.vmdk"
+	desc := fmt.Sprintf("# Disk DescriptorFile\nversion=1\nCID=%s\nparentCID=ffffffff\ncreateType=\"vmfs\"\n\nRW 1 VMFS \"%s\"\n", cid, flat)
+	if err := sim.WriteFile(datastore, vmdkPath, []byte(desc)); err != nil {
+		return err
+	}
+	return sim.WriteFile(datastore, path.Join(path.Dir(vmdkPath), flat), []byte(data))
+}
+
+func TestReplicateStaleCopy(t *testing.T) {
+	vs, sim := newTestSession(t)
+	defer sim.Close()
+
+	src, dst, vmdk := sim.Datastores[0], sim.Datastores[1], "macos/macos.vmdk"
+	if err := writeTestImage(sim, src, vmdk, "00000001", "v1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := HasReplica(vs, src, vmdk, dst); err != nil || ok {
+		t.Fatalf("HasReplica before copying = %v, %v", ok, err)
+	}
+	if err := Replicate(vs, src, vmdk, dst); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := HasReplica(vs, src, vmdk, dst); err != nil || !ok {
+		t.Fatalf("HasReplica after copying = %v, %v", ok, err)
+	}
+
+	// the source is rebuilt in place, so the copy no longer matches it
+	if err := writeTestImage(sim, src, vmdk, "00000002", "v2 data"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := HasReplica(vs, src, vmdk, dst); err != nil || ok {
+		t.Fatalf("HasReplica after changing the source = %v, %v", ok, err)
+	}
+	if ClosestReplica(vs, src, vmdk, dst) != src {
+		t.Error("ClosestReplica chose the stale copy")
+	}
+
+	if err := Replicate(vs, src, vmdk, dst); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := HasReplica(vs, src, vmdk, dst); err != nil || !ok {
+		t.Errorf("HasReplica after copying again = %v, %v", ok, err)
+	}
+	data, err := vs.ReadFile(dst, "macos/macos-flat.vmdk")
+	if err != nil || string(data) != "v2 data" {
+		t.Errorf("copy = %q, %v", data, err)
+	}
+}
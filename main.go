@@ -29,8 +29,13 @@ func run(args []string, exit func(code int)) {
 
 	cmd.ConfigureGlobal(app)
 
+	cmd.ConfigureBench(app)
+	cmd.ConfigureCapacity(app)
 	cmd.ConfigureCreateVM(app)
 	cmd.ConfigureDestroyVM(app)
+	cmd.ConfigureEvents(app)
+	cmd.ConfigureGuest(app)
+	cmd.ConfigureImage(app)
 	cmd.ConfigureRun(app)
 
 	kingpin.MustParse(app.Parse(args))
@@ -5,6 +5,7 @@ import (
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -17,12 +18,20 @@ import (
 	"time"
 
 	"github.com/macstadium/vmkite/buildkite"
+	"github.com/macstadium/vmkite/eventlog"
 )
 
 type apiHookEvent struct {
 	JobID     string
 	Event     string
 	Timestamp time.Time
+	// RanJobID is the job the VM's agent reported running, if it said
+	RanJobID string
+	// ExitStatus is the exit status of the job's command, if reported
+	ExitStatus string
+	// keep is sent whether the VM is being kept, when a failure or the end
+	// of the job is reported
+	keep chan bool
 }
 
 type api struct {
@@ -31,10 +40,21 @@ type api struct {
 
 	subscribers map[string]chan apiHookEvent
 	authTokens  map[string]string
+	bootstraps  map[string]bootstrap
+	metaData    map[string]map[string]string
 	secret      string
+	state       *state
+	// operatorToken returns the token for the dashboard and event stream
+	operatorToken func() string
 }
 
-func newApiListener(listenOn string, tokenSecret string) (*api, error) {
+// bootstrap is handed out once to the VM presenting its bootstrap token
+type bootstrap struct {
+	JobID   string
+	Secrets map[string]string
+}
+
+func newApiListener(listenOn string, tokenSecret string, operatorToken func() string, st *state, events *eventlog.Log) (*api, error) {
 	if listenOn == "" {
 		addr, err := getLocalIP()
 		if err != nil {
@@ -56,7 +76,12 @@ func newApiListener(listenOn string, tokenSecret string) (*api, error) {
 		Listener:    l,
 		subscribers: map[string]chan apiHookEvent{},
 		authTokens:  map[string]string{},
+		bootstraps:  map[string]bootstrap{},
+		metaData:    map[string]map[string]string{},
 		secret:      tokenSecret,
+		state:       st,
+
+		operatorToken: operatorToken,
 	}
 
 	mux := http.NewServeMux()
@@ -65,9 +90,30 @@ func newApiListener(listenOn string, tokenSecret string) (*api, error) {
 		json.NewEncoder(w).Encode("OK")
 	})
 
+	// VMs reach this listener too, so what operators see needs a token
+	if operatorToken() == "" {
+		debugf("No operator token, the dashboard and events are disabled")
+	}
+	mux.Handle("/dashboard", server.operatorOnly(http.HandlerFunc(server.handleDashboard)))
+	mux.Handle("/dashboard.json", server.operatorOnly(http.HandlerFunc(server.handleStatus)))
+	if events != nil {
+		mux.Handle("/events", server.operatorOnly(events))
+	}
+
+	mux.HandleFunc("/bootstrap", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, "Only POST is Allowed", http.StatusBadRequest)
+			return
+		}
+		server.handleBootstrap(w, req)
+	})
+
+	mux.HandleFunc("/metadata", server.authenticate(server.handleMetaData))
+
 	mux.HandleFunc("/notify/hook/", func(w http.ResponseWriter, req *http.Request) {
 		if req.Method != http.MethodPost {
 			http.Error(w, "Only POST is Allowed", http.StatusBadRequest)
+			return
 		}
 		server.authenticate(server.handleNotifyHook).ServeHTTP(w, req)
 	})
@@ -81,8 +127,20 @@ func newApiListener(listenOn string, tokenSecret string) (*api, error) {
 	return server, nil
 }
 
+// hookEventBuffer is how many hook events can wait for a job's worker before
+// more are dropped
+const hookEventBuffer = 16
+
+// finishedHook is reported by a VM once its agent has finished the job,
+// before the VM shuts down, when the job's final state is known
+const finishedHook = "job-finished"
+
+// keepReplyTimeout is how long a VM reporting a failed job waits to hear
+// whether it is being kept
+const keepReplyTimeout = time.Second * 10
+
 func (a *api) Subscribe(job buildkite.VmkiteJob) (string, chan apiHookEvent, error) {
-	events := make(chan apiHookEvent)
+	events := make(chan apiHookEvent, hookEventBuffer)
 	data := make([]byte, 10)
 
 	_, err := rand.Read(data)
@@ -108,13 +166,100 @@ func (a *api) Subscribe(job buildkite.VmkiteJob) (string, chan apiHookEvent, err
 	return token, events, nil
 }
 
+// IssueBootstrap returns a one-time token that the VM for job can exchange
+// for its secrets, so they never need to be written to guestinfo
+func (a *api) IssueBootstrap(job buildkite.VmkiteJob, secrets map[string]string) (string, error) {
+	data := make([]byte, 32)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(data)
+
+	a.Lock()
+	defer a.Unlock()
+
+	a.bootstraps[token] = bootstrap{JobID: job.ID, Secrets: secrets}
+	return token, nil
+}
+
+// SetMetaData sets the build meta-data the VM for job can fetch to set with
+// buildkite-agent meta-data set, which only agents running the build's jobs
+// can do
+func (a *api) SetMetaData(job buildkite.VmkiteJob, metaData map[string]string) {
+	a.Lock()
+	defer a.Unlock()
+	a.metaData[job.ID] = metaData
+}
+
+// Release forgets a job's subscriber, auth token, meta-data and any unused
+// bootstrap token, closing its events channel
 func (a *api) Release(job buildkite.VmkiteJob) {
+	a.Lock()
+	defer a.Unlock()
+
+	for token, b := range a.bootstraps {
+		if b.JobID == job.ID {
+			delete(a.bootstraps, token)
+		}
+	}
+	for token, jobID := range a.authTokens {
+		if jobID == job.ID {
+			delete(a.authTokens, token)
+		}
+	}
+	delete(a.metaData, job.ID)
 	if events, ok := a.subscribers[job.ID]; ok {
 		debugf("Releasing subscriber for %v", job.ID)
+		delete(a.subscribers, job.ID)
 		close(events)
 	}
 }
 
+// counts returns how many subscribers, auth tokens and bootstrap tokens are
+// held, which should all drop to zero once every job is released
+func (a *api) counts() (int, int, int) {
+	a.Lock()
+	defer a.Unlock()
+	return len(a.subscribers), len(a.authTokens), len(a.bootstraps)
+}
+
+// handleBootstrap exchanges a bootstrap token for the job's secrets, the
+// token is invalidated on first use
+func (a *api) handleBootstrap(w http.ResponseWriter, req *http.Request) {
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+
+	a.Lock()
+	b, ok := a.bootstraps[token]
+	delete(a.bootstraps, token)
+	a.Unlock()
+
+	if !ok {
+		debugf("Got unknown or already used bootstrap token")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	debugf("job %s bootstrapped", b.JobID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(b.Secrets)
+}
+
+// handleMetaData returns the build meta-data for the job of the VM asking, an
+// empty object if there is none yet
+func (a *api) handleMetaData(w http.ResponseWriter, req *http.Request) {
+	jobID := req.Context().Value("JobID").(string)
+
+	a.Lock()
+	metaData, ok := a.metaData[jobID]
+	a.Unlock()
+	if !ok {
+		metaData = map[string]string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(metaData)
+}
+
 func (a *api) handleNotifyHook(w http.ResponseWriter, req *http.Request) {
 	jobID := req.Context().Value("JobID")
 	if jobID == nil {
@@ -125,22 +270,51 @@ func (a *api) handleNotifyHook(w http.ResponseWriter, req *http.Request) {
 	hook := path.Base(req.URL.Path)
 	debugf("job %s reported hook %s", jobID, hook)
 
-	a.Lock()
-	defer a.Unlock()
+	event := apiHookEvent{
+		JobID:      jobID.(string),
+		Timestamp:  time.Now(),
+		Event:      hook,
+		RanJobID:   req.URL.Query().Get("job"),
+		ExitStatus: req.URL.Query().Get("exit_status"),
+	}
+	if hook == finishedHook || (event.ExitStatus != "" && event.ExitStatus != "0") {
+		event.keep = make(chan bool, 1)
+	}
 
-	events, ok := a.subscribers[jobID.(string)]
+	a.Lock()
+	events, ok := a.subscribers[event.JobID]
 	if !ok {
+		a.Unlock()
 		http.Error(w, "Unknown hook", http.StatusNotFound)
 		return
 	}
 
-	events <- apiHookEvent{
-		JobID:     jobID.(string),
-		Timestamp: time.Now(),
-		Event:     hook,
+	// never block while holding the lock, a worker that has stopped reading
+	// would otherwise stall the whole API
+	sent := false
+	select {
+	case events <- event:
+		sent = true
+	default:
+		debugf("Dropped hook %s for job %s, too many unread events", hook, jobID)
 	}
+	a.Unlock()
 
-	json.NewEncoder(w).Encode("OK")
+	if event.keep == nil {
+		json.NewEncoder(w).Encode("OK")
+		return
+	}
+
+	// tell the VM whether to stay powered on for debugging
+	keep := false
+	if sent {
+		select {
+		case keep = <-event.keep:
+		case <-time.After(keepReplyTimeout):
+			debugf("Timed out deciding whether to keep the VM for job %s", jobID)
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]bool{"keep": keep})
 }
 
 // authenticate provides Authentication middleware for handlers
@@ -157,9 +331,11 @@ func (a *api) authenticate(next http.HandlerFunc) http.HandlerFunc {
 		}
 
 		// Check if we have the token in our auth table
+		a.Lock()
 		jobID, ok := a.authTokens[token]
+		a.Unlock()
 		if !ok {
-			debugf("Got incorrect auth token of %s", token)
+			debugf("Got incorrect auth token")
 			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 			return
 		}
@@ -168,6 +344,25 @@ func (a *api) authenticate(next http.HandlerFunc) http.HandlerFunc {
 	})
 }
 
+// operatorOnly requires the operator token, either as a bearer token or as a
+// token query parameter for opening the dashboard in a browser, refusing
+// everyone if there is no operator token
+func (a *api) operatorOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" {
+			token = r.URL.Query().Get("token")
+		}
+		expected := a.operatorToken()
+		if expected == "" || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+			debugf("Got incorrect operator token")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func getLocalIP() (string, error) {
 	addrs, err := net.InterfaceAddrs()
 	if err != nil {
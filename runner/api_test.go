@@ -0,0 +1,77 @@
+package runner
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/macstadium/vmkite/eventlog"
+)
+
+func TestOperatorOnly(t *testing.T) {
+	events, err := eventlog.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := newApiListener("127.0.0.1:0", "", func() string { return "operator-token" }, newState("acme"), events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := "http://" + a.Addr().String()
+
+	tests := []struct {
+		path   string
+		bearer string
+		status int
+	}{
+		{"/dashboard", "", http.StatusUnauthorized},
+		{"/dashboard.json", "wrong", http.StatusUnauthorized},
+		{"/events", "", http.StatusUnauthorized},
+		{"/dashboard", "operator-token", http.StatusOK},
+		{"/dashboard.json?token=operator-token", "", http.StatusOK},
+		{"/events", "operator-token", http.StatusOK},
+	}
+	for _, test := range tests {
+		if status := get(t, base+test.path, test.bearer); status != test.status {
+			t.Errorf("%s with %q: %d, want %d", test.path, test.bearer, status, test.status)
+		}
+	}
+
+	// a hook token isn't an operator token
+	hookToken, _, err := a.Subscribe(testJob("job-1", "app", 0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := get(t, base+"/dashboard.json", hookToken); status != http.StatusUnauthorized {
+		t.Errorf("hook token: %d, want %d", status, http.StatusUnauthorized)
+	}
+
+	// without an operator token nothing gets in
+	a, err = newApiListener("127.0.0.1:0", "", func() string { return "" }, newState("acme"), events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := get(t, "http://"+a.Addr().String()+"/dashboard.json", ""); status != http.StatusUnauthorized {
+		t.Errorf("no operator token: %d, want %d", status, http.StatusUnauthorized)
+	}
+}
+
+// get requests a URL with a bearer token, returning the status
+func get(t *testing.T, url, bearer string) int {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatalf("%s: %v", url, err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
@@ -0,0 +1,274 @@
+package runner
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/macstadium/vmkite/buildkite"
+	"github.com/macstadium/vmkite/vsphere"
+)
+
+// BenchParams describe the synthetic load and faults for Bench
+type BenchParams struct {
+	Jobs        int
+	Pipelines   int
+	Concurrency int
+	// ArrivalInterval is the time between synthetic jobs being queued
+	ArrivalInterval time.Duration
+
+	CreateLatency  time.Duration
+	JobDuration    time.Duration
+	DestroyLatency time.Duration
+	// JobTimeout is how long the runner waits for a VM to power off
+	JobTimeout time.Duration
+	// Deadline fails the benchmark if the runner hasn't finished by then
+	Deadline time.Duration
+
+	// failure rates, from 0 to 1
+	CreateFailureRate float64
+	HungPowerOffRate  float64
+	APIErrorRate      float64
+	DroppedHookRate   float64
+}
+
+// BenchReport is the outcome of Bench
+type BenchReport struct {
+	Jobs, Succeeded, Failed int
+	Elapsed                 time.Duration
+	// Throughput is finished jobs per second
+	Throughput float64
+	// Latencies from jobs being queued to finishing, by percentile
+	Latencies map[int]time.Duration
+
+	CreateFailures, HungVMs, APIErrors, DroppedHooks int64
+
+	// what is left over after every job finished, all should be zero
+	LeakedSubscribers, LeakedAuthTokens, LeakedBootstraps int
+	LeakedStateJobs, LeakedPreemptible                    int
+	LeakedGoroutines                                      int
+}
+
+// Bench drives synthetic jobs through Run using a fake Buildkite and a fake
+// hypervisor, injecting faults, to find deadlocks and leaks and measure
+// throughput
+func Bench(p BenchParams) (BenchReport, error) {
+	report := BenchReport{Jobs: p.Jobs, Latencies: map[int]time.Duration{}}
+	bk := &benchBuildkite{
+		params: p,
+		report: &report,
+		client: &http.Client{Transport: &http.Transport{}},
+	}
+
+	r := newRunner(nil, bk, "bench", Params{
+		Concurrency: p.Concurrency,
+		ApiListenOn: "127.0.0.1:0",
+	})
+	r.pollInterval = time.Millisecond * 50
+	r.jobTimeout = p.JobTimeout
+	r.provision = func(params vsphere.VirtualMachineCreationParams, job buildkite.VmkiteJob) (jobVM, error) {
+		return bk.provision(params, job)
+	}
+
+	var mu sync.Mutex
+	latencies := []time.Duration{}
+	r.finished = func(job buildkite.VmkiteJob, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		latencies = append(latencies, time.Since(job.CreatedAt))
+		if err != nil {
+			report.Failed++
+		} else {
+			report.Succeeded++
+		}
+	}
+
+	goroutines := runtime.NumGoroutine()
+	start := time.Now()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- r.Run(vsphere.VirtualMachineCreationParams{GuestInfo: map[string]string{}})
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return report, err
+		}
+	case <-time.After(p.Deadline):
+		pprof.Lookup("goroutine").WriteTo(os.Stderr, 1)
+		mu.Lock()
+		defer mu.Unlock()
+		return report, fmt.Errorf("Runner still busy after %v with %d of %d jobs finished, goroutines dumped above",
+			p.Deadline, len(latencies), p.Jobs)
+	}
+
+	report.Elapsed = time.Since(start)
+	report.Throughput = float64(p.Jobs) / report.Elapsed.Seconds()
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	for _, pc := range []int{50, 90, 99, 100} {
+		if len(latencies) > 0 {
+			report.Latencies[pc] = latencies[(len(latencies)-1)*pc/100]
+		}
+	}
+
+	// give hooks that were in flight and the API's connections time to
+	// wind down before counting what's left
+	time.Sleep(time.Second)
+	bk.client.Transport.(*http.Transport).CloseIdleConnections()
+	time.Sleep(time.Millisecond * 100)
+	report.LeakedSubscribers, report.LeakedAuthTokens, report.LeakedBootstraps = r.api.counts()
+	snap := r.state.Snapshot()
+	report.LeakedStateJobs = len(snap.Queued) + len(snap.Active)
+	r.Lock()
+	report.LeakedPreemptible = len(r.preempt)
+	r.Unlock()
+	// the API server's goroutines are expected to outlive Run
+	if leaked := runtime.NumGoroutine() - goroutines - 1; leaked > 0 {
+		report.LeakedGoroutines = leaked
+	}
+
+	return report, nil
+}
+
+// benchBuildkite is a fake job source and Buildkite API
+type benchBuildkite struct {
+	params BenchParams
+	report *BenchReport
+	client *http.Client
+}
+
+func (b *benchBuildkite) PollJobs(query buildkite.VmkiteJobQueryParams) chan buildkite.VmkiteJob {
+	ch := make(chan buildkite.VmkiteJob)
+	go func() {
+		defer close(ch)
+		for i := 0; i < b.params.Jobs; {
+			time.Sleep(b.params.ArrivalInterval)
+			if chance(b.params.APIErrorRate) {
+				atomic.AddInt64(&b.report.APIErrors, 1)
+				continue
+			}
+			pipeline := fmt.Sprintf("bench-%d", i%b.params.Pipelines)
+			ch <- buildkite.VmkiteJob{
+				ID:          fmt.Sprintf("bench-job-%d", i),
+				BuildNumber: strconv.Itoa(i),
+				Pipeline:    pipeline,
+				CreatedAt:   time.Now(),
+				Priority:    rand.Intn(3),
+				Metadata:    buildkite.VmkiteMetadata{VMDK: "bench/bench.vmdk", GuestID: "otherGuest64"},
+			}
+			i++
+		}
+	}()
+	return ch
+}
+
+func (b *benchBuildkite) FailJob(agentToken string, job buildkite.VmkiteJob, message string) error {
+	if chance(b.params.APIErrorRate) {
+		atomic.AddInt64(&b.report.APIErrors, 1)
+		return errors.New("500 Internal Server Error")
+	}
+	return nil
+}
+
+func (b *benchBuildkite) PreemptJob(job buildkite.VmkiteJob) (string, error) {
+	return job.ID + "-retry", nil
+}
+
+func (b *benchBuildkite) Annotate(job buildkite.VmkiteJob, context string, style string, body string) error {
+	return nil
+}
+
+func (b *benchBuildkite) JobState(job buildkite.VmkiteJob) (string, error) {
+	return "passed", nil
+}
+
+// provision pretends to create a VM, which bootstraps and reports hooks to
+// the runner's API like a real one would
+func (b *benchBuildkite) provision(params vsphere.VirtualMachineCreationParams, job buildkite.VmkiteJob) (jobVM, error) {
+	time.Sleep(jitter(b.params.CreateLatency))
+	if chance(b.params.CreateFailureRate) {
+		atomic.AddInt64(&b.report.CreateFailures, 1)
+		return nil, errors.New("InsufficientHostCapacityFault")
+	}
+
+	vm := &benchVM{destroyLatency: b.params.DestroyLatency}
+	if chance(b.params.HungPowerOffRate) {
+		atomic.AddInt64(&b.report.HungVMs, 1)
+		vm.hung = true
+	}
+	vm.poweroff = time.Now().Add(jitter(b.params.JobDuration))
+
+	go b.agent(params.GuestInfo, job)
+	return vm, nil
+}
+
+// agent fetches the VM's secrets and notifies the runner of hooks
+func (b *benchBuildkite) agent(guestInfo map[string]string, job buildkite.VmkiteJob) {
+	api := "http://" + guestInfo["vmkite-api"]
+
+	req, _ := http.NewRequest("POST", api+"/bootstrap", nil)
+	req.Header.Set("Authorization", "Bearer "+guestInfo["vmkite-bootstrap-token"])
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return
+	}
+	secrets := map[string]string{}
+	json.NewDecoder(resp.Body).Decode(&secrets)
+	resp.Body.Close()
+
+	for _, hook := range []string{"environment", "pre-command", "post-command"} {
+		if chance(b.params.DroppedHookRate) {
+			atomic.AddInt64(&b.report.DroppedHooks, 1)
+			continue
+		}
+		req, _ := http.NewRequest("POST", api+"/notify/hook/"+hook+"?job="+job.ID, nil)
+		req.Header.Set("Authorization", "Bearer "+secrets["vmkite-api-token"])
+		if resp, err := b.client.Do(req); err == nil {
+			resp.Body.Close()
+		}
+	}
+}
+
+type benchVM struct {
+	hung           bool
+	poweroff       time.Time
+	destroyLatency time.Duration
+}
+
+func (vm *benchVM) HostName() (string, error) {
+	return "bench-host", nil
+}
+
+func (vm *benchVM) IsPoweredOn() (bool, error) {
+	return vm.hung || time.Now().Before(vm.poweroff), nil
+}
+
+func (vm *benchVM) Destroy(force bool) error {
+	time.Sleep(jitter(vm.destroyLatency))
+	return nil
+}
+
+func chance(rate float64) bool {
+	return rate > 0 && rand.Float64() < rate
+}
+
+// jitter returns a duration within 50% either side of d
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d)))
+}
@@ -0,0 +1,115 @@
+package runner
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/macstadium/vmkite/buildkite"
+)
+
+// Which builds are annotated, for Params.Annotate
+const (
+	// AnnotateNone never annotates builds
+	AnnotateNone = "none"
+	// AnnotateFailures annotates builds whose jobs couldn't get a VM
+	AnnotateFailures = "failures"
+	// AnnotateAll also annotates builds with the VM each job runs on
+	AnnotateAll = "all"
+)
+
+// placedVM is a VM that can say where its files and disk image are
+type placedVM interface {
+	Directory() (string, string, error)
+	DiskFiles() ([]string, error)
+}
+
+// vmReport describes the VM a job runs on, for its build's meta-data and
+// annotations
+type vmReport struct {
+	VM        string
+	Host      string
+	Datastore string
+	Image     string
+	Boot      time.Duration
+	QueueWait time.Duration
+}
+
+func newVMReport(vm jobVM, job buildkite.VmkiteJob, host string, boot, queueWait time.Duration) vmReport {
+	rep := vmReport{
+		VM:        job.VMName(),
+		Host:      host,
+		Image:     job.Metadata.VMDK,
+		Boot:      boot.Truncate(time.Second),
+		QueueWait: queueWait.Truncate(time.Second),
+	}
+	if p, ok := vm.(placedVM); ok {
+		if ds, _, err := p.Directory(); err == nil {
+			rep.Datastore = ds
+		}
+		if disks, err := p.DiskFiles(); err == nil && len(disks) > 0 {
+			rep.Image = disks[0]
+		}
+	}
+	return rep
+}
+
+// metaData is the report as build meta-data. A build's meta-data is shared by
+// all its jobs, so keys include the job ID.
+func (rep vmReport) metaData(job buildkite.VmkiteJob) map[string]string {
+	prefix := "vmkite:" + job.ID + ":"
+	return map[string]string{
+		prefix + "vm":         rep.VM,
+		prefix + "host":       rep.Host,
+		prefix + "datastore":  rep.Datastore,
+		prefix + "image":      rep.Image,
+		prefix + "boot-time":  rep.Boot.String(),
+		prefix + "queue-wait": rep.QueueWait.String(),
+	}
+}
+
+// markdown is the report as a build annotation
+func (rep vmReport) markdown(job buildkite.VmkiteJob) string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "Job %s ran on vmkite VM `%s`\n\n", job.ID, rep.VM)
+	b.WriteString("| | |\n|---|---|\n")
+	fmt.Fprintf(&b, "| ESXi host | `%s` |\n", rep.Host)
+	fmt.Fprintf(&b, "| Datastore | `%s` |\n", rep.Datastore)
+	fmt.Fprintf(&b, "| Image | `%s` |\n", rep.Image)
+	fmt.Fprintf(&b, "| Boot time | %s |\n", rep.Boot)
+	fmt.Fprintf(&b, "| Queue wait | %s |\n", rep.QueueWait)
+	return b.String()
+}
+
+// reportVM makes the VM a job runs on known to the job's build, as meta-data
+// for the VM's agent to set and optionally as an annotation
+func (r *Runner) reportVM(job buildkite.VmkiteJob, rep vmReport) {
+	if r.api != nil {
+		r.api.SetMetaData(job, rep.metaData(job))
+	}
+	if r.params.Annotate == AnnotateAll {
+		r.annotate(job, "vmkite-"+job.ID, buildkite.AnnotationInfo, rep.markdown(job))
+	}
+}
+
+// reportProvisionFailure annotates a job's build with why it didn't get a VM
+func (r *Runner) reportProvisionFailure(job buildkite.VmkiteJob, err error) {
+	if r.params.Annotate != AnnotateFailures && r.params.Annotate != AnnotateAll {
+		return
+	}
+	r.annotate(job, "vmkite-"+job.ID, buildkite.AnnotationError, fmt.Sprintf(
+		"vmkite couldn't create VM `%s` for job %s:\n\n```\n%s\n```\n",
+		job.VMName(), job.ID, strings.TrimSpace(err.Error())))
+}
+
+// annotate adds or replaces the build annotation for a job with context
+func (r *Runner) annotate(job buildkite.VmkiteJob, context string, style string, body string) {
+	if r.params.DryRun {
+		dryRunf("would annotate build of %s: %s", job.String(), body)
+		return
+	}
+	if err := r.bk.Annotate(job, context, style, body); err != nil {
+		debugf("Error annotating build for job %s: %v", job.ID, err)
+	}
+}
@@ -0,0 +1,104 @@
+package runner
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"time"
+)
+
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"elapsed": func(j jobState) string {
+		return j.Elapsed().Truncate(time.Second).String()
+	},
+	"ago": func(t time.Time) string {
+		return time.Since(t).Truncate(time.Second).String() + " ago"
+	},
+	"until": func(t time.Time) string {
+		return time.Until(t).Truncate(time.Second).String()
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="5">
+<title>vmkite</title>
+<style>
+body { font-family: -apple-system, Helvetica, Arial, sans-serif; margin: 2em; color: #333; }
+table { border-collapse: collapse; margin-bottom: 2em; min-width: 60%; }
+th, td { text-align: left; padding: 4px 12px; border-bottom: 1px solid #ddd; }
+th { background: #f4f4f4; }
+.error { color: #b00; font-family: monospace; }
+.empty { color: #999; }
+</style>
+</head>
+<body>
+<h1>vmkite</h1>
+
+<h2>Queue ({{len .Queued}})</h2>
+<table>
+<tr><th>Job</th><th>Template</th><th>Waiting</th></tr>
+{{range .Queued}}<tr>
+<td><a href="{{.JobURL}}">{{.Job.String}}</a></td>
+<td>{{.Job.TemplateName}}</td>
+<td>{{elapsed .}}</td>
+</tr>{{else}}<tr><td colspan="3" class="empty">No queued jobs</td></tr>{{end}}
+</table>
+
+<h2>Active VMs ({{len .Active}})</h2>
+<table>
+<tr><th>VM</th><th>Job</th><th>Host</th><th>Phase</th><th>In phase</th><th>Elapsed</th></tr>
+{{range .Active}}<tr>
+<td>{{.VMName}}</td>
+<td><a href="{{.JobURL}}">{{.Job.String}}</a> (<a href="{{.BuildURL}}">build</a>)</td>
+<td>{{.Host}}</td>
+<td>{{.Phase}}</td>
+<td>{{ago .PhaseChanged}}</td>
+<td>{{elapsed .}}</td>
+</tr>{{else}}<tr><td colspan="6" class="empty">No active VMs</td></tr>{{end}}
+</table>
+
+<h2>Kept for debugging ({{len .Held}})</h2>
+<table>
+<tr><th>VM</th><th>Job</th><th>Host</th><th>Destroyed in</th></tr>
+{{range .Held}}<tr>
+<td>{{.VMName}}</td>
+<td><a href="{{.JobURL}}">{{.Job.String}}</a> (<a href="{{.BuildURL}}">build</a>)</td>
+<td>{{.Host}}</td>
+<td>{{until .HeldUntil}}</td>
+</tr>{{else}}<tr><td colspan="4" class="empty">No VMs kept</td></tr>{{end}}
+</table>
+
+<h2>Hosts</h2>
+<table>
+<tr><th>Host</th><th>Slots in use</th></tr>
+{{range .Hosts}}<tr><td>{{.Host}}</td><td>{{.Slots}}{{if .Held}} ({{.Held}} kept){{end}}</td></tr>
+{{else}}<tr><td colspan="2" class="empty">No hosts in use</td></tr>{{end}}
+</table>
+
+<h2>Recent failures</h2>
+<p>{{.Preemptions}} jobs preempted by higher priority jobs</p>
+<table>
+<tr><th>Job</th><th>VM</th><th>Phase</th><th>Error</th></tr>
+{{range .Failures}}<tr>
+<td><a href="{{.JobURL}}">{{.Job.String}}</a></td>
+<td>{{.VMName}}</td>
+<td>{{.Phase}}</td>
+<td class="error">{{.Error}}</td>
+</tr>{{else}}<tr><td colspan="4" class="empty">No recent failures</td></tr>{{end}}
+</table>
+</body>
+</html>
+`))
+
+func (a *api) handleDashboard(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplate.Execute(w, a.state.Snapshot()); err != nil {
+		debugf("Error rendering dashboard: %v", err)
+	}
+}
+
+func (a *api) handleStatus(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.state.Snapshot())
+}
@@ -0,0 +1,31 @@
+package runner
+
+import (
+	"path/filepath"
+
+	"github.com/macstadium/vmkite/buildkite"
+)
+
+// diagnosable VMs can save what's needed to debug them before they are
+// destroyed
+type diagnosable interface {
+	CaptureDiagnostics(dir string) ([]string, error)
+}
+
+// captureDiagnostics saves a failed job's VM screenshot and logs, if a
+// diagnostics directory is configured
+func (r *Runner) captureDiagnostics(vm jobVM, job buildkite.VmkiteJob) {
+	d, ok := vm.(diagnosable)
+	if !ok || r.params.DiagnosticsDir == "" {
+		return
+	}
+	dir := filepath.Join(r.params.DiagnosticsDir, job.ID)
+	debugf("capturing diagnostics for job %s to %s", job.ID, dir)
+	files, err := d.CaptureDiagnostics(dir)
+	if err != nil {
+		debugf("Error capturing diagnostics for job %s: %v", job.ID, err)
+	}
+	for _, f := range files {
+		debugf("saved %s", f)
+	}
+}
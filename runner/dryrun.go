@@ -0,0 +1,89 @@
+package runner
+
+import (
+	"time"
+
+	"github.com/macstadium/vmkite/buildkite"
+	"github.com/macstadium/vmkite/creator"
+	"github.com/macstadium/vmkite/images"
+	"github.com/macstadium/vmkite/vsphere"
+)
+
+// jobVM is the VM a job runs on
+type jobVM interface {
+	HostName() (string, error)
+	IsPoweredOn() (bool, error)
+	Destroy(force bool) error
+}
+
+// planVMForJob is createVMForJob for dry runs: it looks up everything a real
+// run would and logs what it would do, returning a VM that powers off after
+// the configured job duration
+func (r *Runner) planVMForJob(createParams vsphere.VirtualMachineCreationParams, job buildkite.VmkiteJob) (jobVM, error) {
+	if existing, err := r.vs.VirtualMachine(job.VMName()); err == nil {
+		adopt, err := r.canAdoptVM(existing, job)
+		if err != nil {
+			return nil, err
+		}
+		if adopt {
+			dryRunf("would adopt existing vm %s for %s", existing.Name, job.String())
+			return newDryRunVM(existing.Name, "", r.params.DryRunJobDuration), nil
+		}
+		dryRunf("would destroy unhealthy vm %s", existing.Name)
+	}
+
+	srcDiskPath, err := images.Resolve(r.vs, createParams.SrcDiskDataStore, job.Metadata.VMDK)
+	if err != nil {
+		return nil, err
+	}
+	createParams.SrcDiskPath = srcDiskPath
+	createParams.GuestID = job.Metadata.GuestID
+	createParams.Name = job.VMName()
+
+	placement, err := creator.Plan(r.vs, createParams, r.params.CreatorOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	host := placement.Host
+	if host == "" {
+		host = "(chosen by vSphere)"
+	}
+	profile := job.Profile
+	if profile == "" {
+		profile = "(agent query rules)"
+	}
+	dryRunf("would create vm %s for %s: profile %s, image [%s] %s, datastore %s, host %s",
+		createParams.Name, job.String(), profile, placement.SrcDatastore, srcDiskPath,
+		placement.Datastore, host)
+
+	return newDryRunVM(createParams.Name, host, r.params.DryRunJobDuration), nil
+}
+
+// dryRunVM pretends to run a job for a while and then power off
+type dryRunVM struct {
+	name     string
+	host     string
+	poweroff time.Time
+}
+
+func newDryRunVM(name, host string, duration time.Duration) *dryRunVM {
+	return &dryRunVM{name: name, host: host, poweroff: time.Now().Add(duration)}
+}
+
+func (vm *dryRunVM) HostName() (string, error) {
+	return vm.host, nil
+}
+
+func (vm *dryRunVM) IsPoweredOn() (bool, error) {
+	return time.Now().Before(vm.poweroff), nil
+}
+
+func (vm *dryRunVM) Destroy(force bool) error {
+	dryRunf("would destroy vm %s", vm.name)
+	return nil
+}
+
+func dryRunf(format string, data ...interface{}) {
+	debugf("[dry-run] "+format, data...)
+}
@@ -0,0 +1,144 @@
+package runner
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/macstadium/vmkite/buildkite"
+	"github.com/macstadium/vmkite/eventlog"
+)
+
+// KeepParams control keeping the VMs of failed jobs for debugging
+type KeepParams struct {
+	// Enabled keeps VMs of failed jobs unless the job has a
+	// vmkite-keep-on-failure=false rule, jobs can opt in with
+	// vmkite-keep-on-failure=true either way
+	Enabled bool
+	// TTL is how long a VM is kept before it is destroyed
+	TTL time.Duration
+	// MaxVMs is how many VMs can be kept at once, none if zero. Kept VMs
+	// don't count towards the concurrency limit.
+	MaxVMs int
+}
+
+// consoleVM is a VM that can say how to get at it
+type consoleVM interface {
+	ConsoleURL() string
+	IPAddress() (string, error)
+}
+
+// failedStates are the final Buildkite states of jobs whose VMs are worth
+// keeping
+var failedStates = map[string]bool{"failed": true, "timed_out": true}
+
+// reserveHold decides whether to keep a failed job's VM for debugging,
+// returning how the job failed, or false if it didn't, the job doesn't want
+// its VM kept or too many VMs already are
+func (r *Runner) reserveHold(job buildkite.VmkiteJob, event apiHookEvent) (string, bool) {
+	p := r.params.KeepOnFailure
+	if !job.KeepOnFailure(p.Enabled) {
+		return "", false
+	}
+	failure, failed := r.jobFailure(job, event)
+	if !failed {
+		return "", false
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	if r.held >= p.MaxVMs {
+		debugf("Already keeping %d VMs, not keeping the VM for job %s", r.held, job.ID)
+		return "", false
+	}
+	r.held++
+	return failure, true
+}
+
+// jobFailure decides whether a job failed from the exit status a hook
+// reported, or else from the job's state in Buildkite, which catches jobs
+// failed by a later hook or timed out
+func (r *Runner) jobFailure(job buildkite.VmkiteJob, event apiHookEvent) (string, bool) {
+	if event.ExitStatus != "" && event.ExitStatus != "0" {
+		return "exit status " + event.ExitStatus, true
+	}
+	state, err := r.bk.JobState(job)
+	if err != nil {
+		debugf("Error getting the state of job %s: %v", job.ID, err)
+		return "", false
+	}
+	if failedStates[state] {
+		return "state " + state, true
+	}
+	return "", false
+}
+
+// hold keeps a failed job's VM, reserved with reserveHold, and annotates its
+// build with how to get at it. The VM is destroyed when its TTL expires or
+// once it is powered off.
+func (r *Runner) hold(vm jobVM, job buildkite.VmkiteJob) {
+	until := time.Now().Add(r.params.KeepOnFailure.TTL)
+	r.state.Held(job, until)
+	r.record(eventlog.Kept, job, eventlog.Event{VM: job.VMName()})
+	debugf("keeping VM %s for failed job %s until %s", job.VMName(), job.ID, until.Format(time.RFC3339))
+
+	r.annotate(job, "vmkite-kept-"+job.ID, buildkite.AnnotationWarning, keptAnnotation(vm, job, until))
+
+	go r.expire(vm, job, until)
+}
+
+// expire destroys a held VM once its TTL is up or it has been powered off.
+// The job was already recorded as failed when its VM was kept.
+func (r *Runner) expire(vm jobVM, job buildkite.VmkiteJob, until time.Time) {
+	defer func() {
+		r.Lock()
+		r.held--
+		r.Unlock()
+		r.state.Released(job)
+	}()
+
+	ticker := time.NewTicker(r.pollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if time.Now().After(until) {
+			debugf("Kept VM %s for job %s expired, destroying", job.VMName(), job.ID)
+			break
+		}
+		poweredOn, err := vm.IsPoweredOn()
+		if err != nil {
+			debugf("Error checking kept VM %s: %v", job.VMName(), err)
+			continue
+		}
+		if !poweredOn {
+			debugf("Kept VM %s for job %s was powered off, destroying", job.VMName(), job.ID)
+			break
+		}
+	}
+
+	if err := vm.Destroy(true); err != nil {
+		debugf("Error destroying kept VM %s: %v", job.VMName(), err)
+		return
+	}
+	r.record(eventlog.Destroyed, job, eventlog.Event{VM: job.VMName()})
+}
+
+// keptAnnotation describes where to find a kept VM, in Markdown
+func keptAnnotation(vm jobVM, job buildkite.VmkiteJob, until time.Time) string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "vmkite kept VM `%s` for job %s running for debugging until %s.\n\n",
+		job.VMName(), job.ID, until.Format(time.RFC1123))
+
+	if host, err := vm.HostName(); err == nil && host != "" {
+		fmt.Fprintf(&b, "* ESXi host: `%s`\n", host)
+	}
+	if c, ok := vm.(consoleVM); ok {
+		fmt.Fprintf(&b, "* Console: %s\n", c.ConsoleURL())
+		if ip, err := c.IPAddress(); err == nil && ip != "" {
+			fmt.Fprintf(&b, "* IP address: `%s`\n", ip)
+		}
+	}
+
+	b.WriteString("\nPower the VM off to destroy it early.\n")
+	return b.String()
+}
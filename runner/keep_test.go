@@ -0,0 +1,129 @@
+package runner
+
+import (
+	"testing"
+	"time"
+
+	"github.com/macstadium/vmkite/buildkite"
+	"github.com/macstadium/vmkite/buildkite/buildkitetest"
+	"github.com/macstadium/vmkite/eventlog"
+)
+
+func TestReserveHold(t *testing.T) {
+	bk, stub := newStubSession(t)
+	defer stub.Close()
+	stub.SetJobs(
+		buildkitetest.Job{ID: "passed", Pipeline: "app", BuildNumber: 1, State: "passed"},
+		buildkitetest.Job{ID: "failed", Pipeline: "app", BuildNumber: 1, State: "failed"},
+		buildkitetest.Job{ID: "timed-out", Pipeline: "app", BuildNumber: 1, State: "timed_out"},
+		buildkitetest.Job{ID: "running", Pipeline: "app", BuildNumber: 1, State: "running"},
+	)
+
+	tests := []struct {
+		name       string
+		job        string
+		rules      []string
+		exitStatus string
+		want       string
+		kept       bool
+	}{
+		{"failed hook", "passed", nil, "2", "exit status 2", true},
+		{"failed in Buildkite", "failed", nil, "0", "state failed", true},
+		{"timed out without exit status", "timed-out", nil, "", "state timed_out", true},
+		{"passed", "passed", nil, "", "", false},
+		{"still running", "running", nil, "0", "", false},
+		{"unknown build", "missing", nil, "", "", false},
+		{"opted out", "failed", []string{"vmkite-keep-on-failure=false"}, "1", "", false},
+	}
+	for _, test := range tests {
+		r := newRunner(nil, bk, "acme", Params{Concurrency: 1, KeepOnFailure: KeepParams{Enabled: true, MaxVMs: 1}})
+		job := buildkite.VmkiteJob{ID: test.job, Pipeline: "app", BuildNumber: "1", AgentQueryRules: test.rules}
+		if test.job == "missing" {
+			job.BuildNumber = "2"
+		}
+		failure, kept := r.reserveHold(job, apiHookEvent{Event: finishedHook, ExitStatus: test.exitStatus})
+		if failure != test.want || kept != test.kept {
+			t.Errorf("%s: reserveHold = %q, %v, want %q, %v", test.name, failure, kept, test.want, test.kept)
+		}
+		if held := r.held; (held == 1) != test.kept {
+			t.Errorf("%s: %d VMs held", test.name, held)
+		}
+	}
+}
+
+func TestReserveHoldLimit(t *testing.T) {
+	bk, stub := newStubSession(t)
+	defer stub.Close()
+	r := newRunner(nil, bk, "acme", Params{Concurrency: 1, KeepOnFailure: KeepParams{Enabled: true, MaxVMs: 1}})
+	job := buildkite.VmkiteJob{ID: "job-1", Pipeline: "app", BuildNumber: "1"}
+
+	if _, kept := r.reserveHold(job, apiHookEvent{ExitStatus: "1"}); !kept {
+		t.Fatal("first VM wasn't kept")
+	}
+	if _, kept := r.reserveHold(job, apiHookEvent{ExitStatus: "1"}); kept {
+		t.Fatal("kept more than --keep-on-failure-max VMs")
+	}
+}
+
+func TestReserveHoldNone(t *testing.T) {
+	bk, stub := newStubSession(t)
+	defer stub.Close()
+	r := newRunner(nil, bk, "acme", Params{Concurrency: 1, KeepOnFailure: KeepParams{Enabled: true, MaxVMs: 0}})
+	job := buildkite.VmkiteJob{ID: "job-1", Pipeline: "app", BuildNumber: "1", AgentQueryRules: []string{"vmkite-keep-on-failure=true"}}
+
+	if _, kept := r.reserveHold(job, apiHookEvent{ExitStatus: "1"}); kept {
+		t.Fatal("kept a VM with --keep-on-failure-max=0")
+	}
+}
+
+func TestExpireRecordsDestroyed(t *testing.T) {
+	events, err := eventlog.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorded, stop := events.Subscribe()
+	defer stop()
+
+	r := newRunner(nil, nil, "acme", Params{Concurrency: 1, Events: events})
+	r.pollInterval = time.Millisecond
+	r.held = 1
+	job := buildkite.VmkiteJob{ID: "job-1", Pipeline: "app", BuildNumber: "1"}
+	vm := &testVM{hung: true}
+	r.expire(vm, job, time.Now())
+
+	if !vm.isDestroyed() || r.held != 0 {
+		t.Errorf("destroyed = %v, %d VMs held", vm.isDestroyed(), r.held)
+	}
+	types := []string{}
+	for len(recorded) > 0 {
+		types = append(types, (<-recorded).Type)
+	}
+	if len(types) != 1 || types[0] != eventlog.Destroyed {
+		t.Errorf("recorded %v, want only destroyed", types)
+	}
+}
+
+func TestSnapshotCountsHeldVMs(t *testing.T) {
+	s := newState("acme")
+	running := buildkite.VmkiteJob{ID: "running", Pipeline: "app", BuildNumber: "1"}
+	kept := buildkite.VmkiteJob{ID: "kept", Pipeline: "app", BuildNumber: "2"}
+	finishing := buildkite.VmkiteJob{ID: "finishing", Pipeline: "app", BuildNumber: "3"}
+	for _, job := range []buildkite.VmkiteJob{running, kept, finishing} {
+		s.Queued(job)
+		s.SetPhase(job, phaseRunning)
+		s.SetVM(job, job.VMName(), "esxi-1")
+	}
+	until := time.Now().Add(time.Hour)
+	s.Held(kept, until)
+	s.Finished(kept, nil)
+	// held, but its job is yet to finish so it's already counted
+	s.Held(finishing, until)
+
+	snap := s.Snapshot()
+	if len(snap.Hosts) != 1 {
+		t.Fatalf("hosts = %+v", snap.Hosts)
+	}
+	if h := snap.Hosts[0]; h.Host != "esxi-1" || h.Slots != 3 || h.Held != 2 {
+		t.Errorf("host usage = %+v, want 3 slots with 2 kept", h)
+	}
+}
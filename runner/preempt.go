@@ -0,0 +1,85 @@
+package runner
+
+import (
+	"errors"
+
+	"github.com/macstadium/vmkite/buildkite"
+)
+
+// Preemption policies for choosing which running job to make way
+const (
+	// PreemptLowestPriority preempts the lowest priority job, the most
+	// recently started of those if there are several
+	PreemptLowestPriority = "lowest-priority"
+	// PreemptNewest preempts the most recently started lower priority job,
+	// wasting the least work
+	PreemptNewest = "newest"
+)
+
+var errPreempted = errors.New("Preempted by a higher priority job")
+
+// PreemptionParams control whether urgent jobs can take the place of running
+// ones when every worker is busy
+type PreemptionParams struct {
+	Enabled bool
+	// MinPriority is the priority a job needs to preempt others
+	MinPriority int
+	Policy      string
+}
+
+// preemptible registers a running job as one that can be preempted,
+// returning a channel that is closed if it is
+func (r *Runner) preemptible(job buildkite.VmkiteJob) chan struct{} {
+	r.Lock()
+	defer r.Unlock()
+	ch := make(chan struct{})
+	r.preempt[job.ID] = ch
+	return ch
+}
+
+func (r *Runner) notPreemptible(job buildkite.VmkiteJob) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.preempt, job.ID)
+}
+
+// preemptFor stops a lower priority running job to free a worker for an
+// urgent job, if preemption is enabled and all workers are busy
+func (r *Runner) preemptFor(job buildkite.VmkiteJob, busy int) {
+	p := r.params.Preemption
+	if !p.Enabled || job.Priority < p.MinPriority || busy < r.params.Concurrency {
+		return
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	var victim *jobState
+	for _, js := range r.state.Snapshot().Active {
+		js := js
+		if _, ok := r.preempt[js.Job.ID]; !ok || js.Job.Priority >= job.Priority {
+			continue
+		}
+		if victim == nil || betterVictim(p.Policy, js, *victim) {
+			victim = &js
+		}
+	}
+	if victim == nil {
+		debugf("No running job to preempt for %s (priority %d)", job.String(), job.Priority)
+		return
+	}
+
+	debugf("Preempting %s (priority %d) on %s for %s (priority %d)",
+		victim.Job.String(), victim.Job.Priority, victim.VMName, job.String(), job.Priority)
+	close(r.preempt[victim.Job.ID])
+	delete(r.preempt, victim.Job.ID)
+	r.state.Preempted()
+}
+
+// betterVictim returns whether a is a better job to preempt than b
+func betterVictim(policy string, a, b jobState) bool {
+	if policy != PreemptNewest && a.Job.Priority != b.Job.Priority {
+		return a.Job.Priority < b.Job.Priority
+	}
+	return a.PhaseChanged.After(b.PhaseChanged)
+}
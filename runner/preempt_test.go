@@ -0,0 +1,125 @@
+package runner
+
+import (
+	"testing"
+	"time"
+
+	"github.com/macstadium/vmkite/buildkite"
+)
+
+func TestBetterVictim(t *testing.T) {
+	older := jobState{Job: testJob("older", "app", 1, 0), PhaseChanged: epoch}
+	newer := jobState{Job: testJob("newer", "app", 1, 0), PhaseChanged: epoch.Add(time.Minute)}
+	lowOld := jobState{Job: testJob("low-old", "app", 0, 0), PhaseChanged: epoch}
+
+	tests := []struct {
+		policy string
+		a, b   jobState
+		want   bool
+	}{
+		{PreemptLowestPriority, lowOld, newer, true},
+		{PreemptLowestPriority, newer, lowOld, false},
+		{PreemptLowestPriority, newer, older, true},
+		{PreemptLowestPriority, older, newer, false},
+		{PreemptNewest, newer, lowOld, true},
+		{PreemptNewest, lowOld, newer, false},
+	}
+	for _, test := range tests {
+		if got := betterVictim(test.policy, test.a, test.b); got != test.want {
+			t.Errorf("betterVictim(%s, %s, %s) = %v, want %v",
+				test.policy, test.a.Job.ID, test.b.Job.ID, got, test.want)
+		}
+	}
+}
+
+func TestPreemptFor(t *testing.T) {
+	// running jobs, started a minute apart in this order
+	running := []buildkite.VmkiteJob{
+		testJob("p1-first", "app", 1, 0),
+		testJob("p0-second", "app", 0, 0),
+		testJob("p1-third", "app", 1, 0),
+		testJob("p5-fourth", "app", 5, 0),
+	}
+
+	tests := []struct {
+		name    string
+		params  PreemptionParams
+		urgent  buildkite.VmkiteJob
+		busy    int
+		victim  string
+		victims int
+	}{
+		{
+			name:    "lowest priority",
+			params:  PreemptionParams{Enabled: true, MinPriority: 3, Policy: PreemptLowestPriority},
+			urgent:  testJob("urgent", "app", 3, 0),
+			busy:    4,
+			victim:  "p0-second",
+			victims: 1,
+		},
+		{
+			name:    "newest lower priority",
+			params:  PreemptionParams{Enabled: true, MinPriority: 3, Policy: PreemptNewest},
+			urgent:  testJob("urgent", "app", 3, 0),
+			busy:    4,
+			victim:  "p1-third",
+			victims: 1,
+		},
+		{
+			name:   "not urgent enough",
+			params: PreemptionParams{Enabled: true, MinPriority: 3},
+			urgent: testJob("urgent", "app", 2, 0),
+			busy:   4,
+		},
+		{
+			name:   "free worker",
+			params: PreemptionParams{Enabled: true, MinPriority: 3},
+			urgent: testJob("urgent", "app", 9, 0),
+			busy:   3,
+		},
+		{
+			name:   "disabled",
+			params: PreemptionParams{MinPriority: 3},
+			urgent: testJob("urgent", "app", 9, 0),
+			busy:   4,
+		},
+		{
+			name:   "nothing lower",
+			params: PreemptionParams{Enabled: true},
+			urgent: testJob("urgent", "app", 0, 0),
+			busy:   4,
+		},
+	}
+
+	for _, test := range tests {
+		r := newRunner(nil, nil, "acme", Params{Concurrency: 4, Preemption: test.params})
+		channels := map[string]chan struct{}{}
+		for i, job := range running {
+			r.state.Queued(job)
+			r.state.SetPhase(job, phaseRunning)
+			r.state.jobs[job.ID].PhaseChanged = epoch.Add(time.Duration(i) * time.Minute)
+			channels[job.ID] = r.preemptible(job)
+		}
+
+		r.preemptFor(test.urgent, test.busy)
+
+		preempted := []string{}
+		for id, ch := range channels {
+			select {
+			case <-ch:
+				preempted = append(preempted, id)
+			default:
+			}
+		}
+		if len(preempted) != test.victims {
+			t.Errorf("%s: preempted %v, want %d jobs", test.name, preempted, test.victims)
+			continue
+		}
+		if test.victims > 0 && preempted[0] != test.victim {
+			t.Errorf("%s: preempted %s, want %s", test.name, preempted[0], test.victim)
+		}
+		if snap := r.state.Snapshot(); snap.Preemptions != test.victims {
+			t.Errorf("%s: %d preemptions counted, want %d", test.name, snap.Preemptions, test.victims)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package runner
+
+import (
+	"errors"
+	"time"
+
+	"github.com/macstadium/vmkite/buildkite"
+	"github.com/macstadium/vmkite/creator"
+	"github.com/macstadium/vmkite/eventlog"
+)
+
+// maxRequeues is how many times a job waits for capacity or for its VM name
+// to be free before it is given up on
+const maxRequeues = 20
+
+// requeueError is a provisioning failure that should clear up by itself, like
+// every datastore being full or another job's VM having the same name, so the
+// job is put back in the queue instead of being failed
+type requeueError struct {
+	error
+}
+
+// shouldRequeue returns whether a job that couldn't get a VM because of err
+// should wait and try again, counting its attempts
+func (r *Runner) shouldRequeue(job buildkite.VmkiteJob, err error) bool {
+	_, collision := err.(vmNameCollision)
+	if err != creator.ErrNoDatastoreCapacity && !collision {
+		return false
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	if r.requeues[job.ID] >= maxRequeues {
+		debugf("job %s has been requeued %d times, giving up", job.ID, r.requeues[job.ID])
+		delete(r.requeues, job.ID)
+		return false
+	}
+	r.requeues[job.ID]++
+	return true
+}
+
+// requeue puts a job back in the queue after requeueDelay
+func (r *Runner) requeue(sched *scheduler, job buildkite.VmkiteJob, err error) {
+	debugf("requeueing job %s in %v: %v", job.ID, r.requeueDelay, err)
+	r.state.SetPhase(job, phaseQueued)
+	r.record(eventlog.Queued, job, eventlog.Event{Error: err.Error()})
+	sched.Requeueing(job)
+	time.AfterFunc(r.requeueDelay, func() {
+		if !sched.Requeue(job) {
+			debugf("dropping job %s, the runner stopped before it was requeued", job.ID)
+			r.requeued(job)
+			r.finish(job, errRequeueDropped)
+		}
+	})
+}
+
+// errRequeueDropped is the outcome of a job waiting to be requeued when the
+// runner stops taking jobs
+var errRequeueDropped = errors.New("Runner stopped before the job was requeued")
+
+// withdraw drops a job that is no longer scheduled in Buildkite if it is
+// still waiting for a worker
+func (r *Runner) withdraw(sched *scheduler, id string) {
+	job, ok := sched.Remove(id)
+	if !ok {
+		return
+	}
+	debugf("dropping job %s, it is no longer scheduled in Buildkite", id)
+	r.requeued(job)
+	r.finish(job, nil)
+}
+
+// requeued forgets the attempts of a job that got a VM or was failed
+func (r *Runner) requeued(job buildkite.VmkiteJob) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.requeues, job.ID)
+}
@@ -5,67 +5,253 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/macstadium/vmkite/buildkite"
+	"github.com/macstadium/vmkite/capacity"
 	"github.com/macstadium/vmkite/creator"
+	"github.com/macstadium/vmkite/eventlog"
+	"github.com/macstadium/vmkite/images"
 	"github.com/macstadium/vmkite/vsphere"
 )
 
 type Params struct {
 	Pipelines      []string
+	JobSource      string
 	Concurrency    int
 	ApiListenOn    string
 	ApiTokenSecret string
+	// OperatorToken protects the dashboard and event stream, which are
+	// disabled without it
+	OperatorToken  string
+	CreatorOptions creator.Options
+	// Secrets are delivered to each VM through the bootstrap API, along
+	// with its Buildkite agent token
+	Secrets map[string]string
+	// AgentToken is the Buildkite agent token given to VMs
+	AgentToken string
+	// PipelineAgentTokens override the agent token for jobs from a pipeline
+	PipelineAgentTokens map[string]string
+	// AgentPriority is the priority given to the agent in each VM
+	AgentPriority int
+	// Profiles map jobs without vmkite-* rules to VMs
+	Profiles []buildkite.Profile
+	// Scheduler controls which queued job runs next
+	Scheduler SchedulerParams
+	// Preemption lets urgent jobs take the place of running ones
+	Preemption PreemptionParams
+	// Stats records job arrivals and VM boot and run times, if set
+	Stats *capacity.Stats
+	// DryRun logs the VMs that would be created instead of creating them,
+	// pretending each job takes DryRunJobDuration
+	DryRun            bool
+	DryRunJobDuration time.Duration
+	// DiagnosticsDir is where to save a screenshot and logs of VMs that
+	// fail, in a directory per job, if set
+	DiagnosticsDir string
+	// KeepOnFailure keeps the VMs of failed jobs for debugging
+	KeepOnFailure KeepParams
+	// Annotate is which builds to annotate: AnnotateNone, AnnotateFailures
+	// or AnnotateAll
+	Annotate string
+	// Events records what happens to each job, if set
+	Events *eventlog.Log
+}
+
+// buildkiteAPI is the part of the Buildkite API the runner uses
+type buildkiteAPI interface {
+	PollJobs(query buildkite.VmkiteJobQueryParams) chan buildkite.VmkiteJob
+	FailJob(agentToken string, job buildkite.VmkiteJob, message string) error
+	PreemptJob(job buildkite.VmkiteJob) (string, error)
+	Annotate(job buildkite.VmkiteJob, context string, style string, body string) error
+	JobState(job buildkite.VmkiteJob) (string, error)
 }
 
 type Runner struct {
-	vs     *vsphere.Session
-	bk     *buildkite.Session
-	params Params
+	sync.Mutex
+
+	vs         *vsphere.Session
+	bk         buildkiteAPI
+	api        *api
+	params     Params
+	state      *state
+	agentToken string
+	// operator token, copied from params so it can be updated
+	operatorToken string
+	// per-pipeline agent tokens, copied from params so they can be updated
+	pipelineTokens map[string]string
+	// secrets for VMs, copied from params so they can be updated
+	secrets map[string]string
+	// running jobs that can be preempted, see preemptible
+	preempt map[string]chan struct{}
+	// how many VMs of failed jobs are being kept, see reserveHold
+	held int
+	// how many times jobs have been requeued, see shouldRequeue
+	requeues map[string]int
+
+	// provision returns the VM to run a job on, replaced in benchmarks
+	provision func(vsphere.VirtualMachineCreationParams, buildkite.VmkiteJob) (jobVM, error)
+	// finished is called with the outcome of each job, if set
+	finished     func(buildkite.VmkiteJob, error)
+	pollInterval time.Duration
+	jobTimeout   time.Duration
+	requeueDelay time.Duration
 }
 
 func NewRunner(vs *vsphere.Session, bk *buildkite.Session, p Params) *Runner {
-	return &Runner{
-		vs:     vs,
-		bk:     bk,
-		params: p,
+	return newRunner(vs, bk, bk.Org, p)
+}
+
+func newRunner(vs *vsphere.Session, bk buildkiteAPI, org string, p Params) *Runner {
+	pipelineTokens := map[string]string{}
+	for pipeline, token := range p.PipelineAgentTokens {
+		pipelineTokens[pipeline] = token
+	}
+	secrets := map[string]string{}
+	for key, val := range p.Secrets {
+		secrets[key] = val
 	}
+	r := &Runner{
+		vs:             vs,
+		bk:             bk,
+		params:         p,
+		state:          newState(org),
+		agentToken:     p.AgentToken,
+		operatorToken:  p.OperatorToken,
+		pipelineTokens: pipelineTokens,
+		secrets:        secrets,
+		preempt:        map[string]chan struct{}{},
+		requeues:       map[string]int{},
+		pollInterval:   time.Second,
+		jobTimeout:     time.Minute * 5,
+		requeueDelay:   time.Second * 30,
+	}
+	r.provision = r.provisionVMForJob
+	return r
+}
+
+// UpdateAgentToken changes the Buildkite agent token given to new VMs
+func (r *Runner) UpdateAgentToken(token string) {
+	r.Lock()
+	defer r.Unlock()
+	r.agentToken = token
+}
+
+// UpdateOperatorToken changes the token for the dashboard and event stream
+func (r *Runner) UpdateOperatorToken(token string) {
+	r.Lock()
+	defer r.Unlock()
+	r.operatorToken = token
+}
+
+// currentOperatorToken returns the token for the dashboard and event stream
+func (r *Runner) currentOperatorToken() string {
+	r.Lock()
+	defer r.Unlock()
+	return r.operatorToken
+}
+
+// UpdatePipelineAgentToken changes the agent token given to new VMs for jobs
+// from a pipeline
+func (r *Runner) UpdatePipelineAgentToken(pipeline, token string) {
+	r.Lock()
+	defer r.Unlock()
+	r.pipelineTokens[pipeline] = token
+}
+
+// UpdateSecret changes the value of a secret given to new VMs
+func (r *Runner) UpdateSecret(key, val string) {
+	r.Lock()
+	defer r.Unlock()
+	r.secrets[key] = val
+}
+
+// vmSecrets returns a copy of the secrets given to new VMs
+func (r *Runner) vmSecrets() map[string]string {
+	r.Lock()
+	defer r.Unlock()
+	secrets := map[string]string{}
+	for key, val := range r.secrets {
+		secrets[key] = val
+	}
+	return secrets
+}
+
+// agentTokenFor returns the agent token for a job's pipeline, falling back
+// to the global agent token
+func (r *Runner) agentTokenFor(job buildkite.VmkiteJob) string {
+	r.Lock()
+	defer r.Unlock()
+	if token, ok := r.pipelineTokens[job.Pipeline]; ok {
+		return token
+	}
+	return r.agentToken
 }
 
 func (r *Runner) Run(createParams vsphere.VirtualMachineCreationParams) error {
 	var wg sync.WaitGroup
 
-	api, err := newApiListener(r.params.ApiListenOn, r.params.ApiTokenSecret)
+	api, err := newApiListener(r.params.ApiListenOn, r.params.ApiTokenSecret, r.currentOperatorToken, r.state, r.params.Events)
 	if err != nil {
 		return err
 	}
+	r.api = api
 
-	jobs := r.bk.PollJobs(buildkite.VmkiteJobQueryParams{
+	withdrawn := make(chan string)
+	polled := r.bk.PollJobs(buildkite.VmkiteJobQueryParams{
+		Source:    r.params.JobSource,
 		Pipelines: r.params.Pipelines,
+		Profiles:  r.params.Profiles,
+		Withdrawn: func(id string) { withdrawn <- id },
 	})
 
+	// record jobs as queued until the scheduler gives them to a worker, and
+	// drop them if they stop being scheduled before then
+	sched := newScheduler(r.params.Scheduler)
+	go func() {
+		for {
+			select {
+			case job, ok := <-polled:
+				if !ok {
+					sched.Close()
+					return
+				}
+				r.record(eventlog.Seen, job, eventlog.Event{})
+				r.state.Queued(job)
+				if r.params.DryRun {
+					dryRunf("queued %s (priority %d, %d already waiting)", job.String(), job.Priority, sched.Queued())
+				}
+				if r.params.Stats != nil {
+					r.params.Stats.Arrival(job.TemplateName(), queuedAt(job))
+				}
+				sched.Push(job)
+				r.record(eventlog.Queued, job, eventlog.Event{})
+				r.preemptFor(job, sched.Running())
+			case id := <-withdrawn:
+				r.withdraw(sched, id)
+			}
+		}
+	}()
+
 	for i := 0; i < r.params.Concurrency; i++ {
 		debugf("spawning runner %d", i+1)
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			for job := range jobs {
-				token, ch, err := api.Subscribe(job)
-				if err != nil {
-					debugf("Error subscribing to hook events: %v", err)
-					continue
+			for {
+				job, ok := sched.Next()
+				if !ok {
+					return
 				}
-
-				createParams.GuestInfo["vmkite-api"] = api.Addr().String()
-				createParams.GuestInfo["vmkite-api-token"] = token
-
-				if err := r.runJob(createParams, job, ch); err != nil {
-					debugf("Error running job: %v", err)
+				r.record(eventlog.Assigned, job, eventlog.Event{})
+				err := r.runQueuedJob(api, createParams, job)
+				sched.Done(job)
+				if rerr, ok := err.(requeueError); ok {
+					r.requeue(sched, job, rerr.error)
 				}
-
-				api.Release(job)
 			}
 		}()
 	}
@@ -74,18 +260,142 @@ func (r *Runner) Run(createParams vsphere.VirtualMachineCreationParams) error {
 	return nil
 }
 
+// runQueuedJob delivers a job's secrets and runs it, recording the outcome.
+// It returns a requeueError instead if the job should wait for capacity.
+func (r *Runner) runQueuedJob(api *api, createParams vsphere.VirtualMachineCreationParams, job buildkite.VmkiteJob) error {
+	token, ch, err := api.Subscribe(job)
+	if err != nil {
+		debugf("Error subscribing to hook events: %v", err)
+		r.finish(job, err)
+		return err
+	}
+
+	// each job gets its own guestinfo, workers share createParams
+	jobParams := createParams
+	jobParams.GuestInfo = map[string]string{}
+	for k, v := range createParams.GuestInfo {
+		jobParams.GuestInfo[k] = v
+	}
+	secrets := map[string]string{
+		"buildkite-agent-token": r.agentTokenFor(job),
+		"vmkite-api-token":      token,
+	}
+	for k, v := range r.vmSecrets() {
+		secrets[k] = v
+	}
+	bootstrapToken, err := api.IssueBootstrap(job, secrets)
+	if err != nil {
+		debugf("Error issuing bootstrap token: %v", err)
+		r.finish(job, err)
+		api.Release(job)
+		return err
+	}
+
+	jobParams.GuestInfo["vmkite-api"] = api.Addr().String()
+	jobParams.GuestInfo["vmkite-bootstrap-token"] = bootstrapToken
+	jobParams.GuestInfo["vmkite-agent-name"] = job.VMName()
+	jobParams.GuestInfo["vmkite-agent-tags"] = strings.Join(job.AgentTags(), ",")
+	jobParams.GuestInfo["vmkite-agent-priority"] = strconv.Itoa(r.params.AgentPriority)
+	jobParams.GuestInfo["vmkite-agent-acquire-job"] = job.ID
+
+	err = r.runJob(jobParams, job, ch)
+	api.Release(job)
+	if _, ok := err.(requeueError); ok {
+		return err
+	}
+	if err != nil {
+		debugf("Error running job: %v", err)
+	}
+	r.finish(job, err)
+	return err
+}
+
+// finish records the outcome of a job
+func (r *Runner) finish(job buildkite.VmkiteJob, err error) {
+	r.state.Finished(job, err)
+	if err != nil {
+		r.record(eventlog.Failed, job, eventlog.Event{Error: err.Error()})
+	} else {
+		r.record(eventlog.Finished, job, eventlog.Event{})
+	}
+	if r.finished != nil {
+		r.finished(job, err)
+	}
+}
+
+// record adds an event for a job to the event log, if there is one
+func (r *Runner) record(eventType string, job buildkite.VmkiteJob, e eventlog.Event) {
+	if r.params.Events == nil {
+		return
+	}
+	e.Type = eventType
+	e.JobID = job.ID
+	e.Job = job.String()
+	r.params.Events.Record(e)
+}
+
 func (r *Runner) runJob(createParams vsphere.VirtualMachineCreationParams, job buildkite.VmkiteJob, events chan apiHookEvent) error {
 	debugf("running job %v", job.ID)
-	vm, err := r.createVMForJob(createParams, job)
+	r.state.SetPhase(job, phaseCreating)
+	creating := time.Now()
+	vm, err := r.provision(createParams, job)
+	if err != nil && r.shouldRequeue(job, err) {
+		return requeueError{err}
+	}
+	r.requeued(job)
 	if err != nil {
+		r.reportProvisionFailure(job, err)
+		msg := fmt.Sprintf("Failed to provision VM %s: %v", job.VMName(), err)
+		if _, collision := err.(vmNameCollision); collision {
+			// the job did nothing wrong, leave it for another agent
+			debugf("Giving up on job %s without failing it: %v", job.ID, err)
+		} else if r.params.DryRun {
+			dryRunf("would fail job %s: %s", job.String(), msg)
+		} else if ferr := r.bk.FailJob(r.agentTokenFor(job), job, msg); ferr != nil {
+			debugf("Error failing job %s: %v", job.ID, ferr)
+		}
 		return err
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
+	vmName := job.VMName()
+	host, err := vm.HostName()
+	if err != nil {
+		debugf("Error finding host for %s: %v", vmName, err)
+	}
+	r.state.SetVM(job, vmName, host)
+	r.record(eventlog.VMCreated, job, eventlog.Event{VM: vmName, Host: host})
+
+	// an adopted VM, or one that failed to power on, may not be running, so
+	// only record it powered on once it's seen to be
+	sawPoweredOn := false
+	checkPoweredOn := func() (bool, error) {
+		poweredOn, err := vm.IsPoweredOn()
+		if err == nil && poweredOn && !sawPoweredOn {
+			sawPoweredOn = true
+			r.record(eventlog.PoweredOn, job, eventlog.Event{VM: vmName, Host: host})
+		}
+		return poweredOn, err
+	}
+	if _, err := checkPoweredOn(); err != nil {
+		debugf("Error checking whether %s is powered on: %v", vmName, err)
+	}
+	r.state.SetPhase(job, phaseRunning)
+	running := time.Now()
+	if r.params.Stats != nil {
+		r.params.Stats.Boot(job.TemplateName(), running.Sub(creating))
+	}
+	r.reportVM(job, newVMReport(vm, job, host, running.Sub(creating), creating.Sub(queuedAt(job))))
+
+	preempted := r.preemptible(job)
+	defer r.notPreemptible(job)
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.jobTimeout)
 	defer cancel()
 
 	debugf("waiting for job %v to finish", job.ID)
-	ticker := time.NewTicker(time.Second * 1)
+	var mismatch error
+	hooks := 0
+	ticker := time.NewTicker(r.pollInterval)
 	defer ticker.Stop()
 
 	for {
@@ -93,37 +403,129 @@ func (r *Runner) runJob(createParams vsphere.VirtualMachineCreationParams, job b
 		case event := <-events:
 			debugf("read event %s from job %s (%v after job created)",
 				event.Event, event.JobID, event.Timestamp.Sub(job.CreatedAt))
+			r.record(eventlog.Hook, job, eventlog.Event{VM: vmName, Hook: event.Event, ExitStatus: event.ExitStatus})
+			hooks++
+
+			// the agent should only ever run the job its VM was created for
+			if event.RanJobID != "" && event.RanJobID != job.ID {
+				mismatch = fmt.Errorf("vm %s ran job %s instead of %s", vmName, event.RanJobID, job.ID)
+				debugf("%v", mismatch)
+			}
+
+			// the VM asks whether to stay powered on after a failed job,
+			// or once its job has finished
+			if event.keep != nil {
+				failure, kept := r.reserveHold(job, event)
+				event.keep <- kept
+				if kept {
+					if r.params.Stats != nil {
+						r.params.Stats.Run(job.TemplateName(), time.Since(running))
+					}
+					r.hold(vm, job)
+					return fmt.Errorf("Job failed with %s, keeping VM %s for debugging", failure, vmName)
+				}
+			}
+
+		case <-preempted:
+			r.record(eventlog.Preempted, job, eventlog.Event{VM: vmName})
+			r.state.SetPhase(job, phaseDestroying)
+			if r.params.DryRun {
+				dryRunf("would cancel and retry job %s", job.String())
+			} else if retry, err := r.bk.PreemptJob(job); err != nil {
+				debugf("Error preempting job %s: %v", job.ID, err)
+			} else {
+				debugf("job %s will be retried as %s", job.ID, retry)
+			}
+			if err := vm.Destroy(true); err != nil {
+				return err
+			}
+			r.record(eventlog.Destroyed, job, eventlog.Event{VM: vmName})
+			return errPreempted
 
 		case <-ticker.C:
-			poweredOn, err := vm.IsPoweredOn()
+			poweredOn, err := checkPoweredOn()
 			if err != nil {
 				return fmt.Errorf("vm.IsPoweredOn failed: %v", err)
 			}
 
 			if !poweredOn {
+				r.record(eventlog.PoweredOff, job, eventlog.Event{VM: vmName})
+				if r.params.Stats != nil {
+					r.params.Stats.Run(job.TemplateName(), time.Since(running))
+				}
+				// a VM that powers off without calling any hook never got
+				// as far as running the agent
+				if mismatch != nil || hooks == 0 {
+					if hooks == 0 {
+						debugf("vm %s powered off without calling any hooks", vmName)
+					}
+					r.captureDiagnostics(vm, job)
+				}
 				debugf("VM is powered off, destroying")
-				return vm.Destroy(true)
+				r.state.SetPhase(job, phaseDestroying)
+				if err := vm.Destroy(true); err != nil {
+					return err
+				}
+				r.record(eventlog.Destroyed, job, eventlog.Event{VM: vmName})
+				return mismatch
 			}
 
 		case <-ctx.Done():
+			r.record(eventlog.TimedOut, job, eventlog.Event{VM: vmName})
+			r.captureDiagnostics(vm, job)
+			r.state.SetPhase(job, phaseDestroying)
+			if err := vm.Destroy(true); err != nil {
+				debugf("Error destroying %s: %v", vmName, err)
+			} else {
+				r.record(eventlog.Destroyed, job, eventlog.Event{VM: vmName})
+			}
 			return errors.New("Timed out waiting for VM power-off")
 		}
 	}
 }
 
+// provisionVMForJob returns the VM to run a job on, only pretending to
+// create it in a dry run
+func (r *Runner) provisionVMForJob(createParams vsphere.VirtualMachineCreationParams, job buildkite.VmkiteJob) (jobVM, error) {
+	if r.params.DryRun {
+		return r.planVMForJob(createParams, job)
+	}
+	vm, err := r.createVMForJob(createParams, job)
+	if err != nil {
+		return nil, err
+	}
+	return vm, nil
+}
+
 func (r *Runner) createVMForJob(createParams vsphere.VirtualMachineCreationParams, job buildkite.VmkiteJob) (*vsphere.VirtualMachine, error) {
 	if existing, err := r.vs.VirtualMachine(job.VMName()); err == nil {
-		debugf("vm %s already exists, skipping create", existing.Name)
-		return existing, nil
+		adopt, err := r.canAdoptVM(existing, job)
+		if err != nil {
+			return nil, err
+		}
+		if adopt {
+			debugf("vm %s already exists, skipping create", existing.Name)
+			return existing, nil
+		}
+		debugf("vm %s already exists but is unhealthy, destroying", existing.Name)
+		if err := existing.Destroy(true); err != nil {
+			return nil, err
+		}
+	}
+
+	srcDiskPath, err := images.Resolve(r.vs, createParams.SrcDiskDataStore, job.Metadata.VMDK)
+	if err != nil {
+		return nil, err
 	}
 
 	// add parameters from the job
-	createParams.SrcDiskPath = job.Metadata.VMDK
+	createParams.SrcDiskPath = srcDiskPath
 	createParams.GuestID = job.Metadata.GuestID
 	createParams.Name = job.VMName()
+	createParams.JobID = job.ID
 
 	debugf("createVM(%s) => %s %s", job.String(), job.Metadata.VMDK, job.Metadata.GuestID)
-	vm, err := creator.CreateVM(r.vs, createParams)
+	vm, err := creator.CreateVM(r.vs, createParams, r.params.CreatorOptions)
 	if err != nil {
 		return nil, err
 	}
@@ -132,6 +534,32 @@ func (r *Runner) createVMForJob(createParams vsphere.VirtualMachineCreationParam
 	return vm, nil
 }
 
+// vmNameCollision is returned when a job's VM name is taken by the VM of a
+// different job. It is a problem with that VM rather than the job, so the
+// job waits for the name to be free instead of failing.
+type vmNameCollision struct {
+	VM    string
+	Owner string
+	JobID string
+}
+
+func (e vmNameCollision) Error() string {
+	return fmt.Sprintf("vm %s exists but belongs to job %q, not %s", e.VM, e.Owner, e.JobID)
+}
+
+// canAdoptVM checks whether an existing VM was created for job and is still
+// running, returning a vmNameCollision if it belongs to a different job
+func (r *Runner) canAdoptVM(vm *vsphere.VirtualMachine, job buildkite.VmkiteJob) (bool, error) {
+	jobID, err := vm.GuestInfo("vmkite-job-id")
+	if err != nil {
+		return false, err
+	}
+	if jobID != job.ID {
+		return false, vmNameCollision{VM: vm.Name, Owner: jobID, JobID: job.ID}
+	}
+	return vm.IsHealthy()
+}
+
 func debugf(format string, data ...interface{}) {
 	log.Printf("[runner] "+format, data...)
 }
@@ -0,0 +1,291 @@
+package runner
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/macstadium/vmkite/buildkite"
+	"github.com/macstadium/vmkite/buildkite/buildkitetest"
+	"github.com/macstadium/vmkite/creator"
+	"github.com/macstadium/vmkite/eventlog"
+	"github.com/macstadium/vmkite/vsphere"
+)
+
+// testVM powers off at a set time, or never if it is hung
+type testVM struct {
+	sync.Mutex
+	hung      bool
+	poweroff  time.Time
+	destroyed bool
+	captured  string
+}
+
+func (vm *testVM) HostName() (string, error) {
+	return "esxi-1", nil
+}
+
+func (vm *testVM) IsPoweredOn() (bool, error) {
+	vm.Lock()
+	defer vm.Unlock()
+	return !vm.destroyed && (vm.hung || time.Now().Before(vm.poweroff)), nil
+}
+
+func (vm *testVM) Destroy(force bool) error {
+	vm.Lock()
+	defer vm.Unlock()
+	vm.destroyed = true
+	return nil
+}
+
+func (vm *testVM) CaptureDiagnostics(dir string) ([]string, error) {
+	vm.Lock()
+	defer vm.Unlock()
+	vm.captured = dir
+	return nil, nil
+}
+
+func (vm *testVM) capturedTo() string {
+	vm.Lock()
+	defer vm.Unlock()
+	return vm.captured
+}
+
+func (vm *testVM) isDestroyed() bool {
+	vm.Lock()
+	defer vm.Unlock()
+	return vm.destroyed
+}
+
+// newStubSession returns a Buildkite session talking to a stub, which the
+// caller should Close
+func newStubSession(t *testing.T) (*buildkite.Session, *buildkitetest.Server) {
+	stub := buildkitetest.NewServer("acme")
+	bk, err := buildkite.NewSession("acme", "api-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bk.SetAPIEndpoint(stub.URL); err != nil {
+		t.Fatal(err)
+	}
+	bk.AgentEndpoint = stub.AgentURL()
+	bk.PollInterval = time.Millisecond * 20
+	return bk, stub
+}
+
+func TestRunnerLoop(t *testing.T) {
+	bk, stub := newStubSession(t)
+	defer stub.Close()
+
+	rules := []string{"queue=macos", "vmkite-vmdk=macos/macos.vmdk", "vmkite-guestid=darwin16_64Guest"}
+	stub.SetJobs(
+		buildkitetest.Job{ID: "ok", Pipeline: "app", BuildNumber: 1, AgentQueryRules: rules},
+		buildkitetest.Job{ID: "hung", Pipeline: "app", BuildNumber: 2, AgentQueryRules: rules},
+		buildkitetest.Job{ID: "broken", Pipeline: "app", BuildNumber: 3, AgentQueryRules: rules},
+		buildkitetest.Job{ID: "full", Pipeline: "app", BuildNumber: 4, AgentQueryRules: rules},
+		buildkitetest.Job{ID: "dead", Pipeline: "app", BuildNumber: 5, AgentQueryRules: rules},
+	)
+
+	events, err := eventlog.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorded, stop := events.Subscribe()
+	defer stop()
+
+	r := newRunner(nil, bk, "acme", Params{
+		Concurrency:    4,
+		ApiListenOn:    "127.0.0.1:0",
+		AgentToken:     buildkitetest.AgentToken,
+		Annotate:       AnnotateFailures,
+		DiagnosticsDir: "/diagnostics",
+		Events:         events,
+	})
+	r.pollInterval = time.Millisecond * 10
+	r.jobTimeout = time.Millisecond * 300
+	r.requeueDelay = time.Millisecond * 10
+
+	var mu sync.Mutex
+	vms := map[string]*testVM{}
+	provisioned := map[string]int{}
+	r.provision = func(params vsphere.VirtualMachineCreationParams, job buildkite.VmkiteJob) (jobVM, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		provisioned[job.ID]++
+		if params.GuestInfo["vmkite-agent-acquire-job"] != job.ID || params.GuestInfo["vmkite-bootstrap-token"] == "" {
+			t.Errorf("%s: guestinfo = %v", job.ID, params.GuestInfo)
+		}
+		switch {
+		case job.ID == "broken":
+			return nil, errors.New("InsufficientHostCapacityFault")
+		case job.ID == "full" && provisioned[job.ID] == 1:
+			return nil, creator.ErrNoDatastoreCapacity
+		}
+		vm := &testVM{hung: job.ID == "hung", poweroff: time.Now().Add(time.Millisecond * 50)}
+		if job.ID == "dead" {
+			// never powers on
+			vm.poweroff = time.Now()
+		}
+		vms[job.ID] = vm
+		return vm, nil
+	}
+
+	results := make(chan error, 10)
+	outcomes := map[string]error{}
+	r.finished = func(job buildkite.VmkiteJob, err error) {
+		mu.Lock()
+		outcomes[job.ID] = err
+		mu.Unlock()
+		results <- err
+	}
+
+	go r.Run(vsphere.VirtualMachineCreationParams{GuestInfo: map[string]string{}})
+
+	for i := 0; i < 5; i++ {
+		select {
+		case <-results:
+		case <-time.After(time.Second * 5):
+			t.Fatalf("only %d of 5 jobs finished: %v", i, outcomes)
+		}
+	}
+
+	poweredOn := map[string]bool{}
+	for len(recorded) > 0 {
+		if e := <-recorded; e.Type == eventlog.PoweredOn {
+			poweredOn[e.JobID] = true
+		}
+	}
+	for _, id := range []string{"ok", "hung", "full"} {
+		if !poweredOn[id] {
+			t.Errorf("%s: powered-on wasn't recorded", id)
+		}
+	}
+	if poweredOn["dead"] || poweredOn["broken"] {
+		t.Error("powered-on recorded for a VM that never powered on")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if err := outcomes["ok"]; err != nil {
+		t.Errorf("ok: %v", err)
+	}
+	if err := outcomes["dead"]; err != nil {
+		t.Errorf("dead: %v", err)
+	}
+	if err := outcomes["full"]; err != nil {
+		t.Errorf("full: %v", err)
+	}
+	if provisioned["full"] != 2 {
+		t.Errorf("full: provisioned %d times, want 2 after being requeued", provisioned["full"])
+	}
+	if err := outcomes["hung"]; err == nil || err.Error() != "Timed out waiting for VM power-off" {
+		t.Errorf("hung: %v, want a timeout", err)
+	}
+	if err := outcomes["broken"]; err == nil {
+		t.Error("broken: no error")
+	}
+
+	// every VM is destroyed, whether it powered off or had to be reaped
+	for id, vm := range vms {
+		if !vm.isDestroyed() {
+			t.Errorf("%s: VM wasn't destroyed", id)
+		}
+	}
+
+	// none of the VMs called any hooks, so all are worth debugging
+	for _, id := range []string{"ok", "hung", "dead"} {
+		if dir := vms[id].capturedTo(); dir != "/diagnostics/"+id {
+			t.Errorf("%s: diagnostics captured to %q", id, dir)
+		}
+	}
+
+	// only the job that couldn't get a VM is failed in Buildkite
+	for _, id := range []string{"ok", "hung", "full", "dead"} {
+		if _, ok := stub.FinishedJob(id); ok {
+			t.Errorf("%s: failed in Buildkite", id)
+		}
+	}
+	if status, ok := stub.FinishedJob("broken"); !ok || status != "1" {
+		t.Errorf("broken: finished in Buildkite = %v with %q, want exit status 1", ok, status)
+	}
+	if annotations := stub.AnnotationsFor("app", 3); len(annotations) != 1 || annotations[0].Style != buildkite.AnnotationError {
+		t.Errorf("broken: annotations = %+v", annotations)
+	}
+
+	snap := r.state.Snapshot()
+	if len(snap.Active) != 0 || len(snap.Queued) != 0 {
+		t.Errorf("jobs left in state: %d active, %d queued", len(snap.Active), len(snap.Queued))
+	}
+	if len(snap.Failures) != 2 {
+		t.Errorf("%d failures recorded, want 2", len(snap.Failures))
+	}
+	if subscribers, auth, bootstraps := r.api.counts(); subscribers+auth+bootstraps != 0 {
+		t.Errorf("API leaked %d subscribers, %d auth tokens, %d bootstraps", subscribers, auth, bootstraps)
+	}
+}
+
+func TestRunnerDropsWithdrawnJobs(t *testing.T) {
+	bk, stub := newStubSession(t)
+	defer stub.Close()
+
+	rules := []string{"queue=macos", "vmkite-vmdk=macos/macos.vmdk", "vmkite-guestid=darwin16_64Guest"}
+	running := buildkitetest.Job{ID: "running", Pipeline: "app", BuildNumber: 1, AgentQueryRules: rules}
+	stub.SetJobs(
+		running,
+		buildkitetest.Job{ID: "cancelled", Pipeline: "app", BuildNumber: 2, AgentQueryRules: rules},
+	)
+
+	// one worker, busy with the first job until the test is done
+	r := newRunner(nil, bk, "acme", Params{
+		Concurrency: 1,
+		ApiListenOn: "127.0.0.1:0",
+		AgentToken:  buildkitetest.AgentToken,
+	})
+	r.pollInterval = time.Millisecond * 10
+	r.jobTimeout = time.Minute
+	vm := &testVM{hung: true}
+	defer vm.Destroy(true)
+	provisioned := make(chan string, 10)
+	r.provision = func(params vsphere.VirtualMachineCreationParams, job buildkite.VmkiteJob) (jobVM, error) {
+		provisioned <- job.ID
+		return vm, nil
+	}
+	finished := make(chan string, 10)
+	r.finished = func(job buildkite.VmkiteJob, err error) {
+		finished <- job.ID
+	}
+
+	go r.Run(vsphere.VirtualMachineCreationParams{GuestInfo: map[string]string{}})
+
+	if id := <-provisioned; id != "running" {
+		t.Fatalf("provisioned %s first, want the oldest job", id)
+	}
+	deadline := time.Now().Add(time.Second * 5)
+	for len(r.state.Snapshot().Queued) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("the second job was never queued")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	// the queued job is cancelled in Buildkite
+	stub.SetJobs(running)
+	select {
+	case id := <-finished:
+		if id != "cancelled" {
+			t.Errorf("finished %s, want the cancelled job", id)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("the cancelled job was never dropped")
+	}
+	if snap := r.state.Snapshot(); len(snap.Queued) != 0 || len(snap.Failures) != 0 {
+		t.Errorf("%d jobs queued, %d failures after dropping the cancelled job", len(snap.Queued), len(snap.Failures))
+	}
+	select {
+	case id := <-provisioned:
+		t.Errorf("provisioned %s after it was cancelled", id)
+	default:
+	}
+}
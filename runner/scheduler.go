@@ -0,0 +1,226 @@
+package runner
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/macstadium/vmkite/buildkite"
+)
+
+// SchedulerParams control the order jobs are given to workers in
+type SchedulerParams struct {
+	// PipelineWeights give pipelines a bigger share of VMs, the default is 1
+	PipelineWeights map[string]int
+	// PipelineTeams group pipelines into teams that share VMs between them
+	PipelineTeams map[string]string
+	// TeamWeights give teams a bigger share of VMs, the default is 1
+	TeamWeights map[string]int
+	// PipelineMaxVMs caps how many VMs a pipeline can have at once
+	PipelineMaxVMs map[string]int
+}
+
+// scheduler queues jobs between the poller and the workers. Higher priority
+// jobs go first; among equal priorities the team and then the pipeline using
+// the least of its share of running VMs goes next, oldest job first.
+type scheduler struct {
+	sync.Mutex
+	cond *sync.Cond
+
+	params      SchedulerParams
+	queue       []buildkite.VmkiteJob
+	running     map[string]int
+	teamRunning map[string]int
+	// jobs waiting to be put back in the queue, see Requeueing
+	requeueing map[string]buildkite.VmkiteJob
+	closed     bool
+}
+
+func newScheduler(p SchedulerParams) *scheduler {
+	s := &scheduler{
+		params:      p,
+		running:     map[string]int{},
+		teamRunning: map[string]int{},
+		requeueing:  map[string]buildkite.VmkiteJob{},
+	}
+	s.cond = sync.NewCond(&s.Mutex)
+	return s
+}
+
+// Push adds a job to the queue
+func (s *scheduler) Push(job buildkite.VmkiteJob) {
+	s.Lock()
+	defer s.Unlock()
+	s.queue = append(s.queue, job)
+	s.cond.Broadcast()
+}
+
+// Requeueing marks a job that will be put back in the queue with Requeue,
+// so that Remove can withdraw it meanwhile
+func (s *scheduler) Requeueing(job buildkite.VmkiteJob) {
+	s.Lock()
+	defer s.Unlock()
+	s.requeueing[job.ID] = job
+}
+
+// Requeue puts back a job marked with Requeueing, unless it was withdrawn
+// meanwhile. It returns false if the job was dropped because the scheduler
+// is closed.
+func (s *scheduler) Requeue(job buildkite.VmkiteJob) bool {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.requeueing[job.ID]; !ok {
+		return true
+	}
+	delete(s.requeueing, job.ID)
+	if s.closed {
+		return false
+	}
+	s.queue = append(s.queue, job)
+	s.cond.Broadcast()
+	return true
+}
+
+// Remove withdraws a job that is queued or waiting to be requeued, returning
+// false if it isn't, e.g. because a worker has taken it
+func (s *scheduler) Remove(id string) (buildkite.VmkiteJob, bool) {
+	s.Lock()
+	defer s.Unlock()
+	if job, ok := s.requeueing[id]; ok {
+		delete(s.requeueing, id)
+		return job, true
+	}
+	for i, job := range s.queue {
+		if job.ID == id {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			return job, true
+		}
+	}
+	return buildkite.VmkiteJob{}, false
+}
+
+// Close stops Next from blocking once the queue is empty
+func (s *scheduler) Close() {
+	s.Lock()
+	defer s.Unlock()
+	s.closed = true
+	s.cond.Broadcast()
+}
+
+// Next blocks until a job can run and takes it off the queue, returning
+// false once the scheduler is closed and drained. Done must be called when
+// the job is finished.
+func (s *scheduler) Next() (buildkite.VmkiteJob, bool) {
+	s.Lock()
+	defer s.Unlock()
+	for {
+		if i := s.pick(); i >= 0 {
+			job := s.queue[i]
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			s.running[job.Pipeline]++
+			s.teamRunning[s.team(job)]++
+			return job, true
+		}
+		if s.closed && len(s.queue) == 0 {
+			return buildkite.VmkiteJob{}, false
+		}
+		s.cond.Wait()
+	}
+}
+
+// Done frees the job's share for other jobs from its pipeline and team
+func (s *scheduler) Done(job buildkite.VmkiteJob) {
+	s.Lock()
+	defer s.Unlock()
+	s.running[job.Pipeline]--
+	s.teamRunning[s.team(job)]--
+	s.cond.Broadcast()
+}
+
+// Running returns how many jobs workers have taken from the queue
+func (s *scheduler) Running() int {
+	s.Lock()
+	defer s.Unlock()
+	n := 0
+	for _, count := range s.running {
+		n += count
+	}
+	return n
+}
+
+// Queued returns how many jobs are waiting for a worker
+func (s *scheduler) Queued() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.queue)
+}
+
+// pick returns the index of the next job to run, or -1 if none can run
+func (s *scheduler) pick() int {
+	candidates := []int{}
+	for i, job := range s.queue {
+		if max, ok := s.params.PipelineMaxVMs[job.Pipeline]; ok && s.running[job.Pipeline] >= max {
+			continue
+		}
+		candidates = append(candidates, i)
+	}
+	if len(candidates) == 0 {
+		return -1
+	}
+
+	sort.SliceStable(candidates, func(a, b int) bool {
+		ja, jb := s.queue[candidates[a]], s.queue[candidates[b]]
+		if ja.Priority != jb.Priority {
+			return ja.Priority > jb.Priority
+		}
+		ta, tb := s.team(ja), s.team(jb)
+		if ta != tb {
+			ua := usage(s.teamRunning[ta], s.teamWeight(ja))
+			ub := usage(s.teamRunning[tb], s.teamWeight(jb))
+			if ua != ub {
+				return ua < ub
+			}
+		}
+		if ja.Pipeline != jb.Pipeline {
+			ua := usage(s.running[ja.Pipeline], s.params.PipelineWeights[ja.Pipeline])
+			ub := usage(s.running[jb.Pipeline], s.params.PipelineWeights[jb.Pipeline])
+			if ua != ub {
+				return ua < ub
+			}
+		}
+		return queuedAt(ja).Before(queuedAt(jb))
+	})
+	return candidates[0]
+}
+
+// team returns the team a job's pipeline belongs to, pipelines without a
+// team are each a team of their own
+func (s *scheduler) team(job buildkite.VmkiteJob) string {
+	if team, ok := s.params.PipelineTeams[job.Pipeline]; ok {
+		return "team:" + team
+	}
+	return "pipeline:" + job.Pipeline
+}
+
+func (s *scheduler) teamWeight(job buildkite.VmkiteJob) int {
+	if team, ok := s.params.PipelineTeams[job.Pipeline]; ok {
+		return s.params.TeamWeights[team]
+	}
+	return s.params.PipelineWeights[job.Pipeline]
+}
+
+// queuedAt is when a job started waiting for an agent
+func queuedAt(job buildkite.VmkiteJob) time.Time {
+	if !job.ScheduledAt.IsZero() {
+		return job.ScheduledAt
+	}
+	return job.CreatedAt
+}
+
+// usage is how much of its share a pipeline or team is using
+func usage(running, weight int) float64 {
+	if weight <= 0 {
+		weight = 1
+	}
+	return float64(running) / float64(weight)
+}
@@ -0,0 +1,226 @@
+package runner
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/macstadium/vmkite/buildkite"
+)
+
+var epoch = time.Date(2017, 6, 1, 10, 0, 0, 0, time.UTC)
+
+// testJob is a job from a pipeline queued some minutes after epoch
+func testJob(id, pipeline string, priority, minutes int) buildkite.VmkiteJob {
+	return buildkite.VmkiteJob{
+		ID:          id,
+		Pipeline:    pipeline,
+		BuildNumber: "1",
+		Priority:    priority,
+		CreatedAt:   epoch.Add(time.Duration(minutes) * time.Minute),
+	}
+}
+
+func TestSchedulerOrder(t *testing.T) {
+	tests := []struct {
+		name   string
+		params SchedulerParams
+		// jobs already taken by workers, before the queue below
+		running []buildkite.VmkiteJob
+		queue   []buildkite.VmkiteJob
+		// how many jobs to take and the order they should come out in
+		want string
+	}{
+		{
+			name: "oldest first",
+			queue: []buildkite.VmkiteJob{
+				testJob("b", "app", 0, 2),
+				testJob("a", "app", 0, 1),
+				testJob("c", "app", 0, 3),
+			},
+			want: "a,b,c",
+		},
+		{
+			name: "higher priority first",
+			queue: []buildkite.VmkiteJob{
+				testJob("low", "app", 0, 1),
+				testJob("high", "app", 5, 3),
+				testJob("mid", "app", 1, 2),
+			},
+			want: "high,mid,low",
+		},
+		{
+			name: "pipelines take turns",
+			queue: []buildkite.VmkiteJob{
+				testJob("app-1", "app", 0, 1),
+				testJob("app-2", "app", 0, 2),
+				testJob("app-3", "app", 0, 3),
+				testJob("docs-1", "docs", 0, 4),
+				testJob("docs-2", "docs", 0, 5),
+			},
+			want: "app-1,docs-1,app-2,docs-2,app-3",
+		},
+		{
+			name:    "least used share first",
+			running: []buildkite.VmkiteJob{testJob("app-0", "app", 0, 0)},
+			queue: []buildkite.VmkiteJob{
+				testJob("app-1", "app", 0, 1),
+				testJob("docs-1", "docs", 0, 2),
+			},
+			want: "docs-1,app-1",
+		},
+		{
+			name:   "weights give bigger shares",
+			params: SchedulerParams{PipelineWeights: map[string]int{"app": 2}},
+			queue: []buildkite.VmkiteJob{
+				testJob("app-1", "app", 0, 1),
+				testJob("app-2", "app", 0, 2),
+				testJob("app-3", "app", 0, 3),
+				testJob("docs-1", "docs", 0, 4),
+				testJob("docs-2", "docs", 0, 5),
+			},
+			want: "app-1,docs-1,app-2,app-3,docs-2",
+		},
+		{
+			name: "teams share between their pipelines",
+			params: SchedulerParams{
+				PipelineTeams: map[string]string{"ios": "mobile", "android": "mobile"},
+			},
+			running: []buildkite.VmkiteJob{testJob("ios-0", "ios", 0, 0)},
+			queue: []buildkite.VmkiteJob{
+				testJob("android-1", "android", 0, 1),
+				testJob("web-1", "web", 0, 2),
+			},
+			want: "web-1,android-1",
+		},
+		{
+			name:    "max VMs holds jobs back",
+			params:  SchedulerParams{PipelineMaxVMs: map[string]int{"app": 1}},
+			running: []buildkite.VmkiteJob{testJob("app-0", "app", 0, 0)},
+			queue: []buildkite.VmkiteJob{
+				testJob("app-1", "app", 9, 1),
+				testJob("docs-1", "docs", 0, 2),
+			},
+			want: "docs-1",
+		},
+	}
+
+	for _, test := range tests {
+		s := newScheduler(test.params)
+		for _, job := range test.running {
+			s.Push(job)
+			s.Next()
+		}
+		for _, job := range test.queue {
+			s.Push(job)
+		}
+		s.Close()
+
+		got := []string{}
+		for range strings.Split(test.want, ",") {
+			if s.pick() < 0 {
+				break
+			}
+			job, _ := s.Next()
+			got = append(got, job.ID)
+		}
+		if strings.Join(got, ",") != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, strings.Join(got, ","), test.want)
+		}
+	}
+}
+
+func TestSchedulerDoneFreesShare(t *testing.T) {
+	s := newScheduler(SchedulerParams{PipelineMaxVMs: map[string]int{"app": 1}})
+	s.Push(testJob("app-1", "app", 0, 1))
+	s.Push(testJob("app-2", "app", 0, 2))
+
+	first, _ := s.Next()
+	if s.pick() >= 0 {
+		t.Fatal("second job can run while the first is at the pipeline's limit")
+	}
+	if s.Running() != 1 || s.Queued() != 1 {
+		t.Fatalf("running %d, queued %d, want 1 and 1", s.Running(), s.Queued())
+	}
+
+	next := make(chan buildkite.VmkiteJob)
+	go func() {
+		job, _ := s.Next()
+		next <- job
+	}()
+	s.Done(first)
+
+	select {
+	case job := <-next:
+		if job.ID != "app-2" {
+			t.Errorf("got %s, want app-2", job.ID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Next didn't wake up when a job was done")
+	}
+}
+
+func TestSchedulerClose(t *testing.T) {
+	s := newScheduler(SchedulerParams{})
+	s.Push(testJob("a", "app", 0, 1))
+	s.Close()
+
+	if job, ok := s.Next(); !ok || job.ID != "a" {
+		t.Fatalf("Next = %s, %v, want the queued job after Close", job.ID, ok)
+	}
+	if _, ok := s.Next(); ok {
+		t.Fatal("Next returned a job from a closed, empty scheduler")
+	}
+}
+
+func TestSchedulerRemove(t *testing.T) {
+	s := newScheduler(SchedulerParams{})
+	s.Push(testJob("a", "app", 0, 1))
+	s.Push(testJob("b", "app", 0, 2))
+	s.Push(testJob("c", "app", 0, 3))
+
+	taken, _ := s.Next()
+	if _, ok := s.Remove(taken.ID); ok {
+		t.Error("removed a job a worker has taken")
+	}
+	if job, ok := s.Remove("b"); !ok || job.ID != "b" {
+		t.Errorf("Remove = %s, %v, want the queued job", job.ID, ok)
+	}
+	if _, ok := s.Remove("b"); ok {
+		t.Error("removed a job twice")
+	}
+	if job, _ := s.Next(); job.ID != "c" {
+		t.Errorf("next job = %s, want c", job.ID)
+	}
+}
+
+func TestSchedulerRequeue(t *testing.T) {
+	s := newScheduler(SchedulerParams{})
+	a, b := testJob("a", "app", 0, 1), testJob("b", "app", 0, 2)
+
+	// a job is requeued unless it was withdrawn while waiting
+	s.Requeueing(a)
+	s.Requeueing(b)
+	if job, ok := s.Remove("b"); !ok || job.ID != "b" {
+		t.Errorf("Remove = %s, %v, want the requeueing job", job.ID, ok)
+	}
+	if !s.Requeue(a) || !s.Requeue(b) {
+		t.Error("requeue dropped a job from an open scheduler")
+	}
+	if s.Queued() != 1 {
+		t.Fatalf("queued %d, want only the job that wasn't withdrawn", s.Queued())
+	}
+	if job, _ := s.Next(); job.ID != "a" {
+		t.Errorf("next job = %s, want a", job.ID)
+	}
+
+	// once closed, a job waiting to be requeued is dropped
+	s.Requeueing(a)
+	s.Close()
+	if s.Requeue(a) {
+		t.Error("requeued a job into a closed scheduler")
+	}
+	if s.Queued() != 0 {
+		t.Errorf("queued %d after Close, want 0", s.Queued())
+	}
+}
@@ -0,0 +1,170 @@
+package runner
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/macstadium/vmkite/buildkite"
+	"github.com/macstadium/vmkite/buildkite/buildkitetest"
+	"github.com/macstadium/vmkite/creator"
+	"github.com/macstadium/vmkite/eventlog"
+	"github.com/macstadium/vmkite/vsphere"
+	"github.com/macstadium/vmkite/vsphere/vspheretest"
+)
+
+// vmsByJob maps the IDs of the jobs with VMs in the simulator to the VMs'
+// names
+func vmsByJob(t *testing.T, vs *vsphere.Session, sim *vspheretest.Simulator) map[string]string {
+	names, err := sim.VMs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	byJob := map[string]string{}
+	for _, name := range names {
+		vm, err := vs.VirtualMachine(name)
+		if err != nil {
+			continue // destroyed since listing
+		}
+		if jobID, err := vm.GuestInfo("vmkite-job-id"); err == nil {
+			byJob[jobID] = name
+		}
+	}
+	return byJob
+}
+
+// TestRunnerAgainstSimulator runs jobs from the Buildkite stub on VMs in a
+// simulated vCenter: one whose VM powers off once its job is done, one whose
+// VM hangs and is reaped, and one whose disk image doesn't exist
+func TestRunnerAgainstSimulator(t *testing.T) {
+	sim, err := vspheretest.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sim.Close()
+	// each VM has its own base disk, as the simulator deletes a VM's disks
+	// along with it
+	for _, disk := range []string{"ok/macos.vmdk", "hung/macos.vmdk"} {
+		if err := sim.WriteDisk(sim.Datastores[0], disk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	vs, err := vsphere.NewSession(context.Background(), vsphere.ConnectionParams{
+		Host:     sim.Host,
+		User:     sim.User,
+		Pass:     sim.Pass,
+		Insecure: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bk, stub := newStubSession(t)
+	defer stub.Close()
+	rules := func(vmdk string) []string {
+		return []string{"queue=macos", "vmkite-vmdk=" + vmdk, "vmkite-guestid=darwin16_64Guest"}
+	}
+	stub.SetJobs(
+		buildkitetest.Job{ID: "ok", Pipeline: "app", BuildNumber: 1, AgentQueryRules: rules("ok/macos.vmdk")},
+		buildkitetest.Job{ID: "hung", Pipeline: "app", BuildNumber: 2, AgentQueryRules: rules("hung/macos.vmdk")},
+		buildkitetest.Job{ID: "missing", Pipeline: "app", BuildNumber: 3, AgentQueryRules: rules("missing/macos.vmdk")},
+	)
+
+	events, err := eventlog.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorded, stop := events.Subscribe()
+	defer stop()
+
+	r := newRunner(vs, bk, "acme", Params{
+		Concurrency:    3,
+		ApiListenOn:    "127.0.0.1:0",
+		AgentToken:     buildkitetest.AgentToken,
+		CreatorOptions: creator.Options{Datastores: sim.Datastores, Backoff: time.Millisecond},
+		Events:         events,
+	})
+	r.pollInterval = time.Millisecond * 20
+	r.jobTimeout = time.Second * 2
+
+	type outcome struct {
+		jobID string
+		err   error
+	}
+	results := make(chan outcome, 10)
+	r.finished = func(job buildkite.VmkiteJob, err error) {
+		results <- outcome{job.ID, err}
+	}
+
+	go r.Run(vsphere.VirtualMachineCreationParams{
+		ClusterPath:       sim.ClusterPath,
+		DatastoreName:     sim.Datastores[0],
+		NetworkLabel:      sim.Network,
+		MemoryMB:          1024,
+		NumCPUs:           1,
+		NumCoresPerSocket: 1,
+		SrcDiskDataStore:  sim.Datastores[0],
+		GuestInfo:         map[string]string{},
+	})
+
+	// the guest of the ok job powers its VM off once it's running
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		if name, ok := vmsByJob(t, vs, sim)["ok"]; ok {
+			if err := sim.PowerOff(name); err != nil {
+				t.Fatal(err)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no VM was created for the ok job")
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+
+	outcomes := map[string]error{}
+	for len(outcomes) < 3 {
+		select {
+		case o := <-results:
+			outcomes[o.jobID] = o.err
+		case <-time.After(time.Second * 10):
+			t.Fatalf("only %d of 3 jobs finished: %v", len(outcomes), outcomes)
+		}
+	}
+
+	if err := outcomes["ok"]; err != nil {
+		t.Errorf("ok: %v", err)
+	}
+	if err := outcomes["hung"]; err == nil || err.Error() != "Timed out waiting for VM power-off" {
+		t.Errorf("hung: %v, want a timeout", err)
+	}
+	if err := outcomes["missing"]; err == nil {
+		t.Error("missing: no error")
+	}
+
+	// the VM that powered off and the one that was reaped are both gone
+	if names, err := sim.VMs(); err != nil || len(names) != 0 {
+		t.Errorf("VMs left = %v, %v", names, err)
+	}
+	destroyed := map[string]bool{}
+	for len(recorded) > 0 {
+		if e := <-recorded; e.Type == eventlog.Destroyed {
+			destroyed[e.JobID] = true
+		}
+	}
+	for _, id := range []string{"ok", "hung"} {
+		if !destroyed[id] {
+			t.Errorf("%s: destroyed wasn't recorded", id)
+		}
+	}
+
+	// only the job that couldn't get a VM is failed in Buildkite
+	for _, id := range []string{"ok", "hung"} {
+		if _, ok := stub.FinishedJob(id); ok {
+			t.Errorf("%s: failed in Buildkite", id)
+		}
+	}
+	if status, ok := stub.FinishedJob("missing"); !ok || status != "1" {
+		t.Errorf("missing: finished in Buildkite = %v with %q, want exit status 1", ok, status)
+	}
+}
@@ -0,0 +1,233 @@
+package runner
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/macstadium/vmkite/buildkite"
+)
+
+const maxRecentFailures = 20
+
+type jobPhase string
+
+const (
+	phaseQueued     jobPhase = "queued"
+	phaseCreating   jobPhase = "creating"
+	phaseRunning    jobPhase = "running"
+	phaseDestroying jobPhase = "destroying"
+	phaseHeld       jobPhase = "held"
+)
+
+// jobState is a snapshot of where a job is in its lifecycle
+type jobState struct {
+	Job          buildkite.VmkiteJob
+	Phase        jobPhase
+	VMName       string
+	Host         string
+	QueuedAt     time.Time
+	PhaseChanged time.Time
+	FinishedAt   time.Time
+	HeldUntil    time.Time
+	Error        string
+	BuildURL     string
+	JobURL       string
+}
+
+// Elapsed is the time the job has spent in vmkite so far
+func (j jobState) Elapsed() time.Duration {
+	if !j.FinishedAt.IsZero() {
+		return j.FinishedAt.Sub(j.QueuedAt)
+	}
+	return time.Since(j.QueuedAt)
+}
+
+// state tracks the jobs a runner knows about, for the dashboard
+type state struct {
+	sync.Mutex
+
+	org         string
+	jobs        map[string]*jobState
+	held        map[string]*jobState
+	failures    []jobState
+	preemptions int
+}
+
+func newState(org string) *state {
+	return &state{
+		org:  org,
+		jobs: map[string]*jobState{},
+		held: map[string]*jobState{},
+	}
+}
+
+func (s *state) Queued(job buildkite.VmkiteJob) {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	buildURL := fmt.Sprintf("https://buildkite.com/%s/%s/builds/%s",
+		s.org, job.Pipeline, job.BuildNumber)
+
+	s.jobs[job.ID] = &jobState{
+		Job:          job,
+		Phase:        phaseQueued,
+		QueuedAt:     now,
+		PhaseChanged: now,
+		BuildURL:     buildURL,
+		JobURL:       buildURL + "#" + job.ID,
+	}
+}
+
+func (s *state) SetPhase(job buildkite.VmkiteJob, phase jobPhase) {
+	s.Lock()
+	defer s.Unlock()
+
+	if js, ok := s.jobs[job.ID]; ok {
+		js.Phase = phase
+		js.PhaseChanged = time.Now()
+	}
+}
+
+func (s *state) SetVM(job buildkite.VmkiteJob, vmName string, host string) {
+	s.Lock()
+	defer s.Unlock()
+
+	if js, ok := s.jobs[job.ID]; ok {
+		js.VMName = vmName
+		js.Host = host
+	}
+}
+
+// Finished removes a job from the active set, remembering it if it failed
+func (s *state) Finished(job buildkite.VmkiteJob, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	js, ok := s.jobs[job.ID]
+	if !ok {
+		return
+	}
+	delete(s.jobs, job.ID)
+
+	if err != nil {
+		js.FinishedAt = time.Now()
+		js.Error = err.Error()
+		s.failures = append(s.failures, *js)
+		if len(s.failures) > maxRecentFailures {
+			s.failures = s.failures[len(s.failures)-maxRecentFailures:]
+		}
+	}
+}
+
+// Held records that a failed job's VM is being kept for debugging, apart
+// from the active jobs
+func (s *state) Held(job buildkite.VmkiteJob, until time.Time) {
+	s.Lock()
+	defer s.Unlock()
+
+	js, ok := s.jobs[job.ID]
+	if !ok {
+		return
+	}
+	held := *js
+	held.Phase = phaseHeld
+	held.PhaseChanged = time.Now()
+	held.HeldUntil = until
+	s.held[job.ID] = &held
+}
+
+// Released forgets a kept VM once it has been destroyed
+func (s *state) Released(job buildkite.VmkiteJob) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.held, job.ID)
+}
+
+// Preempted counts a job preempted to make way for a higher priority one
+func (s *state) Preempted() {
+	s.Lock()
+	defer s.Unlock()
+	s.preemptions++
+}
+
+type hostUsage struct {
+	Host  string
+	Slots int
+	// Held is how many of the slots are VMs kept for debugging
+	Held int
+}
+
+type stateSnapshot struct {
+	Queued      []jobState
+	Active      []jobState
+	Held        []jobState
+	Hosts       []hostUsage
+	Failures    []jobState
+	Preemptions int
+}
+
+func (s *state) Snapshot() stateSnapshot {
+	s.Lock()
+	defer s.Unlock()
+
+	snap := stateSnapshot{Preemptions: s.preemptions}
+	hosts := map[string]*hostUsage{}
+	usage := func(host string) *hostUsage {
+		if hosts[host] == nil {
+			hosts[host] = &hostUsage{Host: host}
+		}
+		return hosts[host]
+	}
+
+	for _, js := range s.jobs {
+		if js.Phase == phaseQueued {
+			snap.Queued = append(snap.Queued, *js)
+			continue
+		}
+		snap.Active = append(snap.Active, *js)
+		if js.Host != "" {
+			usage(js.Host).Slots++
+		}
+	}
+
+	// kept VMs still take up room on their hosts, their job's slot may not
+	// have been given up yet though
+	for id, js := range s.held {
+		snap.Held = append(snap.Held, *js)
+		if js.Host == "" {
+			continue
+		}
+		u := usage(js.Host)
+		u.Held++
+		if _, counted := s.jobs[id]; !counted {
+			u.Slots++
+		}
+	}
+
+	for _, u := range hosts {
+		snap.Hosts = append(snap.Hosts, *u)
+	}
+
+	// most recent failures first
+	for i := len(s.failures) - 1; i >= 0; i-- {
+		snap.Failures = append(snap.Failures, s.failures[i])
+	}
+
+	sort.Slice(snap.Queued, func(i, j int) bool {
+		return snap.Queued[i].QueuedAt.Before(snap.Queued[j].QueuedAt)
+	})
+	sort.Slice(snap.Active, func(i, j int) bool {
+		return snap.Active[i].QueuedAt.Before(snap.Active[j].QueuedAt)
+	})
+	sort.Slice(snap.Held, func(i, j int) bool {
+		return snap.Held[i].HeldUntil.Before(snap.Held[j].HeldUntil)
+	})
+	sort.Slice(snap.Hosts, func(i, j int) bool {
+		return snap.Hosts[i].Host < snap.Hosts[j].Host
+	})
+
+	return snap
+}
@@ -0,0 +1,130 @@
+// Package secrets resolves credentials given to vmkite as references to
+// files, environment variables or HashiCorp Vault, and keeps them up to date
+// as they are rotated.
+package secrets
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Provider looks up the value of a secret by its reference, minus the
+// provider's prefix
+type Provider interface {
+	Get(ref string) (string, error)
+}
+
+// Resolver turns references like "file:/run/secrets/vsphere-pass",
+// "env:VSPHERE_PASS" or "vault:secret/vmkite#vsphere-pass" into values, any
+// other string is returned as-is
+type Resolver struct {
+	providers map[string]Provider
+}
+
+func NewResolver() *Resolver {
+	return &Resolver{
+		providers: map[string]Provider{
+			"file": FileProvider{},
+			"env":  EnvProvider{},
+		},
+	}
+}
+
+// Register adds a provider for references starting with prefix + ":"
+func (r *Resolver) Register(prefix string, p Provider) {
+	r.providers[prefix] = p
+}
+
+func (r *Resolver) provider(ref string) (Provider, string) {
+	parts := strings.SplitN(ref, ":", 2)
+	if len(parts) != 2 {
+		return nil, ref
+	}
+	p, ok := r.providers[parts[0]]
+	if !ok {
+		return nil, ref
+	}
+	return p, parts[1]
+}
+
+// IsReference returns whether ref refers to a secret held elsewhere
+func (r *Resolver) IsReference(ref string) bool {
+	p, _ := r.provider(ref)
+	return p != nil
+}
+
+// Resolve returns the current value of a secret reference
+func (r *Resolver) Resolve(ref string) (string, error) {
+	p, rest := r.provider(ref)
+	if p == nil {
+		return ref, nil
+	}
+	return p.Get(rest)
+}
+
+// ResolveAll resolves each string in place
+func (r *Resolver) ResolveAll(refs ...*string) error {
+	for _, ref := range refs {
+		val, err := r.Resolve(*ref)
+		if err != nil {
+			return err
+		}
+		*ref = val
+	}
+	return nil
+}
+
+// Watch re-resolves a reference every interval in the background, calling
+// update when its value changes. Plain values are never watched.
+func (r *Resolver) Watch(ref string, interval time.Duration, update func(string)) {
+	if !r.IsReference(ref) || interval <= 0 {
+		return
+	}
+	current, _ := r.Resolve(ref)
+
+	go func() {
+		for range time.Tick(interval) {
+			val, err := r.Resolve(ref)
+			if err != nil {
+				debugf("Error refreshing %s: %v", ref, err)
+				continue
+			}
+			if val != current {
+				debugf("%s changed, updating", ref)
+				current = val
+				update(val)
+			}
+		}
+	}()
+}
+
+// FileProvider reads secrets from files, like those mounted by Kubernetes
+// or Docker secrets
+type FileProvider struct{}
+
+func (FileProvider) Get(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// EnvProvider reads secrets from environment variables
+type EnvProvider struct{}
+
+func (EnvProvider) Get(name string) (string, error) {
+	val, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("Environment variable %s is not set", name)
+	}
+	return val, nil
+}
+
+func debugf(format string, data ...interface{}) {
+	log.Printf("[secrets] "+format, data...)
+}
@@ -0,0 +1,164 @@
+package secrets
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// VaultProvider reads secrets from a HashiCorp Vault KV secrets engine,
+// references look like "secret/vmkite#vsphere-pass". Both version 1 and
+// version 2 KV engines are supported.
+type VaultProvider struct {
+	sync.Mutex
+
+	Addr  string
+	token string
+
+	client *http.Client
+}
+
+func NewVaultProvider(addr, token string) *VaultProvider {
+	return &VaultProvider{
+		Addr:   strings.TrimRight(addr, "/"),
+		token:  token,
+		client: &http.Client{Timeout: time.Second * 30},
+	}
+}
+
+// UpdateToken changes the token used for requests, e.g. when a Vault agent
+// writes a new one
+func (v *VaultProvider) UpdateToken(token string) {
+	v.Lock()
+	defer v.Unlock()
+	v.token = token
+}
+
+func (v *VaultProvider) currentToken() string {
+	v.Lock()
+	defer v.Unlock()
+	return v.token
+}
+
+// vaultAuth is the part of a token lookup or renewal response vmkite uses
+type vaultAuth struct {
+	TTL       int  `json:"ttl"`
+	Renewable bool `json:"renewable"`
+}
+
+// lookupSelf returns how long the token has left and whether it can be
+// renewed
+func (v *VaultProvider) lookupSelf() (vaultAuth, error) {
+	var resp struct {
+		Data vaultAuth `json:"data"`
+	}
+	err := v.do("GET", "auth/token/lookup-self", &resp)
+	return resp.Data, err
+}
+
+// renewSelf extends the token's lease, returning its new TTL
+func (v *VaultProvider) renewSelf() (time.Duration, error) {
+	var resp struct {
+		Auth struct {
+			LeaseDuration int `json:"lease_duration"`
+		} `json:"auth"`
+	}
+	if err := v.do("POST", "auth/token/renew-self", &resp); err != nil {
+		return 0, err
+	}
+	return time.Duration(resp.Auth.LeaseDuration) * time.Second, nil
+}
+
+// KeepRenewed renews the token in the background at half of its TTL, so
+// a long running vmkite keeps access to its secrets. Tokens that don't
+// expire or can't be renewed are left alone.
+func (v *VaultProvider) KeepRenewed() {
+	auth, err := v.lookupSelf()
+	if err != nil {
+		debugf("Error looking up Vault token: %v", err)
+		return
+	}
+	if auth.TTL <= 0 || !auth.Renewable {
+		debugf("Vault token doesn't need renewing")
+		return
+	}
+
+	go func() {
+		ttl := time.Duration(auth.TTL) * time.Second
+		for {
+			time.Sleep(ttl / 2)
+			renewed, err := v.renewSelf()
+			if err != nil {
+				debugf("Error renewing Vault token: %v", err)
+				renewed = ttl / 2
+			}
+			if renewed < vaultMinRenewal {
+				renewed = vaultMinRenewal
+			}
+			debugf("Vault token renewed for %v", renewed)
+			ttl = renewed
+		}
+	}()
+}
+
+// vaultMinRenewal stops renewals from spinning when a token is near its
+// maximum TTL
+const vaultMinRenewal = time.Second * 10
+
+func (v *VaultProvider) Get(ref string) (string, error) {
+	parts := strings.SplitN(ref, "#", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("Vault reference %q should look like path#key", ref)
+	}
+	path, key := parts[0], parts[1]
+
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := v.do("GET", strings.TrimLeft(path, "/"), &secret); err != nil {
+		return "", err
+	}
+
+	data := secret.Data
+	// KV version 2 nests the secret's data under data.data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		if _, hasMeta := data["metadata"]; hasMeta {
+			data = nested
+		}
+	}
+
+	val, ok := data[key]
+	if !ok {
+		return "", fmt.Errorf("Vault secret %s has no key %s", path, key)
+	}
+	s, ok := val.(string)
+	if !ok {
+		return "", fmt.Errorf("Vault secret %s key %s isn't a string", path, key)
+	}
+	return s, nil
+}
+
+// do makes a request to the Vault API and decodes the JSON response
+func (v *VaultProvider) do(method, path string, result interface{}) error {
+	req, err := http.NewRequest(method, v.Addr+"/v1/"+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", v.currentToken())
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Vault %s %s: %d %s", method, path, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
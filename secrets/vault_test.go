@@ -0,0 +1,140 @@
+package secrets
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// vaultStub serves KV secrets and token renewal like a Vault server
+type vaultStub struct {
+	sync.Mutex
+	token    string
+	secrets  map[string]interface{}
+	ttl      int
+	renewals int
+}
+
+func (s *vaultStub) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	if req.Header.Get("X-Vault-Token") != s.token {
+		http.Error(w, `{"errors":["permission denied"]}`, http.StatusForbidden)
+		return
+	}
+
+	path := strings.TrimPrefix(req.URL.Path, "/v1/")
+	switch {
+	case path == "auth/token/lookup-self" && req.Method == "GET":
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]interface{}{"ttl": s.ttl, "renewable": s.ttl > 0},
+		})
+	case path == "auth/token/renew-self" && req.Method == "POST":
+		s.renewals++
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"auth": map[string]interface{}{"lease_duration": s.ttl},
+		})
+	case s.secrets[path] != nil && req.Method == "GET":
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": s.secrets[path]})
+	default:
+		http.Error(w, `{"errors":[]}`, http.StatusNotFound)
+	}
+}
+
+func newVaultStub() (*vaultStub, *httptest.Server) {
+	stub := &vaultStub{
+		token: "s.test",
+		secrets: map[string]interface{}{
+			"secret/vmkite": map[string]interface{}{
+				"vsphere-pass": "kv1-pass",
+				"port":         8443,
+			},
+			"kv/data/vmkite": map[string]interface{}{
+				"data":     map[string]interface{}{"vsphere-pass": "kv2-pass"},
+				"metadata": map[string]interface{}{"version": 3},
+			},
+		},
+	}
+	return stub, httptest.NewServer(stub)
+}
+
+func TestVaultProviderGet(t *testing.T) {
+	_, server := newVaultStub()
+	defer server.Close()
+	v := NewVaultProvider(server.URL+"/", "s.test")
+
+	tests := []struct {
+		ref     string
+		want    string
+		wantErr string
+	}{
+		{ref: "secret/vmkite#vsphere-pass", want: "kv1-pass"},
+		{ref: "/secret/vmkite#vsphere-pass", want: "kv1-pass"},
+		{ref: "kv/data/vmkite#vsphere-pass", want: "kv2-pass"},
+		{ref: "secret/vmkite#missing", wantErr: "has no key missing"},
+		{ref: "secret/vmkite#port", wantErr: "isn't a string"},
+		{ref: "secret/other#key", wantErr: "404"},
+		{ref: "secret/vmkite", wantErr: "should look like path#key"},
+	}
+	for _, test := range tests {
+		got, err := v.Get(test.ref)
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("Get(%q) error = %v, want %q", test.ref, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Get(%q) error = %v", test.ref, err)
+		} else if got != test.want {
+			t.Errorf("Get(%q) = %q, want %q", test.ref, got, test.want)
+		}
+	}
+}
+
+func TestVaultProviderUpdateToken(t *testing.T) {
+	stub, server := newVaultStub()
+	defer server.Close()
+	v := NewVaultProvider(server.URL, "s.test")
+
+	stub.Lock()
+	stub.token = "s.rotated"
+	stub.Unlock()
+
+	if _, err := v.Get("secret/vmkite#vsphere-pass"); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("Get with old token error = %v, want 403", err)
+	}
+	v.UpdateToken("s.rotated")
+	if got, err := v.Get("secret/vmkite#vsphere-pass"); err != nil || got != "kv1-pass" {
+		t.Fatalf("Get with new token = %q, %v", got, err)
+	}
+}
+
+func TestVaultProviderKeepRenewed(t *testing.T) {
+	stub, server := newVaultStub()
+	defer server.Close()
+	v := NewVaultProvider(server.URL, "s.test")
+
+	// tokens without a TTL are never renewed
+	v.KeepRenewed()
+	time.Sleep(time.Millisecond * 50)
+	stub.Lock()
+	if stub.renewals != 0 {
+		t.Fatalf("renewed a token without a TTL %d times", stub.renewals)
+	}
+	stub.ttl = 1
+	stub.Unlock()
+
+	v.KeepRenewed()
+	time.Sleep(time.Millisecond * 800)
+	stub.Lock()
+	defer stub.Unlock()
+	if stub.renewals != 1 {
+		t.Fatalf("renewed a token with a 1s TTL %d times in 0.8s, want 1", stub.renewals)
+	}
+}
@@ -0,0 +1,47 @@
+#!/bin/bash
+# Smoke test the vmkite binary against govmomi's vSphere simulator. The Go
+# tests run vcsim in-process; this runs it and govc as separate binaries:
+#
+#   go install github.com/vmware/govmomi/vcsim@latest
+#   go install github.com/vmware/govmomi/govc@latest
+
+set -e
+set -o pipefail
+set -u
+
+listen=127.0.0.1:8989
+
+vcsim -l "$listen" -cluster 1 -host 2 -ds 2 -pg 1 &
+vcsim_pid=$!
+trap 'kill $vcsim_pid' EXIT
+
+export VMKITE_VSPHERE_HOST="$listen"
+export VMKITE_VSPHERE_USER=user
+export VMKITE_VSPHERE_PASS=pass
+export VMKITE_VSPHERE_INSECURE=true
+export VMKITE_VM_PATH=/DC0/vm
+
+export GOVC_URL="https://$VMKITE_VSPHERE_USER:$VMKITE_VSPHERE_PASS@$listen/sdk"
+export GOVC_INSECURE=true
+
+until govc about > /dev/null 2>&1; do sleep 1; done
+
+govc datastore.mkdir -ds LocalDS_0 vmkite-base
+govc datastore.disk.create -ds LocalDS_0 -size 1M vmkite-base/vmkite-base.vmdk
+
+vmkite create-vm \
+  --source-datastore=LocalDS_0 \
+  --source-path=vmkite-base/vmkite-base.vmdk \
+  --target-datastore=LocalDS_0 \
+  --target-datastore=LocalDS_1 \
+  --vm-cluster-path=/DC0/host/DC0_C0 \
+  --vm-network-label=DC0_DVPG0 \
+  --vm-memory-mb=1024 \
+  --vm-num-cpus=1 \
+  --vm-num-cores-per-socket=1 \
+  --vm-guest-id=darwin16_64Guest
+
+vm=$(govc find /DC0/vm -type m -name 'vmkite-*' | head -n 1)
+govc vm.info -e "$vm" | grep guestinfo.vmkite-name
+
+vmkite destroy-vm "$(basename "$vm")"
@@ -0,0 +1,73 @@
+package vsphere
+
+import (
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/mo"
+)
+
+// DatastoreStats describes how much room a datastore has for new VMs
+type DatastoreStats struct {
+	Name       string
+	Capacity   int64
+	FreeSpace  int64
+	VMCount    int
+	Accessible bool
+}
+
+// DatastoreStats looks up capacity, free space and VM count for datastores
+func (vs *Session) DatastoreStats(names []string) ([]DatastoreStats, error) {
+	finder, err := vs.getFinder()
+	if err != nil {
+		return nil, err
+	}
+	stats := []DatastoreStats{}
+	for _, name := range names {
+		debugf("finder.Datastore(%s)", name)
+		ds, err := finder.Datastore(vs.ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		var mds mo.Datastore
+		err = ds.Properties(vs.ctx, ds.Reference(), []string{"summary", "vm"}, &mds)
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, DatastoreStats{
+			Name:       mds.Summary.Name,
+			Capacity:   mds.Summary.Capacity,
+			FreeSpace:  mds.Summary.FreeSpace,
+			VMCount:    len(mds.Vm),
+			Accessible: mds.Summary.Accessible,
+		})
+	}
+	return stats, nil
+}
+
+// DatastoreClusterMembers returns the names of the datastores in a
+// datastore cluster (storage pod)
+func (vs *Session) DatastoreClusterMembers(path string) ([]string, error) {
+	finder, err := vs.getFinder()
+	if err != nil {
+		return nil, err
+	}
+	debugf("finder.DatastoreCluster(%s)", path)
+	pod, err := finder.DatastoreCluster(vs.ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	children, err := pod.Children(vs.ctx)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, child := range children {
+		if ds, ok := child.(*object.Datastore); ok {
+			name, err := ds.ObjectName(vs.ctx)
+			if err != nil {
+				return nil, err
+			}
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,182 @@
+package vsphere
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// serialLogFile is where a VM's serial port output goes when
+// VirtualMachineCreationParams.SerialLog is set, in the VM's log directory
+const serialLogFile = "serial.log"
+
+func (vm *VirtualMachine) files() (*types.VirtualMachineFileInfo, error) {
+	vs := vm.vs
+	var mvm mo.VirtualMachine
+	err := vm.mo.Properties(vs.ctx, vm.mo.Reference(), []string{"config.files"}, &mvm)
+	if err != nil {
+		return nil, err
+	}
+	if mvm.Config == nil {
+		return nil, fmt.Errorf("vm %s has no config", vm.Name)
+	}
+	return &mvm.Config.Files, nil
+}
+
+// Directory returns the datastore and directory holding the VM's files
+func (vm *VirtualMachine) Directory() (string, string, error) {
+	files, err := vm.files()
+	if err != nil {
+		return "", "", err
+	}
+	var p object.DatastorePath
+	if !p.FromString(files.VmPathName) {
+		return "", "", fmt.Errorf("Can't parse vm path %q", files.VmPathName)
+	}
+	return p.Datastore, path.Dir(p.Path), nil
+}
+
+// LogDirectory returns the datastore and directory the VM writes vmware.log
+// to, which is its own directory unless configured otherwise
+func (vm *VirtualMachine) LogDirectory() (string, string, error) {
+	files, err := vm.files()
+	if err != nil {
+		return "", "", err
+	}
+	if files.LogDirectory == "" {
+		return vm.Directory()
+	}
+	var p object.DatastorePath
+	if !p.FromString(files.LogDirectory) {
+		return "", "", fmt.Errorf("Can't parse log directory %q", files.LogDirectory)
+	}
+	return p.Datastore, path.Clean(p.Path), nil
+}
+
+// CreateScreenshot takes a screenshot of the VM's console, returning the
+// datastore and path of the PNG file it was saved to
+func (vm *VirtualMachine) CreateScreenshot() (string, string, error) {
+	vs := vm.vs
+	debugf("CreateScreenshot_Task(%s)", vm.Name)
+	res, err := methods.CreateScreenshot_Task(vs.ctx, vs.client.Client, &types.CreateScreenshot_Task{
+		This: vm.mo.Reference(),
+	})
+	if err != nil {
+		return "", "", err
+	}
+	info, err := object.NewTask(vs.client.Client, res.Returnval).WaitForResult(vs.ctx, nil)
+	if err != nil {
+		return "", "", err
+	}
+	var p object.DatastorePath
+	if s, ok := info.Result.(string); !ok || !p.FromString(s) {
+		return "", "", fmt.Errorf("CreateScreenshot %s returned unexpected result %v", vm.Name, info.Result)
+	}
+	return p.Datastore, p.Path, nil
+}
+
+// CaptureDiagnostics saves a screenshot of the VM's console, its vmware.log
+// and its serial port output, if it has one, to a local directory. It
+// carries on past errors so as to save as much as it can, returning the
+// files saved along with the first error.
+func (vm *VirtualMachine) CaptureDiagnostics(dir string) ([]string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	saved := []string{}
+	var firstErr error
+	save := func(datastore, src, name string) {
+		if err := vm.vs.downloadFile(datastore, src, filepath.Join(dir, name)); err != nil {
+			debugf("Error saving %s of %s: %v", name, vm.Name, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			return
+		}
+		saved = append(saved, filepath.Join(dir, name))
+	}
+
+	if on, _ := vm.IsPoweredOn(); on {
+		if ds, p, err := vm.CreateScreenshot(); err == nil {
+			save(ds, p, "screenshot.png")
+		} else {
+			debugf("Error taking screenshot of %s: %v", vm.Name, err)
+			firstErr = err
+		}
+	}
+
+	ds, logDir, err := vm.LogDirectory()
+	if err != nil {
+		if firstErr == nil {
+			firstErr = err
+		}
+		return saved, firstErr
+	}
+	save(ds, path.Join(logDir, "vmware.log"), "vmware.log")
+	if exists, err := vm.vs.FileExists(ds, path.Join(logDir, serialLogFile)); err == nil && exists {
+		save(ds, path.Join(logDir, serialLogFile), serialLogFile)
+	}
+
+	return saved, firstErr
+}
+
+// downloadFile copies a file from a datastore to a local path
+func (vs *Session) downloadFile(datastore, src, dst string) error {
+	r, _, err := vs.OpenFile(datastore, src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// addSerialLog adds a serial port that writes to a file in the VM's log
+// directory, so that console output survives a VM that fails to boot. It is
+// added once the VM exists, as that's when vSphere has chosen its directory.
+func (vm *VirtualMachine) addSerialLog() error {
+	vs := vm.vs
+	ds, logDir, err := vm.LogDirectory()
+	if err != nil {
+		return err
+	}
+	devices := object.VirtualDeviceList{}
+	port := &types.VirtualSerialPort{
+		VirtualDevice: types.VirtualDevice{
+			Key: devices.NewKey(),
+			Backing: &types.VirtualSerialPortFileBackingInfo{
+				VirtualDeviceFileBackingInfo: types.VirtualDeviceFileBackingInfo{
+					FileName: fmt.Sprintf("[%s] %s", ds, path.Join(logDir, serialLogFile)),
+				},
+			},
+			Connectable: &types.VirtualDeviceConnectInfo{StartConnected: true, Connected: true},
+		},
+		YieldOnPoll: true,
+	}
+	deviceChange, err := append(devices, port).ConfigSpec(types.VirtualDeviceConfigSpecOperationAdd)
+	if err != nil {
+		return err
+	}
+	debugf("vm.Reconfigure(%s) adding serial log", vm.Name)
+	task, err := vm.mo.Reconfigure(vs.ctx, types.VirtualMachineConfigSpec{DeviceChange: deviceChange})
+	if err != nil {
+		return err
+	}
+	return task.Wait(vs.ctx)
+}
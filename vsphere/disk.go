@@ -0,0 +1,303 @@
+package vsphere
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"time"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// DiskFile is a virtual disk found on a datastore
+type DiskFile struct {
+	Datastore  string
+	Path       string
+	CapacityKB int64
+	FileSize   int64
+	Modified   time.Time
+}
+
+// CopyDisk copies a virtual disk between datastores using the vSphere
+// VirtualDiskManager, so the data never leaves the cluster
+func (vs *Session) CopyDisk(srcDatastore, srcPath, dstDatastore, dstPath string) error {
+	if _, err := vs.getFinder(); err != nil {
+		return err
+	}
+	src := (&object.DatastorePath{Datastore: srcDatastore, Path: srcPath}).String()
+	dst := (&object.DatastorePath{Datastore: dstDatastore, Path: dstPath}).String()
+
+	dir := (&object.DatastorePath{Datastore: dstDatastore, Path: path.Dir(dstPath)}).String()
+	debugf("fileManager.MakeDirectory(%s)", dir)
+	fm := object.NewFileManager(vs.client.Client)
+	if err := fm.MakeDirectory(vs.ctx, dir, vs.datacenter, true); err != nil && !IsFileAlreadyExists(err) {
+		return err
+	}
+
+	debugf("virtualDiskManager.CopyVirtualDisk(%s, %s)", src, dst)
+	m := object.NewVirtualDiskManager(vs.client.Client)
+	task, err := m.CopyVirtualDisk(vs.ctx, src, vs.datacenter, dst, vs.datacenter, nil, false)
+	if err != nil {
+		return err
+	}
+	debugf("waiting for CopyVirtualDisk %v", task)
+	return task.Wait(vs.ctx)
+}
+
+// ListDisks finds the virtual disks under a directory on a datastore
+func (vs *Session) ListDisks(datastore, dir string) ([]DiskFile, error) {
+	ds, err := vs.datastore(datastore)
+	if err != nil {
+		return nil, err
+	}
+	browser, err := ds.Browser(vs.ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	spec := types.HostDatastoreBrowserSearchSpec{
+		MatchPattern: []string{"*.vmdk"},
+		Query: []types.BaseFileQuery{&types.VmDiskFileQuery{
+			Details: &types.VmDiskFileQueryFlags{DiskType: true, CapacityKb: true},
+		}},
+		Details: &types.FileQueryFlags{
+			FileType:     true,
+			FileSize:     true,
+			Modification: true,
+		},
+	}
+
+	debugf("browser.SearchDatastoreSubFolders(%s)", ds.Path(dir))
+	task, err := browser.SearchDatastoreSubFolders(vs.ctx, ds.Path(dir), &spec)
+	if err != nil {
+		return nil, err
+	}
+	info, err := task.WaitForResult(vs.ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	disks := []DiskFile{}
+	results := info.Result.(types.ArrayOfHostDatastoreBrowserSearchResults)
+	for _, result := range results.HostDatastoreBrowserSearchResults {
+		var folder object.DatastorePath
+		folder.FromString(result.FolderPath)
+		for _, f := range result.File {
+			disk, ok := f.(*types.VmDiskFileInfo)
+			if !ok {
+				continue
+			}
+			df := DiskFile{
+				Datastore:  datastore,
+				Path:       path.Join(folder.Path, disk.Path),
+				CapacityKB: disk.CapacityKb,
+				FileSize:   disk.FileSize,
+			}
+			if disk.Modification != nil {
+				df.Modified = *disk.Modification
+			}
+			disks = append(disks, df)
+		}
+	}
+	return disks, nil
+}
+
+// Disk finds a virtual disk on a datastore
+func (vs *Session) Disk(datastore, diskPath string) (DiskFile, error) {
+	disks, err := vs.ListDisks(datastore, path.Dir(diskPath))
+	if err != nil {
+		return DiskFile{}, err
+	}
+	for _, disk := range disks {
+		if disk.Path == path.Clean(diskPath) {
+			return disk, nil
+		}
+	}
+	return DiskFile{}, fmt.Errorf("No disk at [%s] %s", datastore, diskPath)
+}
+
+// DiskCapacity returns the size in bytes a virtual disk can grow to
+func (vs *Session) DiskCapacity(datastore, diskPath string) (int64, error) {
+	disk, err := vs.Disk(datastore, diskPath)
+	if err != nil {
+		return 0, err
+	}
+	return disk.CapacityKB * 1024, nil
+}
+
+// DiskExtents returns the paths of the files holding a virtual disk's data,
+// as the datastore browser reports them. VMFS hides flat extents from plain
+// file searches, so this is the way to check they are there. It returns an
+// error if the datastore doesn't see the file as a disk.
+func (vs *Session) DiskExtents(datastore, diskPath string) ([]string, error) {
+	ds, err := vs.datastore(datastore)
+	if err != nil {
+		return nil, err
+	}
+	browser, err := ds.Browser(vs.ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	extents := true
+	spec := types.HostDatastoreBrowserSearchSpec{
+		Query: []types.BaseFileQuery{&types.VmDiskFileQuery{
+			Details: &types.VmDiskFileQueryFlags{DiskExtents: &extents},
+		}},
+		MatchPattern: []string{path.Base(diskPath)},
+	}
+
+	debugf("browser.SearchDatastore(%s, %s)", ds.Path(path.Dir(diskPath)), path.Base(diskPath))
+	task, err := browser.SearchDatastore(vs.ctx, ds.Path(path.Dir(diskPath)), &spec)
+	if err != nil {
+		return nil, err
+	}
+	info, err := task.WaitForResult(vs.ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	result := info.Result.(types.HostDatastoreBrowserSearchResults)
+	for _, f := range result.File {
+		if disk, ok := f.(*types.VmDiskFileInfo); ok && disk.Path == path.Base(diskPath) {
+			paths := []string{}
+			for _, extent := range disk.DiskExtents {
+				var p object.DatastorePath
+				if p.FromString(extent) {
+					paths = append(paths, p.Path)
+				} else {
+					paths = append(paths, path.Join(path.Dir(diskPath), extent))
+				}
+			}
+			return paths, nil
+		}
+	}
+	return nil, fmt.Errorf("[%s] %s is not a virtual disk, or its extents are missing", datastore, diskPath)
+}
+
+// DeleteDisk deletes a virtual disk and its extents from a datastore
+func (vs *Session) DeleteDisk(datastore, diskPath string) error {
+	if _, err := vs.getFinder(); err != nil {
+		return err
+	}
+	name := (&object.DatastorePath{Datastore: datastore, Path: diskPath}).String()
+	debugf("virtualDiskManager.DeleteVirtualDisk(%s)", name)
+	m := object.NewVirtualDiskManager(vs.client.Client)
+	task, err := m.DeleteVirtualDisk(vs.ctx, name, vs.datacenter)
+	if err != nil {
+		return err
+	}
+	debugf("waiting for DeleteVirtualDisk %v", task)
+	return task.Wait(vs.ctx)
+}
+
+// DeleteFile deletes a file from a datastore
+func (vs *Session) DeleteFile(datastore, filePath string) error {
+	if _, err := vs.getFinder(); err != nil {
+		return err
+	}
+	name := (&object.DatastorePath{Datastore: datastore, Path: filePath}).String()
+	debugf("fileManager.DeleteDatastoreFile(%s)", name)
+	fm := object.NewFileManager(vs.client.Client)
+	task, err := fm.DeleteDatastoreFile(vs.ctx, name, vs.datacenter)
+	if err != nil {
+		return err
+	}
+	return task.Wait(vs.ctx)
+}
+
+// MakeDirectory creates a directory on a datastore. It fails if the
+// directory already exists, see IsFileAlreadyExists, so it can be used as a
+// lock.
+func (vs *Session) MakeDirectory(datastore, dir string) error {
+	if _, err := vs.getFinder(); err != nil {
+		return err
+	}
+	name := (&object.DatastorePath{Datastore: datastore, Path: dir}).String()
+	debugf("fileManager.MakeDirectory(%s)", name)
+	fm := object.NewFileManager(vs.client.Client)
+	return fm.MakeDirectory(vs.ctx, name, vs.datacenter, false)
+}
+
+// MoveFile moves a file within a datastore, replacing any existing file
+func (vs *Session) MoveFile(datastore, srcPath, dstPath string) error {
+	if _, err := vs.getFinder(); err != nil {
+		return err
+	}
+	src := (&object.DatastorePath{Datastore: datastore, Path: srcPath}).String()
+	dst := (&object.DatastorePath{Datastore: datastore, Path: dstPath}).String()
+	debugf("fileManager.MoveDatastoreFile(%s, %s)", src, dst)
+	fm := object.NewFileManager(vs.client.Client)
+	task, err := fm.MoveDatastoreFile(vs.ctx, src, vs.datacenter, dst, vs.datacenter, true)
+	if err != nil {
+		return err
+	}
+	return task.Wait(vs.ctx)
+}
+
+// FileExists returns whether a file exists on a datastore
+func (vs *Session) FileExists(datastore, path string) (bool, error) {
+	ds, err := vs.datastore(datastore)
+	if err != nil {
+		return false, err
+	}
+	debugf("datastore.Stat([%s] %s)", datastore, path)
+	_, err = ds.Stat(vs.ctx, path)
+	switch err.(type) {
+	case nil:
+		return true, nil
+	case object.DatastoreNoSuchFileError, object.DatastoreNoSuchDirectoryError:
+		return false, nil
+	}
+	return false, err
+}
+
+// OpenFile streams a file from a datastore, the caller must close it
+func (vs *Session) OpenFile(datastore, path string) (io.ReadCloser, int64, error) {
+	ds, err := vs.datastore(datastore)
+	if err != nil {
+		return nil, 0, err
+	}
+	debugf("datastore.Download([%s] %s)", datastore, path)
+	return ds.Download(vs.ctx, path, &soap.DefaultDownload)
+}
+
+// ReadFile reads a small file from a datastore
+func (vs *Session) ReadFile(datastore, path string) ([]byte, error) {
+	f, _, err := vs.OpenFile(datastore, path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// WriteFile writes a small file to a datastore, replacing any existing file
+func (vs *Session) WriteFile(datastore, path string, data []byte) error {
+	return vs.UploadFile(datastore, path, bytes.NewReader(data), int64(len(data)))
+}
+
+// UploadFile streams size bytes from r to a file on a datastore
+func (vs *Session) UploadFile(datastore, filePath string, r io.Reader, size int64) error {
+	ds, err := vs.datastore(datastore)
+	if err != nil {
+		return err
+	}
+	debugf("datastore.Upload([%s] %s, %d bytes)", datastore, filePath, size)
+	p := soap.DefaultUpload
+	p.ContentLength = size
+	return ds.Upload(vs.ctx, r, filePath, &p)
+}
+
+func (vs *Session) datastore(name string) (*object.Datastore, error) {
+	finder, err := vs.getFinder()
+	if err != nil {
+		return nil, err
+	}
+	debugf("finder.Datastore(%s)", name)
+	return finder.Datastore(vs.ctx, name)
+}
@@ -0,0 +1,100 @@
+package vsphere
+
+import (
+	"io"
+	"net"
+	"reflect"
+
+	"github.com/vmware/govmomi/task"
+	"github.com/vmware/govmomi/vim25/soap"
+)
+
+// Faults that are likely to go away if the same request is retried later
+var transientFaults = map[string]bool{
+	"ConcurrentAccess":  true,
+	"HostCommunication": true,
+	"HostNotReachable":  true,
+	"RequestCanceled":   true,
+	"ResourceInUse":     true,
+	"SystemError":       true,
+	"TaskInProgress":    true,
+}
+
+// Faults that indicate the chosen host can't take the VM, either when it is
+// created or when it is powered on
+var hostFaults = map[string]bool{
+	"HostNotConnected":                    true,
+	"InsufficientCpuResourcesFault":       true,
+	"InsufficientHostCapacityFault":       true,
+	"InsufficientHostCpuCapacityFault":    true,
+	"InsufficientHostMemoryCapacityFault": true,
+	"InsufficientMemoryResourcesFault":    true,
+	"InsufficientResourcesFault":          true,
+	"InvalidHostState":                    true,
+	"NotEnoughCpus":                       true,
+}
+
+// Faults that indicate the chosen datastore can't take the VM
+var datastoreFaults = map[string]bool{
+	"DatastoreNotWritableOnHost": true,
+	"InaccessibleDatastore":      true,
+	"InsufficientStorageSpace":   true,
+	"InvalidDatastoreState":      true,
+	"NoDiskSpace":                true,
+}
+
+// IsTransient returns whether err is worth retrying as-is, e.g. a network
+// error or a SOAP fault caused by a busy or briefly unreachable vCenter
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	return transientFaults[faultName(err)]
+}
+
+// IsHostFault returns whether err means the VM should be placed on a
+// different host
+func IsHostFault(err error) bool {
+	return hostFaults[faultName(err)]
+}
+
+// IsDatastoreFault returns whether err means the VM should be placed on a
+// different datastore
+func IsDatastoreFault(err error) bool {
+	return datastoreFaults[faultName(err)]
+}
+
+// IsFileAlreadyExists returns whether err is a fault from creating a file or
+// directory that is already there
+func IsFileAlreadyExists(err error) bool {
+	return faultName(err) == "FileAlreadyExists"
+}
+
+// faultName returns the vSphere fault type name carried by a SOAP or task
+// error, or an empty string for any other error
+func faultName(err error) string {
+	var fault interface{}
+
+	switch e := err.(type) {
+	case task.Error:
+		fault = e.Fault()
+	default:
+		switch {
+		case soap.IsSoapFault(err):
+			fault = soap.ToSoapFault(err).VimFault()
+		case soap.IsVimFault(err):
+			fault = soap.ToVimFault(err)
+		}
+	}
+
+	if fault == nil {
+		return ""
+	}
+	return reflect.Indirect(reflect.ValueOf(fault)).Type().Name()
+}
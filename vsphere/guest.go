@@ -0,0 +1,210 @@
+package vsphere
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const guestPollDuration = time.Second * 2
+
+// GuestAuth holds the credentials of a user inside a VM's guest OS
+type GuestAuth struct {
+	User string
+	Pass string
+}
+
+func (a GuestAuth) vim() types.BaseGuestAuthentication {
+	return &types.NamePasswordAuthentication{Username: a.User, Password: a.Pass}
+}
+
+// WaitForTools waits for VMware Tools to be running in the guest
+func (vm *VirtualMachine) WaitForTools(timeout time.Duration) error {
+	vs := vm.vs
+	debugf("waiting for tools in %s", vm.Name)
+	deadline := time.Now().Add(timeout)
+	for {
+		running, err := vm.mo.IsToolsRunning(vs.ctx)
+		if err != nil {
+			return err
+		}
+		if running {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Timed out waiting for VMware Tools in %s", vm.Name)
+		}
+		time.Sleep(guestPollDuration)
+	}
+}
+
+// StartProgram starts a program in the guest, returning its pid
+func (vm *VirtualMachine) StartProgram(auth GuestAuth, program string, args string, env []string) (int64, error) {
+	vs := vm.vs
+	gom, err := vs.guestOperationsManager()
+	if err != nil {
+		return 0, err
+	}
+	debugf("StartProgramInGuest(%s, %s %s)", vm.Name, program, args)
+	res, err := methods.StartProgramInGuest(vs.ctx, vs.client.Client, &types.StartProgramInGuest{
+		This: *gom.ProcessManager,
+		Vm:   vm.mo.Reference(),
+		Auth: auth.vim(),
+		Spec: &types.GuestProgramSpec{
+			ProgramPath:  program,
+			Arguments:    args,
+			EnvVariables: env,
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return res.Returnval, nil
+}
+
+// WaitForProgram waits up to timeout for a program started in the guest to
+// exit, returning its exit code
+func (vm *VirtualMachine) WaitForProgram(auth GuestAuth, pid int64, timeout time.Duration) (int32, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		procs, err := vm.ListProcesses(auth, pid)
+		if err != nil {
+			return 0, err
+		}
+		if len(procs) == 0 {
+			return 0, fmt.Errorf("Process %d not found in %s", pid, vm.Name)
+		}
+		if procs[0].EndTime != nil {
+			return procs[0].ExitCode, nil
+		}
+		if time.Now().After(deadline) {
+			return 0, fmt.Errorf("Timed out waiting for process %d in %s", pid, vm.Name)
+		}
+		time.Sleep(guestPollDuration)
+	}
+}
+
+// ListProcesses lists processes in the guest, or just the given pids
+func (vm *VirtualMachine) ListProcesses(auth GuestAuth, pids ...int64) ([]types.GuestProcessInfo, error) {
+	vs := vm.vs
+	gom, err := vs.guestOperationsManager()
+	if err != nil {
+		return nil, err
+	}
+	res, err := methods.ListProcessesInGuest(vs.ctx, vs.client.Client, &types.ListProcessesInGuest{
+		This: *gom.ProcessManager,
+		Vm:   vm.mo.Reference(),
+		Auth: auth.vim(),
+		Pids: pids,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.Returnval, nil
+}
+
+// CopyToGuest writes size bytes from r to a file in the guest
+func (vm *VirtualMachine) CopyToGuest(auth GuestAuth, r io.Reader, size int64, guestPath string, mode int64) error {
+	vs := vm.vs
+	gom, err := vs.guestOperationsManager()
+	if err != nil {
+		return err
+	}
+	debugf("InitiateFileTransferToGuest(%s, %s)", vm.Name, guestPath)
+	res, err := methods.InitiateFileTransferToGuest(vs.ctx, vs.client.Client, &types.InitiateFileTransferToGuest{
+		This:           *gom.FileManager,
+		Vm:             vm.mo.Reference(),
+		Auth:           auth.vim(),
+		GuestFilePath:  guestPath,
+		FileAttributes: &types.GuestPosixFileAttributes{Permissions: mode},
+		FileSize:       size,
+		Overwrite:      true,
+	})
+	if err != nil {
+		return err
+	}
+	u, err := vs.client.Client.ParseURL(res.Returnval)
+	if err != nil {
+		return err
+	}
+	p := soap.DefaultUpload
+	p.ContentLength = size
+	return vs.client.Client.Upload(vs.ctx, r, u, &p)
+}
+
+// CopyFromGuest opens a file in the guest for reading, the caller must close
+// it
+func (vm *VirtualMachine) CopyFromGuest(auth GuestAuth, guestPath string) (io.ReadCloser, int64, error) {
+	vs := vm.vs
+	gom, err := vs.guestOperationsManager()
+	if err != nil {
+		return nil, 0, err
+	}
+	debugf("InitiateFileTransferFromGuest(%s, %s)", vm.Name, guestPath)
+	res, err := methods.InitiateFileTransferFromGuest(vs.ctx, vs.client.Client, &types.InitiateFileTransferFromGuest{
+		This:          *gom.FileManager,
+		Vm:            vm.mo.Reference(),
+		Auth:          auth.vim(),
+		GuestFilePath: guestPath,
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	u, err := vs.client.Client.ParseURL(res.Returnval.Url)
+	if err != nil {
+		return nil, 0, err
+	}
+	return vs.client.Client.Download(vs.ctx, u, &soap.DefaultDownload)
+}
+
+// ShutdownGuest asks the guest OS to shut down and waits for the VM to power
+// off
+func (vm *VirtualMachine) ShutdownGuest(timeout time.Duration) error {
+	vs := vm.vs
+	debugf("vm.ShutdownGuest(%s)", vm.Name)
+	if err := vm.mo.ShutdownGuest(vs.ctx); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(vs.ctx, timeout)
+	defer cancel()
+	err := vm.mo.WaitForPowerState(ctx, types.VirtualMachinePowerStatePoweredOff)
+	if err == context.DeadlineExceeded {
+		return fmt.Errorf("Timed out waiting for %s to shut down", vm.Name)
+	}
+	return err
+}
+
+// DetachDisks removes the VM's disks without deleting their files, so they
+// outlive the VM
+func (vm *VirtualMachine) DetachDisks() error {
+	vs := vm.vs
+	devices, err := vm.mo.Device(vs.ctx)
+	if err != nil {
+		return err
+	}
+	disks := devices.SelectByType((*types.VirtualDisk)(nil))
+	debugf("vm.RemoveDevice(%s, %d disks)", vm.Name, len(disks))
+	return vm.mo.RemoveDevice(vs.ctx, true, disks...)
+}
+
+func (vs *Session) guestOperationsManager() (*mo.GuestOperationsManager, error) {
+	ref := vs.client.Client.ServiceContent.GuestOperationsManager
+	if ref == nil {
+		return nil, errors.New("vSphere has no guest operations manager")
+	}
+	var gom mo.GuestOperationsManager
+	pc := property.DefaultCollector(vs.client.Client)
+	err := pc.RetrieveOne(vs.ctx, *ref, []string{"processManager", "fileManager"}, &gom)
+	if err != nil {
+		return nil, err
+	}
+	return &gom, nil
+}
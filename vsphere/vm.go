@@ -1,6 +1,15 @@
 package vsphere
 
-import "github.com/vmware/govmomi/object"
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
 
 // VirtualMachine wraps govmomi's object.VirtualMachine
 type VirtualMachine struct {
@@ -71,3 +80,157 @@ func (vm *VirtualMachine) PowerOn() error {
 	}
 	return nil
 }
+
+// HostName returns the name of the ESXi host the VM is currently placed on
+func (vm *VirtualMachine) HostName() (string, error) {
+	vs := vm.vs
+	host, err := vm.mo.HostSystem(vs.ctx)
+	if err != nil {
+		return "", err
+	}
+	return host.ObjectName(vs.ctx)
+}
+
+// ConsoleURL returns a link to the VM's console in the vSphere web client
+func (vm *VirtualMachine) ConsoleURL() string {
+	vs := vm.vs
+	host := vs.client.URL().Host
+	q := url.Values{}
+	q.Set("vmId", vm.mo.Reference().Value)
+	q.Set("vmName", vm.Name)
+	q.Set("serverGuid", vs.client.ServiceContent.About.InstanceUuid)
+	q.Set("host", host)
+	return fmt.Sprintf("https://%s/ui/webconsole.html?%s", host, q.Encode())
+}
+
+// IPAddress returns the guest's primary IP address as reported by VMware
+// Tools, or an empty string if it isn't known
+func (vm *VirtualMachine) IPAddress() (string, error) {
+	vs := vm.vs
+	var mvm mo.VirtualMachine
+	err := vm.mo.Properties(vs.ctx, vm.mo.Reference(), []string{"guest.ipAddress"}, &mvm)
+	if err != nil {
+		return "", err
+	}
+	if mvm.Guest == nil {
+		return "", nil
+	}
+	return mvm.Guest.IpAddress, nil
+}
+
+// DiskFiles returns the files backing the VM's disks, as datastore paths like
+// "[datastore] dir/disk.vmdk". Non-persistent disks are backed by their
+// source image.
+func (vm *VirtualMachine) DiskFiles() ([]string, error) {
+	vs := vm.vs
+	var mvm mo.VirtualMachine
+	err := vm.mo.Properties(vs.ctx, vm.mo.Reference(), []string{"config.hardware.device"}, &mvm)
+	if err != nil {
+		return nil, err
+	}
+	if mvm.Config == nil {
+		return nil, nil
+	}
+	files := []string{}
+	for _, device := range mvm.Config.Hardware.Device {
+		disk, ok := device.(*types.VirtualDisk)
+		if !ok {
+			continue
+		}
+		if backing, ok := disk.Backing.(types.BaseVirtualDeviceFileBackingInfo); ok {
+			files = append(files, backing.GetVirtualDeviceFileBackingInfo().FileName)
+		}
+	}
+	return files, nil
+}
+
+// GuestInfo returns the value of a guestinfo key set when the VM was created,
+// or an empty string if it isn't set
+func (vm *VirtualMachine) GuestInfo(key string) (string, error) {
+	vs := vm.vs
+	var mvm mo.VirtualMachine
+	err := vm.mo.Properties(vs.ctx, vm.mo.Reference(), []string{"config.extraConfig"}, &mvm)
+	if err != nil {
+		return "", err
+	}
+	if mvm.Config == nil {
+		return "", nil
+	}
+	for _, opt := range mvm.Config.ExtraConfig {
+		if ov := opt.GetOptionValue(); ov.Key == "guestinfo."+key {
+			return fmt.Sprintf("%v", ov.Value), nil
+		}
+	}
+	return "", nil
+}
+
+// IsHealthy returns whether the VM is connected and powered on
+func (vm *VirtualMachine) IsHealthy() (bool, error) {
+	vs := vm.vs
+	var mvm mo.VirtualMachine
+	err := vm.mo.Properties(vs.ctx, vm.mo.Reference(), []string{"runtime"}, &mvm)
+	if err != nil {
+		return false, err
+	}
+	return mvm.Runtime.ConnectionState == types.VirtualMachineConnectionStateConnected &&
+		mvm.Runtime.PowerState == types.VirtualMachinePowerStatePoweredOn, nil
+}
+
+// VirtualMachineDisks describes the disk files attached to a VM
+type VirtualMachineDisks struct {
+	Name      string
+	Template  bool
+	PoweredOn bool
+	Disks     []string
+}
+
+// ListVirtualMachineDisks returns the disk files attached to each VM in a
+// folder, as datastore paths like "[datastore] dir/disk.vmdk"
+func (vs *Session) ListVirtualMachineDisks(folderPath string) ([]VirtualMachineDisks, error) {
+	finder, err := vs.getFinder()
+	if err != nil {
+		return nil, err
+	}
+	debugf("finder.VirtualMachineList(%s/*)", folderPath)
+	vms, err := finder.VirtualMachineList(vs.ctx, folderPath+"/*")
+	if err != nil {
+		if _, ok := err.(*find.NotFoundError); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	refs := []types.ManagedObjectReference{}
+	for _, vm := range vms {
+		refs = append(refs, vm.Reference())
+	}
+
+	var mvms []mo.VirtualMachine
+	pc := property.DefaultCollector(vs.client.Client)
+	err = pc.Retrieve(vs.ctx, refs, []string{"name", "config", "runtime.powerState"}, &mvms)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []VirtualMachineDisks{}
+	for _, mvm := range mvms {
+		vmd := VirtualMachineDisks{
+			Name:      mvm.Name,
+			PoweredOn: mvm.Runtime.PowerState == types.VirtualMachinePowerStatePoweredOn,
+		}
+		if mvm.Config != nil {
+			vmd.Template = mvm.Config.Template
+			for _, device := range mvm.Config.Hardware.Device {
+				disk, ok := device.(*types.VirtualDisk)
+				if !ok {
+					continue
+				}
+				if backing, ok := disk.Backing.(types.BaseVirtualDeviceFileBackingInfo); ok {
+					vmd.Disks = append(vmd.Disks, backing.GetVirtualDeviceFileBackingInfo().FileName)
+				}
+			}
+		}
+		result = append(result, vmd)
+	}
+	return result, nil
+}
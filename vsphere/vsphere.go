@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"log"
 	"net/url"
+	"sync"
 	"time"
 
 	"github.com/vmware/govmomi"
@@ -17,6 +18,7 @@ import (
 	"github.com/vmware/govmomi/session"
 	"github.com/vmware/govmomi/vim25"
 	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/mo"
 	"github.com/vmware/govmomi/vim25/soap"
 	"github.com/vmware/govmomi/vim25/types"
 )
@@ -34,27 +36,33 @@ type ConnectionParams struct {
 // Session holds state for a vSphere session;
 // client connection, context, session-cached values
 type Session struct {
+	sync.Mutex
+
 	client     *govmomi.Client
 	ctx        context.Context
 	datacenter *object.Datacenter
 	finder     *find.Finder
+	user       *url.Userinfo
 }
 
 // VirtualMachineCreationParams is passed by calling code to Session.CreateVM()
 type VirtualMachineCreationParams struct {
-	BuildkiteAgentToken string
-	ClusterPath         string
-	VirtualMachinePath  string
-	DatastoreName       string
-	GuestID             string
-	MemoryMB            int64
-	Name                string
-	NetworkLabel        string
-	NumCPUs             int32
-	NumCoresPerSocket   int32
-	SrcDiskDataStore    string
-	SrcDiskPath         string
-	GuestInfo           map[string]string
+	ClusterPath        string
+	VirtualMachinePath string
+	DatastoreName      string
+	HostName           string
+	JobID              string
+	GuestID            string
+	MemoryMB           int64
+	Name               string
+	NetworkLabel       string
+	NumCPUs            int32
+	NumCoresPerSocket  int32
+	SrcDiskDataStore   string
+	SrcDiskPath        string
+	PersistentDisk     bool
+	SerialLog          bool
+	GuestInfo          map[string]string
 }
 
 // NewSession logs in to a new Session based on ConnectionParams
@@ -73,12 +81,15 @@ func (s *Session) connect(ctx context.Context, cp ConnectionParams) error {
 		return err
 	}
 
-	u.User = url.UserPassword(cp.User, cp.Pass)
+	s.user = url.UserPassword(cp.User, cp.Pass)
 	soapClient := soap.NewClient(u, cp.Insecure)
 	soapClient.Version = "6.0" // Pin to 6.0 until we need 6.5+ specific API
 
 	var login = func(ctx context.Context) error {
-		return s.client.Login(ctx, u.User)
+		s.Lock()
+		user := s.user
+		s.Unlock()
+		return s.client.Login(ctx, user)
 	}
 
 	vimClient, err := vim25.NewClient(ctx, soapClient)
@@ -113,6 +124,14 @@ func (s *Session) connect(ctx context.Context, cp ConnectionParams) error {
 	return login(ctx)
 }
 
+// UpdatePassword changes the password used when the session next needs to
+// log in again, e.g. after the password is rotated
+func (vs *Session) UpdatePassword(pass string) {
+	vs.Lock()
+	defer vs.Unlock()
+	vs.user = url.UserPassword(vs.user.Username(), pass)
+}
+
 func (vs *Session) VirtualMachine(path string) (*VirtualMachine, error) {
 	finder, err := vs.getFinder()
 	if err != nil {
@@ -150,24 +169,81 @@ func (vs *Session) CreateVM(params VirtualMachineCreationParams) (*VirtualMachin
 	if err != nil {
 		return nil, err
 	}
+	var host *object.HostSystem
+	if params.HostName != "" {
+		hostPath := params.ClusterPath + "/" + params.HostName
+		debugf("finder.HostSystem(%s)", hostPath)
+		host, err = finder.HostSystem(vs.ctx, hostPath)
+		if err != nil {
+			return nil, err
+		}
+	}
 	configSpec, err := vs.createConfigSpec(params)
 	if err != nil {
 		return nil, err
 	}
-	debugf("folder.CreateVM %s on %s", params.Name, resourcePool)
-	task, err := folder.CreateVM(vs.ctx, configSpec, resourcePool, nil)
+	debugf("folder.CreateVM %s on %s (host %q)", params.Name, resourcePool, params.HostName)
+	task, err := folder.CreateVM(vs.ctx, configSpec, resourcePool, host)
 	if err != nil {
 		return nil, err
 	}
 	debugf("waiting for CreateVM %v", task)
-	if err := task.Wait(vs.ctx); err != nil {
+	info, err := task.WaitForResult(vs.ctx, nil)
+	if err != nil {
 		return nil, err
 	}
-	vm, err := vs.VirtualMachine(folder.InventoryPath + "/" + params.Name)
+	ref, ok := info.Result.(types.ManagedObjectReference)
+	if !ok {
+		return nil, fmt.Errorf("CreateVM %s returned unexpected result %v", params.Name, info.Result)
+	}
+	obj := object.NewVirtualMachine(vs.client.Client, ref)
+	obj.SetInventoryPath(folder.InventoryPath + "/" + params.Name)
+	vm := &VirtualMachine{
+		vs:   vs,
+		mo:   obj,
+		Name: params.Name,
+	}
+	if params.SerialLog {
+		// the serial log only helps debugging, so the VM is still usable
+		// without it
+		if err := vm.addSerialLog(); err != nil {
+			debugf("Error adding serial log to %s: %v", vm.Name, err)
+		}
+	}
+	return vm, nil
+}
+
+// ClusterHosts returns the names of the connected hosts in a cluster that
+// aren't in maintenance mode
+func (vs *Session) ClusterHosts(clusterPath string) ([]string, error) {
+	finder, err := vs.getFinder()
 	if err != nil {
 		return nil, err
 	}
-	return vm, nil
+	debugf("finder.ClusterComputeResource(%s)", clusterPath)
+	cluster, err := finder.ClusterComputeResource(vs.ctx, clusterPath)
+	if err != nil {
+		return nil, err
+	}
+	hosts, err := cluster.Hosts(vs.ctx)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, host := range hosts {
+		var mh mo.HostSystem
+		err := host.Properties(vs.ctx, host.Reference(), []string{"name", "runtime"}, &mh)
+		if err != nil {
+			return nil, err
+		}
+		if mh.Runtime.ConnectionState != types.HostSystemConnectionStateConnected ||
+			mh.Runtime.InMaintenanceMode {
+			debugf("skipping host %s (%s)", mh.Name, mh.Runtime.ConnectionState)
+			continue
+		}
+		names = append(names, mh.Name)
+	}
+	return names, nil
 }
 
 func (vs *Session) vmFolder() (*object.Folder, error) {
@@ -208,14 +284,20 @@ func (vs *Session) createConfigSpec(params VirtualMachineCreationParams) (cs typ
 	}
 
 	extraConfig := []types.BaseOptionValue{
-		&types.OptionValue{Key: "guestinfo.vmkite-buildkite-agent-token", Value: params.BuildkiteAgentToken},
 		&types.OptionValue{Key: "guestinfo.vmkite-name", Value: params.Name},
 		&types.OptionValue{Key: "guestinfo.vmkite-vmdk", Value: params.SrcDiskPath},
 	}
 
+	if params.JobID != "" {
+		extraConfig = append(extraConfig,
+			&types.OptionValue{Key: "guestinfo.vmkite-job-id", Value: params.JobID},
+		)
+	}
+
 	if params.GuestInfo != nil {
 		for key, val := range params.GuestInfo {
-			debugf("setting guestinfo.%s=%q", key, val)
+			// values may be tokens or user secrets, so only log the key
+			debugf("setting guestinfo.%s", key)
 			extraConfig = append(extraConfig,
 				&types.OptionValue{Key: "guestinfo." + key, Value: val},
 			)
@@ -317,6 +399,9 @@ func addDisk(devices object.VirtualDeviceList, vs *Session, params VirtualMachin
 	backing := disk.Backing.(*types.VirtualDiskFlatVer2BackingInfo)
 	backing.ThinProvisioned = types.NewBool(true)
 	backing.DiskMode = string(types.VirtualDiskModeIndependent_nonpersistent)
+	if params.PersistentDisk {
+		backing.DiskMode = string(types.VirtualDiskModePersistent)
+	}
 
 	return append(devices, disk), nil
 }
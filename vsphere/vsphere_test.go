@@ -0,0 +1,353 @@
+package vsphere
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/macstadium/vmkite/vsphere/vspheretest"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const testBaseDisk = "macos/macos.vmdk"
+
+// newTestSession starts a simulator with a base disk image on its first
+// datastore and logs in to it
+func newTestSession(t *testing.T) (*Session, *vspheretest.Simulator) {
+	sim, err := vspheretest.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sim.WriteDisk(sim.Datastores[0], testBaseDisk); err != nil {
+		sim.Close()
+		t.Fatal(err)
+	}
+	vs, err := NewSession(context.Background(), ConnectionParams{
+		Host:     sim.Host,
+		User:     sim.User,
+		Pass:     sim.Pass,
+		Insecure: true,
+	})
+	if err != nil {
+		sim.Close()
+		t.Fatal(err)
+	}
+	return vs, sim
+}
+
+func testParams(sim *vspheretest.Simulator, name string) VirtualMachineCreationParams {
+	return VirtualMachineCreationParams{
+		ClusterPath:       sim.ClusterPath,
+		DatastoreName:     sim.Datastores[1],
+		JobID:             "job-1",
+		GuestID:           "darwin16_64Guest",
+		MemoryMB:          4096,
+		Name:              name,
+		NetworkLabel:      sim.Network,
+		NumCPUs:           2,
+		NumCoresPerSocket: 1,
+		SrcDiskDataStore:  sim.Datastores[0],
+		SrcDiskPath:       testBaseDisk,
+		GuestInfo:         map[string]string{"vmkite-api": "10.0.0.2:8080"},
+	}
+}
+
+func (vm *VirtualMachine) config(t *testing.T) *types.VirtualMachineConfigInfo {
+	var mvm mo.VirtualMachine
+	if err := vm.mo.Properties(vm.vs.ctx, vm.mo.Reference(), []string{"config"}, &mvm); err != nil {
+		t.Fatal(err)
+	}
+	return mvm.Config
+}
+
+func TestCreateVM(t *testing.T) {
+	vs, sim := newTestSession(t)
+	defer sim.Close()
+
+	vm, err := vs.CreateVM(testParams(sim, "vmkite-job-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := vm.config(t)
+	if config.GuestId != "darwin16_64Guest" || config.Hardware.MemoryMB != 4096 || config.Hardware.NumCPU != 2 {
+		t.Errorf("guest %s with %d MB and %d CPUs", config.GuestId, config.Hardware.MemoryMB, config.Hardware.NumCPU)
+	}
+	if ds, _, err := vm.Directory(); err != nil || ds != sim.Datastores[1] {
+		t.Errorf("VM placed on %q (%v), want %s", ds, err, sim.Datastores[1])
+	}
+
+	// the disk is the base image, not a copy of it
+	files, err := vm.DiskFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[" + sim.Datastores[0] + "] " + testBaseDisk
+	if len(files) != 1 || files[0] != want {
+		t.Errorf("disk files = %v, want %s", files, want)
+	}
+
+	for key, want := range map[string]string{"vmkite-api": "10.0.0.2:8080", "vmkite-job-id": "job-1", "vmkite-name": "vmkite-job-1"} {
+		if val, err := vm.GuestInfo(key); err != nil || val != want {
+			t.Errorf("guestinfo.%s = %q (%v), want %q", key, val, err, want)
+		}
+	}
+
+	if err := vm.PowerOn(); err != nil {
+		t.Fatal(err)
+	}
+	if healthy, err := vm.IsHealthy(); err != nil || !healthy {
+		t.Errorf("IsHealthy = %v, %v", healthy, err)
+	}
+	host, err := vm.HostName()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(host, "DC0_C0_H") {
+		t.Errorf("VM placed on host %q outside the cluster", host)
+	}
+}
+
+func TestCreateVMOnHost(t *testing.T) {
+	vs, sim := newTestSession(t)
+	defer sim.Close()
+
+	params := testParams(sim, "vmkite-job-1")
+	params.HostName = sim.Hosts[2]
+	vm, err := vs.CreateVM(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host, err := vm.HostName(); err != nil || host != sim.Hosts[2] {
+		t.Errorf("VM placed on %q (%v), want %s", host, err, sim.Hosts[2])
+	}
+
+	params.Name = "vmkite-job-2"
+	params.HostName = "no-such-host"
+	if _, err := vs.CreateVM(params); err == nil {
+		t.Error("created a VM on a host that doesn't exist")
+	}
+}
+
+func TestAddEthernet(t *testing.T) {
+	vs, sim := newTestSession(t)
+	defer sim.Close()
+
+	devices, err := addEthernet(object.VirtualDeviceList{}, vs, sim.Network)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 1 {
+		t.Fatalf("got %d devices, want 1", len(devices))
+	}
+	card, ok := devices[0].(*types.VirtualVmxnet3)
+	if !ok {
+		t.Fatalf("device is a %T, want vmxnet3", devices[0])
+	}
+	backing, ok := card.Backing.(*types.VirtualEthernetCardDistributedVirtualPortBackingInfo)
+	if !ok {
+		t.Fatalf("card is backed by a %T, want a distributed portgroup", card.Backing)
+	}
+	if backing.Port.PortgroupKey == "" || backing.Port.SwitchUuid == "" {
+		t.Errorf("port = %+v", backing.Port)
+	}
+	if card.AddressType != string(types.VirtualEthernetCardMacTypeGenerated) {
+		t.Errorf("address type = %s", card.AddressType)
+	}
+
+	if _, err := addEthernet(object.VirtualDeviceList{}, vs, "no-such-network"); err == nil {
+		t.Error("added a card on a network that doesn't exist")
+	}
+}
+
+func TestAddDisk(t *testing.T) {
+	vs, sim := newTestSession(t)
+	defer sim.Close()
+
+	tests := []struct {
+		persistent bool
+		mode       types.VirtualDiskMode
+	}{
+		{false, types.VirtualDiskModeIndependent_nonpersistent},
+		{true, types.VirtualDiskModePersistent},
+	}
+	for _, test := range tests {
+		devices, err := addSCSI(object.VirtualDeviceList{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		params := testParams(sim, "vmkite-job-1")
+		params.PersistentDisk = test.persistent
+		devices, err = addDisk(devices, vs, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		disks := devices.SelectByType((*types.VirtualDisk)(nil))
+		if len(disks) != 1 {
+			t.Fatalf("got %d disks, want 1", len(disks))
+		}
+		backing := disks[0].GetVirtualDevice().Backing.(*types.VirtualDiskFlatVer2BackingInfo)
+		if backing.DiskMode != string(test.mode) || backing.ThinProvisioned == nil || !*backing.ThinProvisioned {
+			t.Errorf("persistent=%v: mode %s, thin %v", test.persistent, backing.DiskMode, backing.ThinProvisioned)
+		}
+		if want := "[" + sim.Datastores[0] + "] " + testBaseDisk; backing.FileName != want {
+			t.Errorf("disk file = %s, want %s", backing.FileName, want)
+		}
+	}
+
+	params := testParams(sim, "vmkite-job-1")
+	params.SrcDiskDataStore = "no-such-datastore"
+	devices, _ := addSCSI(object.VirtualDeviceList{})
+	if _, err := addDisk(devices, vs, params); err == nil {
+		t.Error("added a disk on a datastore that doesn't exist")
+	}
+}
+
+func TestSerialLog(t *testing.T) {
+	vs, sim := newTestSession(t)
+	defer sim.Close()
+
+	params := testParams(sim, "vmkite-job-1")
+	params.SerialLog = true
+	vm, err := vs.CreateVM(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds, logDir, err := vm.LogDirectory()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ports := object.VirtualDeviceList(vm.config(t).Hardware.Device).SelectByType((*types.VirtualSerialPort)(nil))
+	if len(ports) != 1 {
+		t.Fatalf("got %d serial ports, want 1", len(ports))
+	}
+	backing := ports[0].GetVirtualDevice().Backing.(*types.VirtualSerialPortFileBackingInfo)
+	if want := "[" + ds + "] " + logDir + "/" + serialLogFile; backing.FileName != want {
+		t.Errorf("serial log = %s, want %s", backing.FileName, want)
+	}
+}
+
+func TestDestroy(t *testing.T) {
+	vs, sim := newTestSession(t)
+	defer sim.Close()
+
+	on, err := vs.CreateVM(testParams(sim, "vmkite-job-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := on.PowerOn(); err != nil {
+		t.Fatal(err)
+	}
+	off, err := vs.CreateVM(testParams(sim, "vmkite-job-2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, vm := range []*VirtualMachine{on, off} {
+		ds, dir, err := vm.Directory()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := vm.Destroy(true); err != nil {
+			t.Fatalf("%s: %v", vm.Name, err)
+		}
+		if _, err := vs.VirtualMachine(vm.Name); err == nil {
+			t.Errorf("%s: VM still exists", vm.Name)
+		}
+		if exists, err := vs.FileExists(ds, dir); err != nil || exists {
+			t.Errorf("%s: directory exists = %v, %v", vm.Name, exists, err)
+		}
+	}
+	if names, err := sim.VMs(); err != nil || len(names) != 0 {
+		t.Errorf("VMs left = %v, %v", names, err)
+	}
+}
+
+func TestClusterHosts(t *testing.T) {
+	vs, sim := newTestSession(t)
+	defer sim.Close()
+
+	hosts, err := vs.ClusterHosts(sim.ClusterPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(hosts)
+	if strings.Join(hosts, ",") != strings.Join(sim.Hosts, ",") {
+		t.Errorf("hosts = %v, want %v", hosts, sim.Hosts)
+	}
+}
+
+func TestDatastoreStats(t *testing.T) {
+	vs, sim := newTestSession(t)
+	defer sim.Close()
+
+	if _, err := vs.CreateVM(testParams(sim, "vmkite-job-1")); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := vs.DatastoreStats(sim.Datastores)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 2 {
+		t.Fatalf("got %d stats, want 2", len(stats))
+	}
+	for i, s := range stats {
+		if s.Name != sim.Datastores[i] || !s.Accessible || s.Capacity <= 0 || s.FreeSpace <= 0 {
+			t.Errorf("stats = %+v", s)
+		}
+	}
+	// the VM counts on both the datastore holding its files and the one
+	// holding its base disk
+	if stats[0].VMCount != 1 || stats[1].VMCount != 1 {
+		t.Errorf("VM counts = %d, %d, want 1, 1", stats[0].VMCount, stats[1].VMCount)
+	}
+
+	if _, err := vs.DatastoreStats([]string{"no-such-datastore"}); err == nil {
+		t.Error("got stats for a datastore that doesn't exist")
+	}
+}
+
+func TestGuestInfoValuesNotLogged(t *testing.T) {
+	vs, sim := newTestSession(t)
+	defer sim.Close()
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	params := testParams(sim, "vmkite-job-1")
+	params.GuestInfo["vmkite-bootstrap-token"] = "bootstrap-secret"
+	params.GuestInfo["api-key"] = "user-secret"
+	if _, err := vs.CreateVM(params); err != nil {
+		t.Fatal(err)
+	}
+
+	logged := buf.String()
+	if !strings.Contains(logged, "setting guestinfo.api-key") {
+		t.Errorf("guestinfo key not logged:\n%s", logged)
+	}
+	for _, secret := range []string{"bootstrap-secret", "user-secret"} {
+		if strings.Contains(logged, secret) {
+			t.Errorf("%s logged:\n%s", secret, logged)
+		}
+	}
+}
+
+func TestDiskCapacity(t *testing.T) {
+	vs, sim := newTestSession(t)
+	defer sim.Close()
+
+	if _, err := vs.DiskCapacity(sim.Datastores[0], testBaseDisk); err != nil {
+		t.Error(err)
+	}
+	if _, err := vs.DiskCapacity(sim.Datastores[0], "macos/missing.vmdk"); err == nil {
+		t.Error("got the capacity of a disk that doesn't exist")
+	}
+}
@@ -0,0 +1,165 @@
+// Package vspheretest runs govmomi's vCenter simulator, vcsim, in-process
+// with a cluster of hosts, datastores and a distributed portgroup, for
+// testing creating and destroying VMs without a vCenter
+package vspheretest
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25/mo"
+)
+
+// Simulator is a simulated vCenter. Only one can run at a time, as vcsim
+// keeps its inventory in a global registry.
+type Simulator struct {
+	model  *simulator.Model
+	server *simulator.Server
+	client *govmomi.Client
+	finder *find.Finder
+	ctx    context.Context
+
+	// Host, User and Pass log in to the simulator, which uses a self-signed
+	// certificate
+	Host string
+	User string
+	Pass string
+
+	// ClusterPath is the cluster's inventory path and Hosts the names of
+	// its hosts
+	ClusterPath string
+	Hosts       []string
+	// Datastores are the names of the datastores shared by the hosts
+	Datastores []string
+	// Network is the name of the distributed portgroup
+	Network string
+}
+
+// New starts a simulated vCenter with one datacenter, a cluster of three
+// hosts, two datastores and a distributed portgroup, but no VMs. The caller
+// should Close it when done.
+func New() (*Simulator, error) {
+	model := simulator.VPX()
+	model.Host = 0
+	model.Machine = 0
+	model.Datastore = 2
+	if err := model.Create(); err != nil {
+		return nil, err
+	}
+	model.Service.TLS = new(tls.Config)
+	server := model.Service.NewServer()
+
+	s := &Simulator{
+		model:       model,
+		server:      server,
+		ctx:         context.Background(),
+		Host:        server.URL.Host,
+		User:        server.URL.User.Username(),
+		ClusterPath: "/DC0/host/DC0_C0",
+		Hosts:       []string{"DC0_C0_H0", "DC0_C0_H1", "DC0_C0_H2"},
+		Datastores:  []string{"LocalDS_0", "LocalDS_1"},
+		Network:     "DC0_DVPG0",
+	}
+	s.Pass, _ = server.URL.User.Password()
+
+	client, err := govmomi.NewClient(s.ctx, server.URL, true)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.client = client
+	s.finder = find.NewFinder(client.Client, true)
+	dc, err := s.finder.DefaultDatacenter(s.ctx)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.finder.SetDatacenter(dc)
+	return s, nil
+}
+
+// Close stops the simulator and removes its datastores' files
+func (s *Simulator) Close() {
+	if s.client != nil {
+		s.client.Logout(s.ctx)
+	}
+	s.server.Close()
+	s.model.Remove()
+}
+
+// WriteFile creates a file on a datastore, e.g. a base disk image
+func (s *Simulator) WriteFile(datastore, path string, data []byte) error {
+	dir, err := s.datastoreDir(datastore)
+	if err != nil {
+		return err
+	}
+	file := filepath.Join(dir, filepath.FromSlash(path))
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, data, 0644)
+}
+
+// WriteDisk creates an empty disk image on a datastore, i.e. its descriptor
+// and its flat extent, for VMs to use as their base disk
+func (s *Simulator) WriteDisk(datastore, path string) error {
+	if err := s.WriteFile(datastore, path, []byte("# Disk DescriptorFile\n")); err != nil {
+		return err
+	}
+	flat := strings.TrimSuffix(path, ".vmdk") + "-flat.vmdk"
+	return s.WriteFile(datastore, flat, nil)
+}
+
+// datastoreDir returns the local directory backing a datastore
+func (s *Simulator) datastoreDir(datastore string) (string, error) {
+	ds, err := s.finder.Datastore(s.ctx, datastore)
+	if err != nil {
+		return "", err
+	}
+	var mds mo.Datastore
+	if err := ds.Properties(s.ctx, ds.Reference(), []string{"info"}, &mds); err != nil {
+		return "", err
+	}
+	return mds.Info.GetDatastoreInfo().Url, nil
+}
+
+// VMs returns the names of the VMs in the inventory
+func (s *Simulator) VMs() ([]string, error) {
+	vms, err := s.finder.VirtualMachineList(s.ctx, "*")
+	if _, ok := err.(*find.NotFoundError); ok {
+		return []string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, vm := range vms {
+		names = append(names, vm.Name())
+	}
+	return names, nil
+}
+
+// VM returns a VM in the inventory by name
+func (s *Simulator) VM(name string) (*object.VirtualMachine, error) {
+	return s.finder.VirtualMachine(s.ctx, name)
+}
+
+// PowerOff powers a VM off, as its guest does once the job is done
+func (s *Simulator) PowerOff(name string) error {
+	vm, err := s.VM(name)
+	if err != nil {
+		return err
+	}
+	task, err := vm.PowerOff(s.ctx)
+	if err != nil {
+		return err
+	}
+	return task.Wait(s.ctx)
+}